@@ -0,0 +1,39 @@
+// Command optikon-e2e runs the end to end scenarios of the harness package and
+// exits with status 1 if any of them fails.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+
+	"wwwin-github.cisco.com/edge/optikon-dns/harness"
+)
+
+func main() {
+	run := flag.String("run", "", "only run the scenarios whose name matches this regular expression")
+	flag.Parse()
+
+	match, err := regexp.Compile(*run)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "optikon-e2e: %s\n", err)
+		os.Exit(2)
+	}
+
+	failed := 0
+	for _, s := range harness.Scenarios {
+		if !match.MatchString(s.Name) {
+			continue
+		}
+		if err := harness.RunScenario(s); err != nil {
+			fmt.Printf("FAIL %s: %s\n", s.Name, err)
+			failed++
+			continue
+		}
+		fmt.Printf("ok   %s\n", s.Name)
+	}
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// link relays the UDP queries of an edge to central, delaying and dropping
+// them as configured for the Link of its site.
+type link struct {
+	Link
+	central string
+	pc      net.PacketConn
+
+	sync.RWMutex
+	start time.Time // Of the workload, outages are relative to it.
+}
+
+// startLink starts relaying queries sent to the address of the returned link
+// to central.
+func startLink(l Link, central string) (*link, error) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	ln := &link{Link: l, central: central, pc: pc}
+	go ln.serve()
+	return ln, nil
+}
+
+// addr returns the address edges send their queries to.
+func (l *link) addr() string { return l.pc.LocalAddr().String() }
+
+// begin marks the start of the workload.
+func (l *link) begin(now time.Time) {
+	l.Lock()
+	l.start = now
+	l.Unlock()
+}
+
+// down reports whether the link is in one of its outages at now.
+func (l *link) down(now time.Time) bool {
+	l.RLock()
+	start := l.start
+	l.RUnlock()
+	if start.IsZero() {
+		return false
+	}
+	at := now.Sub(start)
+	for _, o := range l.Failures {
+		if at >= o.Start.Duration && at < o.End.Duration {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *link) close() error { return l.pc.Close() }
+
+func (l *link) serve() {
+	buf := make([]byte, maxMsgSize)
+	for {
+		n, from, err := l.pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		q := make([]byte, n)
+		copy(q, buf[:n])
+		go l.relay(q, from)
+	}
+}
+
+// relay sends the query q to central and its reply back to from, each way
+// taking half the latency of the link.
+func (l *link) relay(q []byte, from net.Addr) {
+	if l.down(time.Now()) || rand.Float64() < l.Loss {
+		return
+	}
+	time.Sleep(l.Latency.Duration / 2)
+
+	conn, err := net.Dial("udp", l.central)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(relayTimeout))
+	if _, err := conn.Write(q); err != nil {
+		return
+	}
+	buf := make([]byte, maxMsgSize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return
+	}
+
+	time.Sleep(l.Latency.Duration / 2)
+	l.pc.WriteTo(buf[:n], from)
+}
+
+const (
+	maxMsgSize   = 65535
+	relayTimeout = 5 * time.Second
+)
@@ -0,0 +1,124 @@
+// Command optikon-sim simulates a topology of edge sites in-process, to check
+// how DNS queries are routed without booting a cluster. It runs
+// optikon-central and an optikon-edge per site, each in a CoreDNS server on a
+// loopback port, relays the queries of the edges to central over simulated
+// links, replays a query workload against the edges and reports, per edge, the
+// distribution of the answers over the sites, the latency of the queries and
+// the violations of the SLO. It exits with status 1 if the SLO was violated.
+//
+// The topology is a JSON or YAML file, for example
+//
+//	sites:
+//	- name: copenhagen
+//	  ip: 10.0.0.1
+//	  lat: 55.6761
+//	  lon: 12.5683
+//	  link: {latency: 20ms}
+//	- name: new-york
+//	  ip: 10.0.0.2
+//	  lat: 40.7128
+//	  lon: -74.0060
+//	  link:
+//	    latency: 90ms
+//	    loss: 0.01
+//	    failures: [{start: 10s, end: 20s}]
+//	services:
+//	  nginx.default.svc.cluster.external: [copenhagen, new-york]
+//	edge: [cache, serve_stale]
+//	workload: {duration: 30s, rate: 50}
+//	slo: {latency: 250ms, distance: 2000}
+//
+// Names are under the domain cluster.external unless the topology sets another
+// domain. Links delay queries by half their round trip time each way, drop the
+// fraction loss of them, and drop all of them during failures, which are
+// relative to the start of the workload. Only queries over UDP are relayed.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"wwwin-github.cisco.com/edge/optikon-dns/harness"
+)
+
+func main() {
+	topology := flag.String("topology", "topology.yaml", "file with the topology to simulate")
+	asJSON := flag.Bool("json", false, "write the report as JSON")
+	flag.Parse()
+
+	t, err := loadTopology(*topology)
+	if err != nil {
+		fatal(err)
+	}
+	reports, err := simulate(t)
+	if err != nil {
+		fatal(err)
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(reports)
+	} else {
+		err = writeText(os.Stdout, reports)
+	}
+	if err != nil {
+		fatal(err)
+	}
+
+	for _, r := range reports {
+		if r.Violations > 0 {
+			os.Exit(1)
+		}
+	}
+}
+
+// simulate starts the servers and links of t, replays its workload and
+// returns the report of every edge.
+func simulate(t *Topology) ([]edgeReport, error) {
+	dir, err := ioutil.TempDir("", "optikon-sim")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := harness.Central(filepath.Join(dir, "table.json"), t.table())
+	if err != nil {
+		return nil, err
+	}
+	defer c.Stop()
+
+	links := make([]*link, len(t.Sites))
+	addrs := make([]string, len(t.Sites))
+	for i, s := range t.Sites {
+		l, err := startLink(s.Link, c.Addr)
+		if err != nil {
+			return nil, err
+		}
+		defer l.close()
+		links[i] = l
+
+		e, err := harness.Edge(s.Lat, s.Lon, t.Domain, []string{l.addr()}, t.Edge...)
+		if err != nil {
+			return nil, fmt.Errorf("edge %s: %s", s.Name, err)
+		}
+		defer e.Stop()
+		addrs[i] = e.Addr
+	}
+
+	now := time.Now()
+	for _, l := range links {
+		l.begin(now)
+	}
+	return summarize(t, replay(t, addrs)), nil
+}
+
+func fatal(err error) {
+	fmt.Fprintf(os.Stderr, "optikon-sim: %s\n", err)
+	os.Exit(2)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"wwwin-github.cisco.com/edge/optikon-dns/plugin/edge"
+)
+
+// edgeReport summarizes the queries sent to the edge of a site.
+type edgeReport struct {
+	Edge       string             `json:"edge"`
+	Queries    int                `json:"queries"`
+	Failed     int                `json:"failed"`
+	P50        Duration           `json:"p50"`
+	P99        Duration           `json:"p99"`
+	Violations int                `json:"slo_violations"`
+	Sites      map[string]float64 `json:"sites"` // Fraction of the answers per site.
+}
+
+// summarize returns the report of every edge in t, in the order of the sites.
+func summarize(t *Topology, results []result) []edgeReport {
+	coords := make(map[string]Site, len(t.Sites))
+	for _, s := range t.Sites {
+		coords[s.Name] = s
+	}
+
+	reports := make([]edgeReport, len(t.Sites))
+	latencies := make([][]time.Duration, len(t.Sites))
+	for i, s := range t.Sites {
+		reports[i] = edgeReport{Edge: s.Name, Sites: make(map[string]float64)}
+	}
+	for _, r := range results {
+		rep := &reports[r.edge]
+		rep.Queries++
+		latencies[r.edge] = append(latencies[r.edge], r.latency)
+		if r.err != nil {
+			rep.Failed++
+			rep.Violations++
+			continue
+		}
+		rep.Sites[r.site]++
+		if t.SLO.Latency.Duration > 0 && r.latency > t.SLO.Latency.Duration {
+			rep.Violations++
+			continue
+		}
+		from, to := t.Sites[r.edge], coords[r.site]
+		if t.SLO.Distance > 0 && edge.Distance(from.Lat, from.Lon, to.Lat, to.Lon) > t.SLO.Distance {
+			rep.Violations++
+		}
+	}
+
+	for i := range reports {
+		rep := &reports[i]
+		if answered := rep.Queries - rep.Failed; answered > 0 {
+			for site, n := range rep.Sites {
+				rep.Sites[site] = n / float64(answered)
+			}
+		}
+		rep.P50.Duration = percentile(latencies[i], 0.50)
+		rep.P99.Duration = percentile(latencies[i], 0.99)
+	}
+	return reports
+}
+
+// percentile returns the p-th percentile of latencies, which it sorts.
+func percentile(latencies []time.Duration, p float64) time.Duration {
+	if len(latencies) == 0 {
+		return 0
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	return latencies[int(float64(len(latencies)-1)*p)]
+}
+
+// writeText writes reports as a table.
+func writeText(w io.Writer, reports []edgeReport) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "EDGE\tQUERIES\tFAILED\tP50\tP99\tSLO VIOLATIONS\tSITES")
+	for _, r := range reports {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t%s\t%d\t%s\n",
+			r.Edge, r.Queries, r.Failed, r.P50.Round(time.Microsecond), r.P99.Round(time.Microsecond),
+			r.Violations, distribution(r.Sites))
+	}
+	return tw.Flush()
+}
+
+// distribution formats the fraction of the answers per site, the most
+// answered site first.
+func distribution(sites map[string]float64) string {
+	names := make([]string, 0, len(sites))
+	for name := range sites {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if sites[names[i]] != sites[names[j]] {
+			return sites[names[i]] > sites[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = fmt.Sprintf("%s %.1f%%", name, 100*sites[name])
+	}
+	return strings.Join(parts, ", ")
+}
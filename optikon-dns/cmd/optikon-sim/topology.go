@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/miekg/dns"
+	"wwwin-github.cisco.com/edge/optikon-dns/plugin/central"
+	"wwwin-github.cisco.com/edge/optikon-dns/plugin/codec"
+)
+
+// Topology is the network simulated: the edge sites, each running
+// optikon-edge, the services running on them and the links from the edges to
+// central.
+type Topology struct {
+	// Domain is the FROM of optikon-edge, every service must be under it.
+	Domain   string              `json:"domain"`
+	Sites    []Site              `json:"sites"`
+	Services map[string][]string `json:"services"` // Names of the sites running each service.
+
+	// Edge holds extra properties of every optikon-edge, e.g. "cache".
+	Edge     []string `json:"edge"`
+	Workload Workload `json:"workload"`
+	SLO      SLO      `json:"slo"`
+}
+
+// Site is an edge site, both running optikon-edge and answered with. Only
+// IPv4 addresses are simulated.
+type Site struct {
+	Name string  `json:"name"`
+	IP   string  `json:"ip"`
+	Lat  float64 `json:"lat"`
+	Lon  float64 `json:"lon"`
+	Link Link    `json:"link"` // From the edge to central.
+}
+
+// Link is the network from an edge to central.
+type Link struct {
+	Latency  Duration `json:"latency"` // Round trip time.
+	Loss     float64  `json:"loss"`    // Fraction of the queries dropped.
+	Failures []Outage `json:"failures"`
+}
+
+// Outage is a window of time, relative to the start of the workload, in which
+// a link drops all queries.
+type Outage struct {
+	Start Duration `json:"start"`
+	End   Duration `json:"end"`
+}
+
+// Workload is the queries replayed: every edge gets Rate queries per second
+// for Duration, spread evenly over the services.
+type Workload struct {
+	Duration Duration `json:"duration"`
+	Rate     float64  `json:"rate"`
+}
+
+// SLO is what every query must meet. Queries that fail always violate it.
+type SLO struct {
+	Latency  Duration `json:"latency"`  // 0 for no bound.
+	Distance float64  `json:"distance"` // Kilometers from the edge to the site answered, 0 for no bound.
+}
+
+// Duration is a time.Duration written as a string such as "20ms".
+type Duration struct{ time.Duration }
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	dur, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = dur
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler.
+func (d Duration) MarshalJSON() ([]byte, error) { return json.Marshal(d.String()) }
+
+// loadTopology reads a Topology from a JSON or YAML file, fills in the
+// defaults and validates it.
+func loadTopology(path string) (*Topology, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	t := new(Topology)
+	if err := yaml.Unmarshal(data, t); err != nil {
+		return nil, err
+	}
+
+	if t.Domain == "" {
+		t.Domain = defaultDomain
+	}
+	t.Domain = dns.Fqdn(t.Domain)
+	if t.Workload.Duration.Duration == 0 {
+		t.Workload.Duration.Duration = defaultDuration
+	}
+	if t.Workload.Rate == 0 {
+		t.Workload.Rate = defaultRate
+	}
+
+	if err := t.validate(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *Topology) validate() error {
+	if len(t.Sites) == 0 {
+		return errNoSites
+	}
+	if len(t.Services) == 0 {
+		return errNoServices
+	}
+	names := make(map[string]bool)
+	for _, s := range t.Sites {
+		if s.Name == "" {
+			return errNoSiteName
+		}
+		if names[s.Name] {
+			return fmt.Errorf("duplicate site %q", s.Name)
+		}
+		names[s.Name] = true
+		if ip := net.ParseIP(s.IP); ip == nil || ip.To4() == nil {
+			return fmt.Errorf("site %q: invalid IPv4 address %q", s.Name, s.IP)
+		}
+		if s.Link.Loss < 0 || s.Link.Loss > 1 {
+			return fmt.Errorf("site %q: loss must be between 0 and 1", s.Name)
+		}
+		for _, o := range s.Link.Failures {
+			if o.End.Duration <= o.Start.Duration {
+				return fmt.Errorf("site %q: failure ends before it starts", s.Name)
+			}
+		}
+	}
+	for svc, sites := range t.Services {
+		if !dns.IsSubDomain(t.Domain, dns.Fqdn(svc)) {
+			return fmt.Errorf("service %q is not under %s", svc, t.Domain)
+		}
+		if len(sites) == 0 {
+			return fmt.Errorf("service %q runs on no site", svc)
+		}
+		for _, name := range sites {
+			if !names[name] {
+				return fmt.Errorf("service %q: unknown site %q", svc, name)
+			}
+		}
+	}
+	return nil
+}
+
+// table returns the table of optikon-central for t.
+func (t *Topology) table() central.Table {
+	sites := make(map[string]codec.EdgeSite, len(t.Sites))
+	for _, s := range t.Sites {
+		sites[s.Name] = codec.EdgeSite{IP: s.IP, Lat: s.Lat, Lon: s.Lon}
+	}
+	table := make(central.Table, len(t.Services))
+	for svc, names := range t.Services {
+		var svcSites []codec.EdgeSite
+		for _, name := range names {
+			svcSites = append(svcSites, sites[name])
+		}
+		table[svc] = central.Service{Sites: svcSites}
+	}
+	return table
+}
+
+const (
+	defaultDomain   = "cluster.external."
+	defaultDuration = 10 * time.Second
+	defaultRate     = 10
+)
+
+var (
+	errNoSites    = errors.New("no sites in topology")
+	errNoServices = errors.New("no services in topology")
+	errNoSiteName = errors.New("site without a name")
+)
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"wwwin-github.cisco.com/edge/optikon-dns/harness"
+)
+
+// result is the outcome of a single query of the workload.
+type result struct {
+	edge    int    // Index of the site of the edge queried.
+	site    string // Name of the site answered with, empty if the query failed.
+	latency time.Duration
+	err     error
+}
+
+// replay sends the workload of t to the edges, the edge of site i listening on
+// addrs[i], and returns the results of all queries. Queries are sent at a
+// fixed rate, without waiting for the answers to earlier ones.
+func replay(t *Topology, addrs []string) []result {
+	sites := make(map[string]string, len(t.Sites))
+	for _, s := range t.Sites {
+		sites[s.IP] = s.Name
+	}
+	var services []string
+	for svc := range t.Services {
+		services = append(services, svc)
+	}
+	sort.Strings(services)
+
+	var (
+		mu      sync.Mutex
+		results []result
+		wg      sync.WaitGroup
+	)
+	interval := time.Duration(float64(time.Second) / t.Workload.Rate)
+	deadline := time.Now().Add(t.Workload.Duration.Duration)
+
+	for i, addr := range addrs {
+		wg.Add(1)
+		go func(i int, addr string) {
+			defer wg.Done()
+			tick := time.NewTicker(interval)
+			defer tick.Stop()
+			for n := 0; time.Now().Before(deadline); n++ {
+				wg.Add(1)
+				go func(svc string) {
+					defer wg.Done()
+					r := query(addr, svc, sites)
+					r.edge = i
+					mu.Lock()
+					results = append(results, r)
+					mu.Unlock()
+				}(services[n%len(services)])
+				<-tick.C
+			}
+		}(i, addr)
+	}
+	wg.Wait()
+	return results
+}
+
+// query asks the edge at addr for the address of svc. sites maps the
+// addresses of the sites to their names.
+func query(addr, svc string, sites map[string]string) result {
+	start := time.Now()
+	ret, err := harness.Query(addr, svc, dns.TypeA)
+	r := result{latency: time.Since(start)}
+	if err != nil {
+		r.err = err
+		return r
+	}
+	if ret.Rcode != dns.RcodeSuccess {
+		r.err = fmt.Errorf("rcode %s", dns.RcodeToString[ret.Rcode])
+		return r
+	}
+	for _, rr := range ret.Answer {
+		if a, ok := rr.(*dns.A); ok {
+			r.site = sites[a.A.String()]
+			break
+		}
+	}
+	if r.site == "" {
+		r.err = errNoSite
+	}
+	return r
+}
+
+var errNoSite = errors.New("no address of a site in the answer")
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"wwwin-github.cisco.com/edge/optikon-dns/plugin/central"
+	"wwwin-github.cisco.com/edge/optikon-dns/plugin/codec"
+)
+
+// client talks to the management API and the DNS server of a central.
+type client struct {
+	api   string // Base URL of the management API.
+	dns   string // Address of the DNS server.
+	http  *http.Client
+	token string // Bearer token of the management API, if it requires one.
+}
+
+func newClient(api, dnsAddr string) *client {
+	return &client{api: strings.TrimSuffix(api, "/"), dns: dnsAddr, http: &http.Client{Timeout: timeout}}
+}
+
+// authenticate sets up c to authenticate to the management API with the
+// bearer token in tokenFile, or $OPTIKON_TOKEN, and the client certificate
+// cert with key. ca replaces the system roots to verify the API. Empty
+// arguments are left out.
+func (c *client) authenticate(tokenFile, cert, key, ca string) error {
+	c.token = os.Getenv("OPTIKON_TOKEN")
+	if tokenFile != "" {
+		data, err := ioutil.ReadFile(tokenFile)
+		if err != nil {
+			return err
+		}
+		c.token = strings.TrimSpace(string(data))
+	}
+
+	if cert == "" && key == "" && ca == "" {
+		return nil
+	}
+	tlsConfig := &tls.Config{}
+	if cert != "" || key != "" {
+		pair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return err
+		}
+		tlsConfig.Certificates = []tls.Certificate{pair}
+	}
+	if ca != "" {
+		pem, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates in %s", ca)
+		}
+	}
+	c.http.Transport = &http.Transport{TLSClientConfig: tlsConfig}
+	return nil
+}
+
+// table returns the table of central and its generation.
+func (c *client) table() (central.Table, uint64, error) {
+	var t central.Table
+	resp, err := c.do(http.MethodGet, "/v1/table", nil, nil, &t)
+	if err != nil {
+		return nil, 0, err
+	}
+	gen, err := strconv.ParseUint(resp.Header.Get(generationHeader), 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid %s header: %s", generationHeader, err)
+	}
+	return t, gen, nil
+}
+
+// setTable replaces the table of central with t if the generation of the
+// table of central is still match, and returns the generation central gave t.
+func (c *client) setTable(t central.Table, match uint64) (uint64, error) {
+	header := http.Header{}
+	header.Set(generationHeader, strconv.FormatUint(match, 10))
+	resp, err := c.do(http.MethodPut, "/v1/services", header, t, nil)
+	if err != nil {
+		return 0, err
+	}
+	gen, err := strconv.ParseUint(resp.Header.Get(generationHeader), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s header: %s", generationHeader, err)
+	}
+	return gen, nil
+}
+
+// sites returns every edge site in the table of central.
+func (c *client) sites() ([]central.Site, error) {
+	var sites []central.Site
+	_, err := c.do(http.MethodGet, "/v1/sites", nil, nil, &sites)
+	return sites, err
+}
+
+// health returns the health of the edge sites reported by the edges.
+func (c *client) health() (map[string]central.SiteHealth, error) {
+	var health map[string]central.SiteHealth
+	_, err := c.do(http.MethodGet, "/v1/health", nil, nil, &health)
+	return health, err
+}
+
+// do sends a request with header and in as JSON body, if not nil, and decodes
+// the JSON response into out, if not nil.
+func (c *client) do(method, path string, header http.Header, in, out interface{}) (*http.Response, error) {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, c.api+path, body)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return nil, err
+		}
+	}
+	return resp, nil
+}
+
+// lookup asks the DNS server of central for the edge sites of name, as an edge
+// does. Central answers names it doesn't serve without edge sites.
+func (c *client) lookup(name string) (*codec.Payload, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), dns.TypeA)
+	codec.Request(m)
+
+	dc := &dns.Client{Net: "udp", Timeout: timeout}
+	ret, _, err := dc.Exchange(m, c.dns)
+	if err == nil && ret.Truncated {
+		dc.Net = "tcp"
+		ret, _, err = dc.Exchange(m, c.dns)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := codec.Extract(ret)
+	if err == codec.ErrNoPayload {
+		return nil, fmt.Errorf("%s is not served by central (rcode %s)", name, dns.RcodeToString[ret.Rcode])
+	}
+	return payload, err
+}
+
+// generationHeader carries the table generation in GET /v1/table responses
+// and in PUT /v1/services requests and responses.
+const generationHeader = "Optikon-Generation"
+
+const timeout = 5 * time.Second
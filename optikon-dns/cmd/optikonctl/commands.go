@@ -0,0 +1,289 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"wwwin-github.cisco.com/edge/optikon-dns/plugin/central"
+	"wwwin-github.cisco.com/edge/optikon-dns/plugin/codec"
+	"wwwin-github.cisco.com/edge/optikon-dns/plugin/edge"
+)
+
+// tableGet writes the table of central.
+func tableGet(c *client, out output) error {
+	t, _, err := c.table()
+	if err != nil {
+		return err
+	}
+	return out.write(t, func(w io.Writer) {
+		fmt.Fprintln(w, "SERVICE\tTTL\tSITES")
+		for _, name := range services(t) {
+			svc := t[name]
+			fmt.Fprintf(w, "%s\t%s\t%s\n", name, ttl(svc.TTL), siteIPs(svc.Sites))
+		}
+	})
+}
+
+// tableSet replaces the table of central with the table file at path through
+// PUT /v1/services. Central gives the new table the next generation and
+// replicates it to its peers. It fails if the table of central changes in the
+// meantime.
+func tableSet(c *client, out output, path string) error {
+	t, err := codec.LoadTable(path)
+	if err != nil {
+		return err
+	}
+	_, current, err := c.table()
+	if err != nil {
+		return err
+	}
+	gen, err := c.setTable(t, current)
+	if err != nil {
+		return err
+	}
+	result := struct {
+		Services   int    `json:"services"`
+		Generation uint64 `json:"generation"`
+	}{len(t), gen}
+	return out.write(result, func(w io.Writer) {
+		fmt.Fprintln(w, "SERVICES\tGENERATION")
+		fmt.Fprintf(w, "%d\t%d\n", result.Services, result.Generation)
+	})
+}
+
+// serviceDiff is a service that differs between the table of central and a
+// table file.
+type serviceDiff struct {
+	Service string           `json:"service"`
+	Change  string           `json:"change"` // added, removed or changed in the file.
+	Live    *central.Service `json:"live,omitempty"`
+	File    *central.Service `json:"file,omitempty"`
+}
+
+// tableDiff writes the services that differ between the table of central and
+// the table file at path. It returns errDiffers if there are any.
+func tableDiff(c *client, out output, path string) error {
+	file, err := codec.LoadTable(path)
+	if err != nil {
+		return err
+	}
+	live, _, err := c.table()
+	if err != nil {
+		return err
+	}
+
+	names := services(live)
+	for name := range file {
+		if _, found := live[name]; !found {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	diffs := []serviceDiff{}
+	for _, name := range names {
+		l, inLive := live[name]
+		f, inFile := file[name]
+		switch {
+		case !inLive:
+			diffs = append(diffs, serviceDiff{Service: name, Change: "added", File: &f})
+		case !inFile:
+			diffs = append(diffs, serviceDiff{Service: name, Change: "removed", Live: &l})
+		case !reflect.DeepEqual(l, f):
+			diffs = append(diffs, serviceDiff{Service: name, Change: "changed", Live: &l, File: &f})
+		}
+	}
+
+	err = out.write(diffs, func(w io.Writer) {
+		fmt.Fprintln(w, "SERVICE\tCHANGE\tLIVE\tFILE")
+		for _, d := range diffs {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", d.Service, d.Change, serviceSites(d.Live), serviceSites(d.File))
+		}
+	})
+	if err == nil && len(diffs) > 0 {
+		err = errDiffers
+	}
+	return err
+}
+
+// sitesList writes every edge site in the table of central.
+func sitesList(c *client, out output) error {
+	sites, err := c.sites()
+	if err != nil {
+		return err
+	}
+	return out.write(sites, func(w io.Writer) {
+		fmt.Fprintln(w, "IP\tIPV6\tLAT\tLON\tWEIGHT\tSERVICES")
+		for _, s := range sites {
+			fmt.Fprintf(w, "%s\t%s\t%g\t%g\t%d\t%s\n", s.IP, orNone(s.IPv6), s.Lat, s.Lon, s.Weight, strings.Join(s.Services, ","))
+		}
+	})
+}
+
+// health writes the health of the edge sites reported by the edges.
+func health(c *client, out output) error {
+	h, err := c.health()
+	if err != nil {
+		return err
+	}
+	return out.write(h, func(w io.Writer) {
+		ips := make([]string, 0, len(h))
+		for ip := range h {
+			ips = append(ips, ip)
+		}
+		sort.Strings(ips)
+		fmt.Fprintln(w, "IP\tUP\tDOWN")
+		for _, ip := range ips {
+			fmt.Fprintf(w, "%s\t%d\t%d\n", ip, h[ip].Up, h[ip].Down)
+		}
+	})
+}
+
+// resolution is the outcome of resolve.
+type resolution struct {
+	Name      string         `json:"name"`
+	Selection string         `json:"selection"`
+	Lat       float64        `json:"lat"`
+	Lon       float64        `json:"lon"`
+	Sites     []resolvedSite `json:"sites"` // Closest first.
+}
+
+type resolvedSite struct {
+	IP       string  `json:"ip"`
+	Distance float64 `json:"distance_km"`
+	Chosen   bool    `json:"chosen"`
+}
+
+// resolve gets the edge sites of a name from central over DNS and runs the
+// selection of an edge at the origin given with -from on them, offline.
+func resolve(c *client, out output, args []string) error {
+	fs := flag.NewFlagSet("resolve", flag.ContinueOnError)
+	from := fs.String("from", "", "`LAT,LON` of the edge to select from")
+	selection := fs.String("selection", "nearest", "selection `STRATEGY` of the edge, as in the Corefile")
+	fs.SetOutput(ioutil.Discard)
+
+	// The name may come before or after the flags.
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+	rest := fs.Args()
+	if len(rest) == 0 {
+		return errUsage
+	}
+	name := rest[0]
+	if err := fs.Parse(rest[1:]); err != nil || fs.NArg() > 0 {
+		return errUsage
+	}
+
+	lat, lon, err := parseOrigin(*from)
+	if err != nil {
+		return err
+	}
+	selector, err := edge.ParseSelection(strings.Fields(*selection))
+	if err != nil {
+		return err
+	}
+	if selector.String() == "latency" {
+		return errLatencyOffline
+	}
+
+	payload, err := c.lookup(name)
+	if err != nil {
+		return err
+	}
+	if len(payload.Sites) == 0 {
+		return fmt.Errorf("central has no edge sites for %s", name)
+	}
+
+	q := edge.Query{Name: name, Lat: lat, Lon: lon}
+	chosen := selector.Select(q, payload.Sites)
+	res := resolution{Name: name, Selection: *selection, Lat: lat, Lon: lon}
+	for _, es := range payload.Sites {
+		res.Sites = append(res.Sites, resolvedSite{
+			IP:       es.IP,
+			Distance: edge.Distance(lat, lon, es.Lat, es.Lon),
+			Chosen:   contains(chosen, es.IP),
+		})
+	}
+	sort.SliceStable(res.Sites, func(i, j int) bool { return res.Sites[i].Distance < res.Sites[j].Distance })
+
+	return out.write(res, func(w io.Writer) {
+		fmt.Fprintln(w, "IP\tDISTANCE_KM\tCHOSEN")
+		for _, s := range res.Sites {
+			fmt.Fprintf(w, "%s\t%.1f\t%t\n", s.IP, s.Distance, s.Chosen)
+		}
+	})
+}
+
+// parseOrigin parses "LAT,LON".
+func parseOrigin(s string) (lat, lon float64, err error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 2 {
+		return 0, 0, errNoOrigin
+	}
+	if lat, err = strconv.ParseFloat(strings.TrimSpace(parts[0]), 64); err != nil {
+		return 0, 0, fmt.Errorf("invalid latitude: %s", err)
+	}
+	if lon, err = strconv.ParseFloat(strings.TrimSpace(parts[1]), 64); err != nil {
+		return 0, 0, fmt.Errorf("invalid longitude: %s", err)
+	}
+	if lat < -90 || lat > 90 || lon < -180 || lon > 180 {
+		return 0, 0, errNoOrigin
+	}
+	return lat, lon, nil
+}
+
+// services returns the names of the services in t, sorted.
+func services(t central.Table) []string {
+	names := make([]string, 0, len(t))
+	for name := range t {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func siteIPs(sites []codec.EdgeSite) string {
+	ips := make([]string, len(sites))
+	for i, es := range sites {
+		ips[i] = es.IP
+	}
+	return strings.Join(ips, ",")
+}
+
+func serviceSites(svc *central.Service) string {
+	if svc == nil {
+		return "-"
+	}
+	return siteIPs(svc.Sites)
+}
+
+func ttl(seconds uint32) string {
+	if seconds == 0 {
+		return "-"
+	}
+	return (time.Duration(seconds) * time.Second).String()
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func contains(sites []codec.EdgeSite, ip string) bool {
+	for _, es := range sites {
+		if es.IP == ip {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,114 @@
+// Command optikonctl queries and manages the table of optikon-central through
+// its management API and DNS server.
+//
+//	optikonctl [flags] table get
+//	optikonctl [flags] table set FILE
+//	optikonctl [flags] table diff FILE
+//	optikonctl [flags] sites list
+//	optikonctl [flags] resolve NAME -from LAT,LON [-selection STRATEGY]
+//	optikonctl [flags] health
+//
+// table set replaces the table with the table file FILE, in the format of the
+// table file of optikon-central, unless the table changes meanwhile; central
+// replicates it to its peers. table diff lists the services that differ
+// between the table and FILE. resolve asks central for the edge sites of NAME
+// over DNS, as an edge does, and runs the selection of an edge at LAT,LON on
+// them; the latency strategy needs measurements and can't be used.
+//
+// The management API may require a bearer token, read from -token-file or
+// given in $OPTIKON_TOKEN, and a client certificate, given with -cert and -key.
+//
+// Results are written as a table, or with -o as JSON or YAML. The exit status
+// is 0 on success, 1 if table diff found differences and 2 on errors.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+)
+
+func main() {
+	api := flag.String("api", envOr("OPTIKON_API", "http://127.0.0.1:8090"), "`URL` of the management API of central")
+	dnsAddr := flag.String("dns", envOr("OPTIKON_DNS", "127.0.0.1:53"), "`ADDRESS` of the DNS server of central")
+	format := flag.String("o", "table", "output `FORMAT`: table, json or yaml")
+	tokenFile := flag.String("token-file", os.Getenv("OPTIKON_TOKEN_FILE"), "`FILE` with the bearer token of the management API")
+	cert := flag.String("cert", "", "client certificate `FILE` for a management API with mutual TLS")
+	key := flag.String("key", "", "`FILE` with the key of -cert")
+	ca := flag.String("ca", "", "CA certificate `FILE` of the management API, instead of the system roots")
+	flag.Usage = usage
+	flag.Parse()
+
+	c := newClient(*api, *dnsAddr)
+	if err := c.authenticate(*tokenFile, *cert, *key, *ca); err != nil {
+		fmt.Fprintf(os.Stderr, "optikonctl: %s\n", err)
+		os.Exit(2)
+	}
+	out := output{format: *format, w: os.Stdout}
+
+	switch err := run(c, out, flag.Args()); err {
+	case nil:
+	case errDiffers:
+		os.Exit(1)
+	case errUsage:
+		usage()
+		os.Exit(2)
+	default:
+		fmt.Fprintf(os.Stderr, "optikonctl: %s\n", err)
+		os.Exit(2)
+	}
+}
+
+// run runs the command in args.
+func run(c *client, out output, args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	switch cmd := args[0]; {
+	case cmd == "table" && len(args) == 2 && args[1] == "get":
+		return tableGet(c, out)
+	case cmd == "table" && len(args) == 3 && args[1] == "set":
+		return tableSet(c, out, args[2])
+	case cmd == "table" && len(args) == 3 && args[1] == "diff":
+		return tableDiff(c, out, args[2])
+	case cmd == "sites" && len(args) == 2 && args[1] == "list":
+		return sitesList(c, out)
+	case cmd == "resolve":
+		return resolve(c, out, args[1:])
+	case cmd == "health" && len(args) == 1:
+		return health(c, out)
+	}
+	return errUsage
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: optikonctl [flags] COMMAND
+
+Commands:
+  table get                  write the table of central
+  table set FILE             replace the table of central with FILE
+  table diff FILE            list the services that differ between central and FILE
+  sites list                 list the edge sites with the services they run
+  resolve NAME -from LAT,LON [-selection STRATEGY]
+                             select the edge sites for NAME as an edge at LAT,LON would
+  health                     write the health of the edge sites reported by the edges
+
+Flags:
+`)
+	flag.PrintDefaults()
+}
+
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+var (
+	errUsage          = errors.New("usage")
+	errDiffers        = errors.New("tables differ")
+	errNoOrigin       = errors.New("-from must be LAT,LON")
+	errLatencyOffline = errors.New("latency selection needs round trip times, use another strategy")
+)
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/ghodss/yaml"
+)
+
+// output writes the results of the commands in the format chosen with -o.
+type output struct {
+	format string // table, json or yaml.
+	w      io.Writer
+}
+
+// write writes v as JSON or YAML, or as a table through rows. rows writes one
+// line per row with tab separated columns, the first line being the header.
+func (o output) write(v interface{}, rows func(w io.Writer)) error {
+	switch o.format {
+	case "json":
+		enc := json.NewEncoder(o.w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	case "yaml":
+		data, err := yaml.Marshal(v)
+		if err != nil {
+			return err
+		}
+		_, err = o.w.Write(data)
+		return err
+	case "table":
+		tw := tabwriter.NewWriter(o.w, 0, 8, 2, ' ', 0)
+		rows(tw)
+		return tw.Flush()
+	}
+	return fmt.Errorf("unknown output format '%s'", o.format)
+}
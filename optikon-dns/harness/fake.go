@@ -0,0 +1,79 @@
+package harness
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+	"wwwin-github.cisco.com/edge/optikon-dns/plugin/codec"
+)
+
+// Fault is the way a FakeCentral misbehaves.
+type Fault int
+
+const (
+	// Malformed answers with a TXT record that isn't a JSON list of sites.
+	Malformed Fault = iota
+	// TruncateUDP answers queries over UDP with an empty truncated message,
+	// and queries over TCP with the edge sites.
+	TruncateUDP
+)
+
+// FakeCentral stands in for optikon-central to inject faults into the answers
+// edges get.
+type FakeCentral struct {
+	Addr string // Address of both the UDP and TCP listener.
+
+	sites []codec.EdgeSite
+	fault Fault
+	udp   *dns.Server
+	tcp   *dns.Server
+}
+
+// StartFake starts a FakeCentral answering every query with sites, as broken
+// by fault.
+func StartFake(sites []codec.EdgeSite, fault Fault) (*FakeCentral, error) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+
+	f := &FakeCentral{Addr: pc.LocalAddr().String(), sites: sites, fault: fault}
+	f.udp = &dns.Server{PacketConn: pc, Handler: f}
+	f.tcp = &dns.Server{Listener: l, Handler: f}
+	go f.udp.ActivateAndServe()
+	go f.tcp.ActivateAndServe()
+	return f, nil
+}
+
+// Stop stops the FakeCentral.
+func (f *FakeCentral) Stop() {
+	f.udp.Shutdown()
+	f.tcp.Shutdown()
+}
+
+// ServeDNS implements dns.Handler.
+func (f *FakeCentral) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+
+	switch f.fault {
+	case Malformed:
+		m.Extra = append(m.Extra, &dns.TXT{
+			Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 30},
+			Txt: []string{`[{"ip": "10.0.0.1", "lat": `},
+		})
+	case TruncateUDP:
+		if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+			m.Truncated = true
+			break
+		}
+		m.SetEdns0(dns.DefaultMsgSize, false)
+		codec.SetOption(m, &codec.Payload{Sites: f.sites, TTL: 30})
+	}
+	w.WriteMsg(m)
+}
@@ -0,0 +1,212 @@
+// Package harness runs optikon-central and optikon-edge in-process, each in a
+// CoreDNS server of its own on a loopback port, to check their behavior end to
+// end without booting a cluster.
+//
+// The plugins are added to the directives of CoreDNS in front of forward, as
+// the plugin.cfg of this repository does, so the harness also runs in a
+// CoreDNS tree that wasn't generated from it. The scenarios run with go test.
+package harness
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coredns/coredns/core/dnsserver"
+	"github.com/mholt/caddy"
+	"github.com/miekg/dns"
+	"wwwin-github.cisco.com/edge/optikon-dns/plugin/central"
+
+	// Register the plugins.
+	_ "github.com/coredns/coredns/core/plugin"
+	_ "wwwin-github.cisco.com/edge/optikon-dns/plugin/edge"
+)
+
+func init() {
+	dnsserver.Quiet = true
+	addDirectives("forward", "optikon-central", "optikon-edge")
+}
+
+// addDirectives adds the plugins names to the directives of CoreDNS, in front
+// of the directive before, where plugin.cfg puts them. CoreDNS trees not
+// generated from the plugin.cfg of this repository, like the one go test
+// builds in, don't know them otherwise.
+func addDirectives(before string, names ...string) {
+	var missing []string
+	for _, name := range names {
+		if !hasDirective(name) {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) == 0 {
+		return
+	}
+	at := len(dnsserver.Directives)
+	for i, d := range dnsserver.Directives {
+		if d == before {
+			at = i
+			break
+		}
+	}
+	directives := append([]string{}, dnsserver.Directives[:at]...)
+	directives = append(directives, missing...)
+	dnsserver.Directives = append(directives, dnsserver.Directives[at:]...)
+}
+
+func hasDirective(name string) bool {
+	for _, d := range dnsserver.Directives {
+		if d == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Server is a CoreDNS server running in-process.
+type Server struct {
+	Addr    string // UDP address.
+	TCPAddr string
+
+	inst *caddy.Instance
+}
+
+// Start starts a CoreDNS server with corefile, which must have a single server
+// block listening on port 0 of a loopback address.
+func Start(corefile string) (*Server, error) {
+	inst, err := caddy.Start(caddy.CaddyfileInput{Contents: []byte(corefile), ServerTypeName: "dns"})
+	if err != nil {
+		return nil, err
+	}
+	srvs := inst.Servers()
+	if len(srvs) == 0 {
+		inst.Stop()
+		return nil, errNoServer
+	}
+	s := &Server{inst: inst}
+	if a := srvs[0].LocalAddr(); a != nil {
+		s.Addr = a.String()
+	}
+	if a := srvs[0].Addr(); a != nil {
+		s.TCPAddr = a.String()
+	}
+	return s, nil
+}
+
+// Stop stops the server and waits for it to shut down.
+func (s *Server) Stop() error {
+	err := s.inst.Stop()
+	s.inst.Wait()
+	return err
+}
+
+// Central starts optikon-central serving table, which is written to the file
+// path. props are added to the properties of the plugin, after table.
+func Central(path string, table central.Table, props ...string) (*Server, error) {
+	if err := WriteTable(path, table); err != nil {
+		return nil, err
+	}
+	corefile := fmt.Sprintf(`.:0 {
+    bind 127.0.0.1
+    optikon-central {
+        table %s
+        reload 0
+        %s
+    }
+}`, path, strings.Join(props, "\n        "))
+	return Start(corefile)
+}
+
+// Edge starts optikon-edge located at lat, lon, forwarding the names under
+// from to the centrals to. props are added to the properties of the plugin.
+func Edge(lat, lon float64, from string, to []string, props ...string) (*Server, error) {
+	corefile := fmt.Sprintf(`.:0 {
+    bind 127.0.0.1
+    optikon-edge %f %f %s %s {
+        %s
+    }
+}`, lon, lat, from, strings.Join(to, " "), strings.Join(props, "\n        "))
+	return Start(corefile)
+}
+
+// WriteTable writes table to the file path, in the format of the table file of
+// optikon-central.
+func WriteTable(path string, table central.Table) error {
+	data, err := json.MarshalIndent(table, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// FreeAddr returns a loopback address with a TCP port nothing listens on, for
+// the management API of a central.
+func FreeAddr() (string, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer ln.Close()
+	return ln.Addr().String(), nil
+}
+
+// GetTable returns the table of the central whose management API is at addr,
+// and its generation.
+func GetTable(addr string) (central.Table, uint64, error) {
+	resp, err := httpClient.Get("http://" + addr + "/v1/table")
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("GET /v1/table: %s", resp.Status)
+	}
+	var t central.Table
+	if err := json.NewDecoder(resp.Body).Decode(&t); err != nil {
+		return nil, 0, err
+	}
+	gen, err := strconv.ParseUint(resp.Header.Get("Optikon-Generation"), 10, 64)
+	return t, gen, err
+}
+
+// PutService replaces the service called name with svc through the management
+// API of the central at addr.
+func PutService(addr, name string, svc central.Service) error {
+	data, err := json.Marshal(svc)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPut, "http://"+addr+"/v1/services/"+name, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("PUT /v1/services/%s: %s", name, resp.Status)
+	}
+	return nil
+}
+
+var httpClient = &http.Client{Timeout: queryTimeout}
+
+// Query sends a query for name of type qtype to the server at addr over UDP.
+func Query(addr, name string, qtype uint16) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), qtype)
+	c := &dns.Client{Net: "udp", Timeout: queryTimeout}
+	ret, _, err := c.Exchange(m, addr)
+	return ret, err
+}
+
+// queryTimeout is larger than the timeout of edges to their centrals, which
+// is what degraded answers wait for.
+const queryTimeout = 5 * time.Second
@@ -0,0 +1,121 @@
+package harness
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"wwwin-github.cisco.com/edge/optikon-dns/plugin/central"
+	"wwwin-github.cisco.com/edge/optikon-dns/plugin/codec"
+)
+
+// TestReplication starts two peered centrals with different tables and checks
+// that they settle on one table, that a change on either replaces it on both,
+// and that an edge with reconcile answers from the highest generation.
+func TestReplication(t *testing.T) {
+	dir, err := ioutil.TempDir("", "optikon-e2e")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	apiA, err := FreeAddr()
+	if err != nil {
+		t.Fatal(err)
+	}
+	apiB, err := FreeAddr()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Both start at the same generation, with different tables.
+	tableA := central.Table{service: {Sites: []codec.EdgeSite{copenhagen}}}
+	tableB := central.Table{service: {Sites: []codec.EdgeSite{tokyo}}}
+	a, err := Central(filepath.Join(dir, "a.json"), tableA, "api "+apiA, "peers http://"+apiB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Stop()
+	b, err := Central(filepath.Join(dir, "b.json"), tableB, "api "+apiB, "peers http://"+apiA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Stop()
+
+	settled, gen := waitConverged(t, apiA, apiB, func(central.Table, uint64) bool { return true })
+	if !reflect.DeepEqual(settled, tableA) && !reflect.DeepEqual(settled, tableB) {
+		t.Fatalf("expected the centrals to settle on one of their tables, got %v", settled)
+	}
+
+	// A change on either central replaces the table of both.
+	for _, change := range []struct {
+		api  string
+		site codec.EdgeSite
+	}{{apiA, newYork}, {apiB, tokyo}, {apiA, copenhagen}} {
+		if err := PutService(change.api, service, central.Service{Sites: []codec.EdgeSite{change.site}}); err != nil {
+			t.Fatal(err)
+		}
+		_, next := waitConverged(t, apiA, apiB, func(got central.Table, _ uint64) bool {
+			sites := got[service].Sites
+			return len(sites) == 1 && sites[0].IP == change.site.IP
+		})
+		if next <= gen {
+			t.Errorf("expected a generation past %d after the change on %s, got %d", gen, change.api, next)
+		}
+		gen = next
+	}
+
+	// A central that doesn't replicate is left at its first generation. An
+	// edge with reconcile ignores it, whichever order it asks in.
+	behind, err := Central(filepath.Join(dir, "behind.json"), tableB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer behind.Stop()
+
+	e := edges[0]
+	for _, to := range [][]string{{behind.Addr, a.Addr}, {b.Addr, behind.Addr}} {
+		edge, err := Edge(e.lat, e.lon, domain, to, "reconcile")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = expectSite(edge.Addr, copenhagen)
+		edge.Stop()
+		if err != nil {
+			t.Errorf("edge asking %v: %s", to, err)
+		}
+	}
+}
+
+// waitConverged waits until the centrals with the management APIs at apiA and
+// apiB serve the same table under the same generation, and ok accepts it.
+func waitConverged(t *testing.T, apiA, apiB string, ok func(central.Table, uint64) bool) (central.Table, uint64) {
+	t.Helper()
+	var last error
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		ta, genA, err := GetTable(apiA)
+		if err != nil {
+			last = err
+			continue
+		}
+		tb, genB, err := GetTable(apiB)
+		if err != nil {
+			last = err
+			continue
+		}
+		if genA != genB || !reflect.DeepEqual(ta, tb) {
+			last = fmt.Errorf("generation %d: %v, generation %d: %v", genA, ta, genB, tb)
+			continue
+		}
+		if ok(ta, genA) {
+			return ta, genA
+		}
+		last = fmt.Errorf("generation %d: %v", genA, ta)
+	}
+	t.Fatalf("centrals didn't converge: %v", last)
+	return nil, 0
+}
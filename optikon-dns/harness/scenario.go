@@ -0,0 +1,245 @@
+package harness
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/miekg/dns"
+	"wwwin-github.cisco.com/edge/optikon-dns/plugin/central"
+	"wwwin-github.cisco.com/edge/optikon-dns/plugin/codec"
+)
+
+// Scenario is an end to end check of the plugins.
+type Scenario struct {
+	Name string
+	Run  func(dir string) error // dir is a scratch directory for files.
+}
+
+// Scenarios are all the checks, each sets up its own servers.
+var Scenarios = []Scenario{
+	{"edges answer with their nearest site", nearestSite},
+	{"edges answer from the cache while central is down", staleWhileDown},
+	{"edges answer from the fallback table while central is down", fallbackWhileDown},
+	{"edges fail queries central answers with a malformed TXT record", malformedTXT},
+	{"edges retry truncated answers of central over TCP", truncatedUDP},
+	{"edges answer from the latest table of two centrals", latestOfTwo},
+}
+
+// RunScenario runs s in a new scratch directory, which is removed afterwards.
+func RunScenario(s Scenario) error {
+	dir, err := ioutil.TempDir("", "optikon-e2e")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	return s.Run(dir)
+}
+
+// The topology of the scenarios: a service running on three edge sites, and
+// an edge close to each of them.
+const (
+	domain  = "cluster.external."
+	service = "nginx.default.svc.cluster.external"
+)
+
+var (
+	copenhagen = codec.EdgeSite{IP: "10.0.0.1", Lat: 55.6761, Lon: 12.5683}
+	newYork    = codec.EdgeSite{IP: "10.0.0.2", Lat: 40.7128, Lon: -74.0060}
+	tokyo      = codec.EdgeSite{IP: "10.0.0.3", Lat: 35.6895, Lon: 139.6917}
+
+	sites = []codec.EdgeSite{copenhagen, newYork, tokyo}
+	table = central.Table{service: {Sites: sites}}
+
+	edges = []struct {
+		name     string
+		lat, lon float64
+		nearest  codec.EdgeSite
+	}{
+		{"malmo", 55.6050, 13.0038, copenhagen},
+		{"boston", 42.3601, -71.0589, newYork},
+		{"osaka", 34.6937, 135.5023, tokyo},
+	}
+)
+
+// nearestSite checks that every edge answers with the site closest to it.
+func nearestSite(dir string) error {
+	c, err := Central(filepath.Join(dir, "table.json"), table)
+	if err != nil {
+		return err
+	}
+	defer c.Stop()
+
+	for _, e := range edges {
+		edge, err := Edge(e.lat, e.lon, domain, []string{c.Addr})
+		if err != nil {
+			return err
+		}
+		err = expectSite(edge.Addr, e.nearest)
+		edge.Stop()
+		if err != nil {
+			return fmt.Errorf("edge %s: %s", e.name, err)
+		}
+	}
+	return nil
+}
+
+// staleWhileDown checks that an edge with serve_stale keeps answering with the
+// sites it cached after central went down and the entry expired.
+func staleWhileDown(dir string) error {
+	c, err := Central(filepath.Join(dir, "table.json"), table, "ttl 1s")
+	if err != nil {
+		return err
+	}
+
+	e := edges[0]
+	edge, err := Edge(e.lat, e.lon, domain, []string{c.Addr}, "serve_stale")
+	if err != nil {
+		c.Stop()
+		return err
+	}
+	defer edge.Stop()
+
+	err = expectSite(edge.Addr, e.nearest)
+	if stopErr := c.Stop(); err == nil {
+		err = stopErr
+	}
+	if err != nil {
+		return err
+	}
+	time.Sleep(1500 * time.Millisecond)
+	return expectSite(edge.Addr, e.nearest)
+}
+
+// fallbackWhileDown checks that an edge that can't reach central answers from
+// its fallback table.
+func fallbackWhileDown(dir string) error {
+	fallback := filepath.Join(dir, "fallback.json")
+	if err := WriteTable(fallback, table); err != nil {
+		return err
+	}
+
+	e := edges[1]
+	edge, err := Edge(e.lat, e.lon, domain, []string{unreachable}, "fallback "+fallback)
+	if err != nil {
+		return err
+	}
+	defer edge.Stop()
+	return expectSite(edge.Addr, e.nearest)
+}
+
+// malformedTXT checks that an edge fails queries when central answers with a
+// TXT record it can't decode, instead of answering with garbage.
+func malformedTXT(dir string) error {
+	f, err := StartFake(sites, Malformed)
+	if err != nil {
+		return err
+	}
+	defer f.Stop()
+
+	e := edges[0]
+	edge, err := Edge(e.lat, e.lon, domain, []string{f.Addr})
+	if err != nil {
+		return err
+	}
+	defer edge.Stop()
+	return expectRcode(edge.Addr, dns.RcodeServerFailure)
+}
+
+// truncatedUDP checks that an edge asks again over TCP when the answer of
+// central doesn't fit in UDP.
+func truncatedUDP(dir string) error {
+	f, err := StartFake(sites, TruncateUDP)
+	if err != nil {
+		return err
+	}
+	defer f.Stop()
+
+	e := edges[2]
+	edge, err := Edge(e.lat, e.lon, domain, []string{f.Addr})
+	if err != nil {
+		return err
+	}
+	defer edge.Stop()
+	return expectSite(edge.Addr, e.nearest)
+}
+
+// latestOfTwo checks that an edge with reconcile answers from the central with
+// the latest table, whichever order the centrals are given in.
+func latestOfTwo(dir string) error {
+	api, err := FreeAddr()
+	if err != nil {
+		return err
+	}
+	old, err := Central(filepath.Join(dir, "old.json"), table)
+	if err != nil {
+		return err
+	}
+	defer old.Stop()
+	latest, err := Central(filepath.Join(dir, "latest.json"), table, "api "+api)
+	if err != nil {
+		return err
+	}
+	defer latest.Stop()
+
+	// The service moves to Tokyo only, on one of the centrals. The change
+	// gives its table a higher generation.
+	if err := PutService(api, service, central.Service{Sites: []codec.EdgeSite{tokyo}}); err != nil {
+		return err
+	}
+
+	e := edges[0]
+	for _, to := range [][]string{{old.Addr, latest.Addr}, {latest.Addr, old.Addr}} {
+		edge, err := Edge(e.lat, e.lon, domain, to, "reconcile")
+		if err != nil {
+			return err
+		}
+		err = expectSite(edge.Addr, tokyo)
+		edge.Stop()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expectSite queries the edge at addr for the service and checks the answer is
+// the address of site.
+func expectSite(addr string, site codec.EdgeSite) error {
+	ret, err := Query(addr, service, dns.TypeA)
+	if err != nil {
+		return err
+	}
+	if ret.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("expected %s, got rcode %s", site.IP, dns.RcodeToString[ret.Rcode])
+	}
+	if len(ret.Answer) != 1 {
+		return fmt.Errorf("expected %s, got %d answers", site.IP, len(ret.Answer))
+	}
+	a, ok := ret.Answer[0].(*dns.A)
+	if !ok || a.A.String() != site.IP {
+		return fmt.Errorf("expected %s, got %s", site.IP, ret.Answer[0])
+	}
+	return nil
+}
+
+// expectRcode queries the edge at addr for the service and checks the rcode of
+// the answer.
+func expectRcode(addr string, rcode int) error {
+	ret, err := Query(addr, service, dns.TypeA)
+	if err != nil {
+		return err
+	}
+	if ret.Rcode != rcode {
+		return fmt.Errorf("expected rcode %s, got %s", dns.RcodeToString[rcode], dns.RcodeToString[ret.Rcode])
+	}
+	return nil
+}
+
+// unreachable is an address nothing listens on, the discard port.
+const unreachable = "127.0.0.1:9"
+
+var errNoServer = errors.New("no server in corefile")
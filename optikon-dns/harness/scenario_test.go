@@ -0,0 +1,19 @@
+package harness
+
+import "testing"
+
+// The scenarios optikon-e2e runs, one test each.
+
+func TestNearestSite(t *testing.T)       { runScenario(t, nearestSite) }
+func TestStaleWhileDown(t *testing.T)    { runScenario(t, staleWhileDown) }
+func TestFallbackWhileDown(t *testing.T) { runScenario(t, fallbackWhileDown) }
+func TestMalformedTXT(t *testing.T)      { runScenario(t, malformedTXT) }
+func TestTruncatedUDP(t *testing.T)      { runScenario(t, truncatedUDP) }
+func TestLatestOfTwo(t *testing.T)       { runScenario(t, latestOfTwo) }
+
+// runScenario runs the scenario run in a new scratch directory.
+func runScenario(t *testing.T, run func(dir string) error) {
+	if err := RunScenario(Scenario{Run: run}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,497 @@
+package central
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"wwwin-github.cisco.com/edge/optikon-dns/plugin/codec"
+)
+
+// api is the HTTP management interface of optikon-central.
+type api struct {
+	addr    string
+	persist bool
+
+	ln  net.Listener
+	mux *http.ServeMux
+}
+
+// apiAuth is how the management API authenticates its clients, see the
+// api_token and api_tls properties. The zero value accepts everyone over
+// plain HTTP.
+type apiAuth struct {
+	token     string      // Bearer token required from clients, if not empty.
+	tlsConfig *tls.Config // Serves the API over TLS, with client certificates if it has ClientCAs.
+}
+
+// authorize wraps h to reject the requests without the bearer token, if one
+// is required.
+func (a apiAuth) authorize(h http.Handler) http.Handler {
+	if a.token == "" {
+		return h
+	}
+	want := []byte("Bearer " + a.token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(got, want) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="optikon-central"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// readToken reads a bearer token from the file at path, without surrounding
+// whitespace.
+func readToken(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", errEmptyToken
+	}
+	return token, nil
+}
+
+// Site is an edge site together with the services it runs, as reported by
+// the /v1/sites endpoint.
+type Site struct {
+	EdgeSite
+	Services []string `json:"services"`
+}
+
+// startAPI starts serving the management API.
+func (oc *OptikonCentral) startAPI() error {
+	ln, err := net.Listen("tcp", oc.api.addr)
+	if err != nil {
+		return err
+	}
+	if oc.auth.tlsConfig != nil {
+		ln = tls.NewListener(ln, oc.auth.tlsConfig)
+	}
+	oc.api.ln = ln
+	oc.api.mux = http.NewServeMux()
+	oc.api.mux.HandleFunc("/v1/table", oc.serveTable)
+	oc.api.mux.HandleFunc("/v1/services", oc.serveServices)
+	oc.api.mux.HandleFunc("/v1/services/", oc.serveService)
+	oc.api.mux.HandleFunc("/v1/sites", oc.serveSites)
+	oc.api.mux.HandleFunc("/v1/sites/", oc.serveSite)
+	oc.api.mux.HandleFunc("/v1/health", oc.serveHealth)
+	oc.api.mux.HandleFunc("/v1/health/", oc.serveHealthReport)
+
+	go func() {
+		http.Serve(oc.api.ln, oc.auth.authorize(oc.api.mux))
+	}()
+	return nil
+}
+
+// stopAPI closes the listener of the management API.
+func (oc *OptikonCentral) stopAPI() error {
+	if oc.api.ln != nil {
+		return oc.api.ln.Close()
+	}
+	return nil
+}
+
+// serveTable handles GET and PUT on /v1/table. GET returns the table, with its
+// generation in the Optikon-Generation header. PUT is used by the peers to
+// replicate their table, it is only applied if it replaces the current one,
+// see replica.replaces. Otherwise it is refused with the current generation.
+func (oc *OptikonCentral) serveTable(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		t, gen := oc.snapshot()
+		w.Header().Set(generationHeader, strconv.FormatUint(gen, 10))
+		oc.writeJSON(w, t)
+
+	case http.MethodPut:
+		var rep replica
+		if err := json.NewDecoder(r.Body).Decode(&rep); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := rep.Table.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err := oc.applyReplica(rep)
+		if err == errStaleGeneration {
+			_, gen := oc.snapshot()
+			w.Header().Set(generationHeader, strconv.FormatUint(gen, 10))
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// serveServices handles PUT on /v1/services, which replaces the whole table
+// with the table in the body, in the format of the table file. Like every
+// change made through the api it gets the next generation, returned in the
+// Optikon-Generation header, and is replicated to the peers. If the request
+// carries the generation the table was read at in that header, the table is
+// only replaced if it didn't change since, else it is refused with 409 and the
+// current generation.
+func (oc *OptikonCentral) serveServices(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	t, err := ParseTable(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var match uint64
+	header := r.Header.Get(generationHeader)
+	if header != "" {
+		if match, err = strconv.ParseUint(header, 10, 64); err != nil {
+			http.Error(w, "invalid "+generationHeader+" header", http.StatusBadRequest)
+			return
+		}
+	}
+
+	gen, err := oc.replaceTable(t, match, header != "")
+	if err == errGenerationChanged {
+		w.Header().Set(generationHeader, strconv.FormatUint(gen, 10))
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(generationHeader, strconv.FormatUint(gen, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveService handles GET, PUT and DELETE on /v1/services/{name}.
+func (oc *OptikonCentral) serveService(w http.ResponseWriter, r *http.Request) {
+	name := codec.NormalizeService(strings.TrimPrefix(r.URL.Path, "/v1/services/"))
+	if name == "" {
+		http.Error(w, codec.ErrEmptyServiceName.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		svc, _, found := oc.lookup(name)
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+		oc.writeJSON(w, svc)
+
+	case http.MethodPut:
+		var svc Service
+		if err := json.NewDecoder(r.Body).Decode(&svc); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := (Table{name: svc}).Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err := oc.updateTable(func(t Table) bool {
+			t[name] = svc
+			return true
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		oc.writeJSON(w, svc)
+
+	case http.MethodDelete:
+		err := oc.updateTable(func(t Table) bool {
+			if _, found := t[name]; !found {
+				return false
+			}
+			delete(t, name)
+			return true
+		})
+		if err == errNotFound {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// serveSites handles GET /v1/sites, listing every edge site in the table.
+func (oc *OptikonCentral) serveSites(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	t, _ := oc.snapshot()
+	oc.writeJSON(w, t.Sites())
+}
+
+// serveSite handles PUT and DELETE on /v1/sites/{ip}. PUT moves the site to
+// new coordinates in every service, DELETE removes the site from every
+// service, dropping services that are left without sites.
+func (oc *OptikonCentral) serveSite(w http.ResponseWriter, r *http.Request) {
+	ip := strings.TrimPrefix(r.URL.Path, "/v1/sites/")
+	if net.ParseIP(ip) == nil {
+		http.Error(w, "invalid ip "+ip, http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		var site EdgeSite
+		if err := json.NewDecoder(r.Body).Decode(&site); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		site.IP = ip
+		if err := (Table{ip: {Sites: []EdgeSite{site}}}).Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err := oc.updateTable(func(t Table) bool {
+			return t.replaceSite(ip, func(EdgeSite) []EdgeSite { return []EdgeSite{site} })
+		})
+		if err == errNotFound {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		oc.writeJSON(w, site)
+
+	case http.MethodDelete:
+		err := oc.updateTable(func(t Table) bool {
+			return t.replaceSite(ip, func(EdgeSite) []EdgeSite { return nil })
+		})
+		if err == errNotFound {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// serveHealth handles GET /v1/health, returning the site health aggregated
+// from the reports of the edges.
+func (oc *OptikonCentral) serveHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	oc.writeJSON(w, oc.health.Summary())
+}
+
+// serveHealthReport handles PUT /v1/health/{edge}, the body maps site IPs to
+// whether the edge finds them up.
+func (oc *OptikonCentral) serveHealthReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	edge := strings.TrimPrefix(r.URL.Path, "/v1/health/")
+	if edge == "" {
+		http.Error(w, "missing edge name", http.StatusBadRequest)
+		return
+	}
+	var up map[string]bool
+	if err := json.NewDecoder(r.Body).Decode(&up); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	oc.health.set(edge, up)
+	oc.restream()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Sites returns every distinct edge site in t, keyed on IP, with the services
+// it runs.
+func (t Table) Sites() []Site {
+	bySite := make(map[string]*Site)
+	for name, svc := range t {
+		for _, es := range svc.Sites {
+			s, found := bySite[es.IP]
+			if !found {
+				s = &Site{EdgeSite: es}
+				bySite[es.IP] = s
+			}
+			s.Services = append(s.Services, name)
+		}
+	}
+
+	ret := make([]Site, 0, len(bySite))
+	for _, s := range bySite {
+		sort.Strings(s.Services)
+		ret = append(ret, *s)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].IP < ret[j].IP })
+	return ret
+}
+
+// replaceSite replaces every occurrence of the site with the given IP with the
+// sites returned by fn. It reports whether the site was found.
+func (t Table) replaceSite(ip string, fn func(EdgeSite) []EdgeSite) bool {
+	found := false
+	for name, svc := range t {
+		var updated []EdgeSite
+		changed := false
+		for _, es := range svc.Sites {
+			if es.IP != ip {
+				updated = append(updated, es)
+				continue
+			}
+			updated = append(updated, fn(es)...)
+			changed = true
+		}
+		if !changed {
+			continue
+		}
+		found = true
+		if len(updated) == 0 {
+			delete(t, name)
+			continue
+		}
+		t[name] = Service{Sites: updated, TTL: svc.TTL}
+	}
+	return found
+}
+
+// snapshot returns the Table currently served and its generation. The Table
+// must not be modified.
+func (oc *OptikonCentral) snapshot() (Table, uint64) {
+	oc.RLock()
+	defer oc.RUnlock()
+	return oc.table, oc.generation
+}
+
+// updateTable applies fn to a copy of the Table and swaps the copy in, so
+// that concurrent readers never see a partial update. fn returns false if it
+// didn't find what it was asked to change, in which case errNotFound is
+// returned. If persisting is enabled the new Table is also written to the
+// table file.
+func (oc *OptikonCentral) updateTable(fn func(Table) bool) error {
+	oc.writer.Lock()
+	defer oc.writer.Unlock()
+
+	t := make(Table, len(oc.table))
+	for name, svc := range oc.table {
+		t[name] = svc
+	}
+	if !fn(t) {
+		return errNotFound
+	}
+
+	if err := oc.persistTable(t); err != nil {
+		return err
+	}
+	oc.swap(t)
+	return nil
+}
+
+// replaceTable makes t the Table, as updateTable does, and returns its
+// generation. With check the table is only replaced if its generation is
+// match, otherwise errGenerationChanged is returned with the current one.
+func (oc *OptikonCentral) replaceTable(t Table, match uint64, check bool) (uint64, error) {
+	oc.writer.Lock()
+	defer oc.writer.Unlock()
+
+	if check && oc.generation != match {
+		return oc.generation, errGenerationChanged
+	}
+	if err := oc.persistTable(t); err != nil {
+		return 0, err
+	}
+	oc.swap(t)
+	return oc.generation, nil
+}
+
+// persistTable writes t to the table file if persisting is enabled. The caller
+// must hold oc.writer.
+func (oc *OptikonCentral) persistTable(t Table) error {
+	if oc.api != nil && oc.api.persist && oc.file != nil {
+		return oc.writeTable(t)
+	}
+	return nil
+}
+
+// writeTable atomically replaces the table file with t. The caller must hold
+// oc.writer.
+func (oc *OptikonCentral) writeTable(t Table) error {
+	data, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(oc.file.path), filepath.Base(oc.file.path))
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), oc.file.path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	// Don't reload what we just wrote.
+	if stat, err := os.Stat(oc.file.path); err == nil {
+		oc.file.mtime = stat.ModTime()
+		oc.file.size = stat.Size()
+	}
+	return nil
+}
+
+func (oc *OptikonCentral) writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		oc.log.Errorf("writing api response: %s", err)
+	}
+}
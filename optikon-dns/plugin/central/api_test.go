@@ -0,0 +1,99 @@
+package central
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAuthorize(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) })
+
+	tests := []struct {
+		token  string
+		header string
+		status int
+	}{
+		{"", "", http.StatusNoContent},
+		{"s3cret", "Bearer s3cret", http.StatusNoContent},
+		{"s3cret", "", http.StatusUnauthorized},
+		{"s3cret", "Bearer wrong", http.StatusUnauthorized},
+		{"s3cret", "s3cret", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		h := apiAuth{token: test.token}.authorize(ok)
+		r := httptest.NewRequest(http.MethodGet, "/v1/table", nil)
+		if test.header != "" {
+			r.Header.Set("Authorization", test.header)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("token %q, header %q: expected status %d, got %d", test.token, test.header, test.status, w.Code)
+		}
+	}
+}
+
+func TestReadToken(t *testing.T) {
+	dir, err := ioutil.TempDir("", "optikon-central")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "token")
+	ioutil.WriteFile(path, []byte("s3cret\n"), 0600)
+	if token, err := readToken(path); err != nil || token != "s3cret" {
+		t.Errorf("expected token s3cret, got %q, %v", token, err)
+	}
+	ioutil.WriteFile(path, []byte("\n"), 0600)
+	if _, err := readToken(path); err != errEmptyToken {
+		t.Errorf("expected %v, got %v", errEmptyToken, err)
+	}
+}
+
+func TestServeServices(t *testing.T) {
+	oc := New()
+	oc.setTable(Table{"echoserver.default": {Sites: []EdgeSite{{IP: "172.16.7.102"}}}})
+
+	put := func(body, gen string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPut, "/v1/services", strings.NewReader(body))
+		if gen != "" {
+			r.Header.Set(generationHeader, gen)
+		}
+		w := httptest.NewRecorder()
+		oc.serveServices(w, r)
+		return w
+	}
+
+	w := put(`{"nginx.default": [{"ip": "172.16.7.103"}]}`, "1")
+	if w.Code != http.StatusNoContent || w.Header().Get(generationHeader) != "2" {
+		t.Fatalf("expected status %d with generation 2, got %d with %q", http.StatusNoContent, w.Code, w.Header().Get(generationHeader))
+	}
+	if _, gen, found := oc.lookup("nginx.default"); !found || gen != 2 {
+		t.Errorf("expected nginx.default under generation 2, got %t under %d", found, gen)
+	}
+	if _, _, found := oc.lookup("echoserver.default"); found {
+		t.Error("expected echoserver.default to be replaced")
+	}
+
+	// The table changed since generation 1.
+	w = put(`{"echoserver.default": [{"ip": "172.16.7.102"}]}`, "1")
+	if w.Code != http.StatusConflict || w.Header().Get(generationHeader) != "2" {
+		t.Errorf("expected status %d with generation 2, got %d with %q", http.StatusConflict, w.Code, w.Header().Get(generationHeader))
+	}
+
+	// Without a generation the table is replaced regardless.
+	w = put(`{"echoserver.default": [{"ip": "172.16.7.102"}]}`, "")
+	if w.Code != http.StatusNoContent || w.Header().Get(generationHeader) != "3" {
+		t.Errorf("expected status %d with generation 3, got %d with %q", http.StatusNoContent, w.Code, w.Header().Get(generationHeader))
+	}
+
+	if w = put(`{"": []}`, ""); w.Code != http.StatusBadRequest {
+		t.Errorf("expected status %d for an invalid table, got %d", http.StatusBadRequest, w.Code)
+	}
+}
@@ -1,72 +1,126 @@
 package central
 
 import (
-	"encoding/json"
+	"errors"
+	"sync"
+	"time"
 
 	"github.com/coredns/coredns/plugin"
 	"github.com/coredns/coredns/request"
 	"github.com/miekg/dns"
 	"golang.org/x/net/context"
+	"wwwin-github.cisco.com/edge/optikon-dns/plugin/codec"
+	"wwwin-github.cisco.com/edge/optikon-dns/plugin/logging"
+	"wwwin-github.cisco.com/edge/optikon-dns/plugin/stream"
 )
 
 // Table specifies the mapping from service DNS names to edge sites.
-type Table map[string][]EdgeSite
+type Table map[string]Service
 
 // EdgeSite is a wrapper around all information needed about edge sites serving
-// content.
-type EdgeSite struct {
-	IP  string  `json:"ip"`
-	Lon float64 `json:"lon"`
-	Lat float64 `json:"lat"`
-}
+// content. It is defined in the codec package shared with optikon-edge.
+type EdgeSite = codec.EdgeSite
+
+// Service is the Table entry of a service. It is defined in the codec package
+// as well.
+type Service = codec.Service
 
 // OptikonCentral is a plugin that returns your IP address, port and the
 // protocol used for connecting to CoreDNS.
 type OptikonCentral struct {
-	table Table
-	Next  plugin.Handler
+	sync.RWMutex
+	writer     sync.Mutex // Serializes changes to the table and the table file.
+	table      Table
+	generation uint64 // Generation of table, see nextGeneration.
+	seen       uint64 // Highest generation received from the peers.
+	file       *tableFile
+	registry   *Registry
+	api        *api
+	auth       apiAuth // Authentication of the api and of the peers.
+	health     *healthReports
+	peers      *replicator
+	stream     *streamer
+	ttl        uint32        // Seconds edges may cache the edge sites.
+	signer     *codec.Signer // Signs the payloads, nil if they aren't signed.
+
+	log  *logging.Logger // Set up by the log_level and log_format properties.
+	stop chan struct{}
+
+	Next plugin.Handler
 }
 
 // New returns a new OptikonCentral.
 func New() *OptikonCentral {
 	oc := &OptikonCentral{
-		table: make(Table),
+		table:  make(Table),
+		ttl:    defaultTTL,
+		health: newHealthReports(),
+		log:    logging.New("optikon-central"),
+		stop:   make(chan struct{}),
 	}
 	return oc
 }
 
-func (oc *OptikonCentral) populateTable() {
-
-	oc.table["kubernetes.default.svc.cluster.external"] = []EdgeSite{
-		EdgeSite{
-			IP:  "172.16.7.102",
-			Lon: 55.664023,
-			Lat: 12.610126,
-		},
-		EdgeSite{
-			IP:  "172.16.7.103",
-			Lon: 55.680770,
-			Lat: 12.543006,
-		},
-		EdgeSite{
-			IP:  "172.16.7.104",
-			Lon: 55.6748923,
-			Lat: 12.5534,
-		},
+// setTable atomically replaces the Table served by oc. The new Table must not
+// be modified afterwards.
+func (oc *OptikonCentral) setTable(t Table) {
+	oc.writer.Lock()
+	defer oc.writer.Unlock()
+	oc.swap(t)
+}
+
+// swap publishes t to readers under the next generation and schedules its
+// replication to the peers. The caller must hold oc.writer.
+func (oc *OptikonCentral) swap(t Table) {
+	oc.publish(t, oc.nextGeneration())
+	if oc.peers != nil {
+		oc.peers.notify()
+	}
+}
+
+// publish makes t with generation gen the Table served by oc, and streams the
+// changes to the subscribed edges. The caller must hold oc.writer.
+func (oc *OptikonCentral) publish(t Table, gen uint64) {
+	var u *stream.Update
+	var streamed Table
+	if oc.stream != nil {
+		streamed = oc.streamed(t)
+		u = stream.Diff(oc.stream.sent, streamed, gen)
 	}
 
-	oc.table["nginx-kubecon.default.svc.cluster.external"] = []EdgeSite{
-		EdgeSite{
-			IP:  "172.16.7.102",
-			Lon: 55.664023,
-			Lat: 12.610126,
-		},
-		EdgeSite{
-			IP:  "172.16.7.103",
-			Lon: 55.680770,
-			Lat: 12.543006,
-		},
+	oc.Lock()
+	oc.table = t
+	oc.generation = gen
+	if u != nil {
+		oc.stream.sent = streamed
+		oc.stream.broadcast(u)
 	}
+	oc.Unlock()
+	TableGeneration.Set(float64(gen))
+	TableSize.Set(float64(len(t)))
+}
+
+// nextGeneration returns the generation of the next change of the table.
+// Generations are Lamport clocks: one past the highest generation oc served or
+// received from a peer, so a change replaces every table its central could
+// have seen before. Changes made at the same time on different centrals may
+// get the same generation, see replica.replaces. The caller must hold
+// oc.writer.
+func (oc *OptikonCentral) nextGeneration() uint64 {
+	gen := oc.generation
+	if oc.seen > gen {
+		gen = oc.seen
+	}
+	return gen + 1
+}
+
+// lookup returns the Table entry of the given service name and the generation
+// of the Table.
+func (oc *OptikonCentral) lookup(name string) (Service, uint64, bool) {
+	oc.RLock()
+	defer oc.RUnlock()
+	svc, found := oc.table[name]
+	return svc, oc.generation, found
 }
 
 // ServeDNS implements the plugin.Handler interface.
@@ -75,20 +129,29 @@ func (oc *OptikonCentral) ServeDNS(ctx context.Context, w dns.ResponseWriter, r
 	// Encapsolate the state of the request and reponse.
 	state := request.Request{W: w, Req: r}
 
-	// Parse the target domain out of the request (NOTE: This will always have
-	// a trailing dot.)
-	targetDomain := state.Name()
+	span, ctx := serveSpan(ctx, r)
+	defer span.Finish()
+
+	// Parse the service out of the request, SRV queries and SRV target names
+	// carry extra labels in front of it.
+	name := codec.ParseName(state.Name())
 
 	// Determine if there is an entry for the DNS name we're looking for.
-	edgeSites, found := oc.table[targetDomain[:(len(targetDomain)-1)]]
+	lookupSpan := childSpan(ctx, "lookup")
+	svc, gen, found := oc.lookup(name.Service)
+	edgeSites := svc.Sites
+	lookupSpan.SetTag(tagService, name.Service)
+	lookupSpan.SetTag(tagFound, found)
+	lookupSpan.SetTag(tagGeneration, gen)
+	lookupSpan.SetTag(tagSites, len(edgeSites))
+	lookupSpan.Finish()
 	if !found || len(edgeSites) == 0 {
+		NotServedCount.Add(1)
 		return plugin.NextOrFailure(oc.Name(), oc.Next, ctx, w, r)
 	}
-
-	// Convert the edge sites to a JSON string.
-	jsonString, err := json.Marshal(edgeSites)
-	if err != nil {
-		return dns.RcodeServerFailure, err
+	QueryCount.WithLabelValues(name.Service).Add(1)
+	if oc.health.exclude {
+		edgeSites = oc.health.filter(edgeSites)
 	}
 
 	// Init a response message.
@@ -97,22 +160,61 @@ func (oc *OptikonCentral) ServeDNS(ctx context.Context, w dns.ResponseWriter, r
 	res.Compress = true
 	res.Authoritative = false
 	res.Response = true
+	state.SizeAndDo(res)
 
-	// Initialze a text resource record (RR) for the edge sites.
-	es := new(dns.TXT)
-	es.Hdr = dns.RR_Header{Name: state.QName(), Rrtype: dns.TypeTXT, Class: state.QClass()}
-	es.Txt = []string{string(jsonString)}
-
-	// Send it as part of the Extra/Additional field of the DNS packet.
-	res.Extra = []dns.RR{es}
+	// Edges that ask for it get the edge sites in an EDNS0 option, all others
+	// get them as JSON in a TXT record in the Extra/Additional field.
+	payload := &codec.Payload{Sites: edgeSites, TTL: oc.ttl, AnswerTTL: svc.TTL, Generation: gen}
+	encodeSpan := childSpan(ctx, "encode")
+	encodeSpan.SetTag(tagSigned, codec.Requested(r) && oc.signer != nil)
+	err := oc.encode(state, res, payload)
+	encodeSpan.Finish()
+	if err != nil {
+		return dns.RcodeServerFailure, err
+	}
 
 	// Write the response message.
-	state.SizeAndDo(res)
+	writeSpan := childSpan(ctx, "write")
 	w.WriteMsg(res)
+	writeSpan.Finish()
 
 	// Return no errors.
 	return dns.RcodeSuccess, nil
 }
 
+// encode adds payload to the response res to the query in state.
+func (oc *OptikonCentral) encode(state request.Request, res *dns.Msg, payload *codec.Payload) error {
+	// Signed payloads are only sent in the option, edges that verify them
+	// always ask for it.
+	if codec.Requested(state.Req) && oc.signer != nil {
+		return oc.signer.SetOption(res, state.Name(), payload, time.Now())
+	}
+	if codec.Requested(state.Req) {
+		return codec.SetOption(res, payload)
+	}
+	es, err := codec.TXT(state.QName(), state.QClass(), payload)
+	if err != nil {
+		return err
+	}
+	res.Extra = append([]dns.RR{es}, res.Extra...)
+	return nil
+}
+
 // Name implements the Handler interface.
 func (oc *OptikonCentral) Name() string { return "optikon-central" }
+
+var (
+	errNoClusterIP       = errors.New("no IP or APIServer annotation")
+	errNoKubeconfig      = errors.New("no Conf annotation with kubeconfig")
+	errTableAndRegistry  = errors.New("table and registry are mutually exclusive")
+	errReloadNoTable     = errors.New("reload requires a table")
+	errNotFound          = errors.New("not found in table")
+	errPersistNoTable    = errors.New("api persist requires a table")
+	errExcludeNoAPI      = errors.New("exclude_unhealthy requires the api to receive health reports")
+	errPeersNoAPI        = errors.New("peers requires the api to receive tables")
+	errAuthNoAPI         = errors.New("api_token and api_tls require the api")
+	errEmptyToken        = errors.New("empty api token")
+	errStaleGeneration   = errors.New("table generation is not newer than the current one")
+	errGenerationChanged = errors.New("table changed since the given generation")
+	errSubscriberBehind  = errors.New("subscriber fell behind the table stream")
+)
@@ -0,0 +1,87 @@
+package central
+
+import (
+	"sync"
+	"time"
+)
+
+// healthReports aggregates the health of edge sites as reported by the edges
+// checking them.
+type healthReports struct {
+	sync.RWMutex
+	reports map[string]healthReport // Keyed by reporting edge.
+
+	// exclude makes central leave out sites most edges report as down.
+	exclude bool
+}
+
+// healthReport is the last report of a single edge.
+type healthReport struct {
+	up       map[string]bool // Keyed by site IP.
+	received time.Time
+}
+
+// SiteHealth is the aggregated health of a single edge site.
+type SiteHealth struct {
+	Up   int `json:"up"`   // Number of edges reporting the site up.
+	Down int `json:"down"` // Number of edges reporting the site down.
+}
+
+func newHealthReports() *healthReports {
+	return &healthReports{reports: make(map[string]healthReport)}
+}
+
+// set records the report of an edge, replacing its previous one.
+func (h *healthReports) set(edge string, up map[string]bool) {
+	h.Lock()
+	h.reports[edge] = healthReport{up: up, received: time.Now()}
+	h.Unlock()
+}
+
+// Summary returns the aggregated health per site IP, taking only reports
+// received in the last healthReportTTL into account.
+func (h *healthReports) Summary() map[string]SiteHealth {
+	cutoff := time.Now().Add(-healthReportTTL)
+	summary := make(map[string]SiteHealth)
+
+	h.RLock()
+	defer h.RUnlock()
+	for _, r := range h.reports {
+		if r.received.Before(cutoff) {
+			continue
+		}
+		for ip, up := range r.up {
+			sh := summary[ip]
+			if up {
+				sh.Up++
+			} else {
+				sh.Down++
+			}
+			summary[ip] = sh
+		}
+	}
+	return summary
+}
+
+// filter drops the sites most edges report as down. If that would drop all of
+// them, all sites are returned.
+func (h *healthReports) filter(sites []EdgeSite) []EdgeSite {
+	summary := h.Summary()
+	if len(summary) == 0 {
+		return sites
+	}
+
+	up := make([]EdgeSite, 0, len(sites))
+	for _, es := range sites {
+		if sh := summary[es.IP]; sh.Down <= sh.Up {
+			up = append(up, es)
+		}
+	}
+	if len(up) == 0 {
+		return sites
+	}
+	return up
+}
+
+// healthReportTTL is how long a report of an edge is taken into account.
+const healthReportTTL = time.Minute
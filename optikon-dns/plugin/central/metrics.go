@@ -0,0 +1,63 @@
+package central
+
+import (
+	"sync"
+
+	"github.com/coredns/coredns/plugin"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Variables declared for monitoring.
+var (
+	TableReloadFailureCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "optikon-central",
+		Name:      "table_reload_failure_count_total",
+		Help:      "Counter of failed attempts to load the table file.",
+	})
+	TableReloadCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "optikon-central",
+		Name:      "table_reload_count_total",
+		Help:      "Counter of changed table files loaded successfully.",
+	})
+	TableSize = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "optikon-central",
+		Name:      "table_services",
+		Help:      "Gauge of services in the table currently served.",
+	})
+	QueryCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "optikon-central",
+		Name:      "queries_total",
+		Help:      "Counter of queries answered with edge sites, per service.",
+	}, []string{"service"})
+	NotServedCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "optikon-central",
+		Name:      "not_served_total",
+		Help:      "Counter of queries for names not in the table, passed to the next plugin.",
+	})
+	TableGeneration = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "optikon-central",
+		Name:      "table_generation",
+		Help:      "Generation of the table currently served.",
+	})
+	ReplicationFailureCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "optikon-central",
+		Name:      "replication_failure_count_total",
+		Help:      "Counter of failed attempts to replicate the table to a peer.",
+	}, []string{"peer"})
+	StreamSubscribers = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "optikon-central",
+		Name:      "stream_subscribers",
+		Help:      "Gauge of edges subscribed to the table stream.",
+	})
+)
+
+var once sync.Once
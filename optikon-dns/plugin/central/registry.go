@@ -0,0 +1,332 @@
+package central
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"wwwin-github.cisco.com/edge/optikon-dns/plugin/codec"
+	"wwwin-github.cisco.com/edge/optikon-dns/plugin/logging"
+
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+	crv1alpha1 "k8s.io/cluster-registry/pkg/apis/clusterregistry/v1alpha1"
+	crclient "k8s.io/cluster-registry/pkg/client/clientset/versioned"
+	crinformers "k8s.io/cluster-registry/pkg/client/informers/externalversions"
+)
+
+// Annotations set on cluster-registry Cluster objects by post-to-optikon.sh.
+const (
+	annotationLat       = "Lat"
+	annotationLon       = "Long"
+	annotationIP        = "IP"
+	annotationIPv6      = "IPv6"
+	annotationAPIServer = "APIServer"
+	annotationConf      = "Conf"
+)
+
+// annotationTTL may be set on the Services on the edges to the TTL of the
+// answers for the service, as a duration.
+const annotationTTL = "optikon/ttl"
+
+// EdgeClientFunc returns a clientset for the API server of an edge cluster.
+type EdgeClientFunc func(cluster *crv1alpha1.Cluster) (kubernetes.Interface, error)
+
+// Registry watches the cluster-registry for edge clusters and builds a Table
+// from the Services running on each of them.
+type Registry struct {
+	client     crclient.Interface
+	edgeClient EdgeClientFunc
+	resync     time.Duration
+
+	// update is called with every newly built Table.
+	update func(Table)
+
+	mu    sync.Mutex
+	edges map[string]*edgeCluster // Keyed by cluster name.
+
+	changed chan struct{}
+
+	log *logging.Logger
+}
+
+// edgeCluster holds the Service informer of a single registered edge.
+type edgeCluster struct {
+	version string
+	site    EdgeSite
+	lister  corelisters.ServiceLister
+	stop    chan struct{}
+}
+
+// NewRegistry returns a Registry reading clusters from client and connecting
+// to edges with edgeClient. Every rebuilt Table is passed to update.
+func NewRegistry(client crclient.Interface, edgeClient EdgeClientFunc, update func(Table)) *Registry {
+	return &Registry{
+		client:     client,
+		edgeClient: edgeClient,
+		resync:     defaultResync,
+		update:     update,
+		edges:      make(map[string]*edgeCluster),
+		changed:    make(chan struct{}, 1),
+		log:        logging.New("optikon-central"),
+	}
+}
+
+// Run watches the cluster-registry until stop is closed.
+func (r *Registry) Run(stop <-chan struct{}) {
+	factory := crinformers.NewSharedInformerFactory(r.client, r.resync)
+	informer := factory.Clusterregistry().V1alpha1().Clusters().Informer()
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { r.addCluster(obj) },
+		UpdateFunc: func(_, obj interface{}) { r.addCluster(obj) },
+		DeleteFunc: func(obj interface{}) { r.deleteCluster(obj) },
+	})
+	factory.Start(stop)
+
+	for {
+		select {
+		case <-stop:
+			r.mu.Lock()
+			for name, e := range r.edges {
+				close(e.stop)
+				delete(r.edges, name)
+			}
+			r.mu.Unlock()
+			return
+		case <-r.changed:
+			// Coalesce bursts of events, e.g. the initial list of a new edge.
+			time.Sleep(rebuildDelay)
+			r.update(r.Build())
+		}
+	}
+}
+
+// Build returns the Table for the Services currently known on all edges.
+func (r *Registry) Build() Table {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	names := make([]string, 0, len(r.edges))
+	for name := range r.edges {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	t := make(Table)
+	for _, name := range names {
+		e := r.edges[name]
+		svcs, err := e.lister.List(labels.Everything())
+		if err != nil {
+			r.log.Errorf("listing services of edge %s: %s", name, err)
+			continue
+		}
+		for _, svc := range svcs {
+			key := serviceName(svc)
+			site := e.site
+			site.Ports = nodePorts(svc)
+			entry := t[key]
+			entry.Sites = append(entry.Sites, site)
+			// Edges may disagree on the TTL, the shortest one wins.
+			if ttl := r.serviceTTL(svc); ttl != 0 && (entry.TTL == 0 || ttl < entry.TTL) {
+				entry.TTL = ttl
+			}
+			t[key] = entry
+		}
+	}
+	return t
+}
+
+// addCluster starts (or restarts, if the Cluster object changed) the Service
+// informer for a registered edge cluster.
+func (r *Registry) addCluster(obj interface{}) {
+	cluster, ok := obj.(*crv1alpha1.Cluster)
+	if !ok {
+		return
+	}
+
+	r.mu.Lock()
+	old, found := r.edges[cluster.Name]
+	r.mu.Unlock()
+	if found && old.version == cluster.ResourceVersion {
+		return
+	}
+
+	site, err := clusterSite(cluster)
+	if err != nil {
+		r.log.Errorf("ignoring edge cluster %s: %s", cluster.Name, err)
+		r.removeEdge(cluster.Name)
+		return
+	}
+	client, err := r.edgeClient(cluster)
+	if err != nil {
+		r.log.Errorf("unable to connect to edge cluster %s: %s", cluster.Name, err)
+		r.removeEdge(cluster.Name)
+		return
+	}
+
+	factory := informers.NewSharedInformerFactory(client, r.resync)
+	services := factory.Core().V1().Services()
+	services.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { r.notify() },
+		DeleteFunc: func(interface{}) { r.notify() },
+	})
+	e := &edgeCluster{
+		version: cluster.ResourceVersion,
+		site:    site,
+		lister:  services.Lister(),
+		stop:    make(chan struct{}),
+	}
+	factory.Start(e.stop)
+
+	r.mu.Lock()
+	if old, found := r.edges[cluster.Name]; found {
+		close(old.stop)
+	}
+	r.edges[cluster.Name] = e
+	r.mu.Unlock()
+
+	r.notify()
+}
+
+// deleteCluster stops watching a deregistered edge cluster.
+func (r *Registry) deleteCluster(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	cluster, ok := obj.(*crv1alpha1.Cluster)
+	if !ok {
+		return
+	}
+	r.removeEdge(cluster.Name)
+}
+
+func (r *Registry) removeEdge(name string) {
+	r.mu.Lock()
+	e, found := r.edges[name]
+	if found {
+		close(e.stop)
+		delete(r.edges, name)
+	}
+	r.mu.Unlock()
+
+	if found {
+		r.notify()
+	}
+}
+
+// notify schedules a rebuild of the Table without blocking.
+func (r *Registry) notify() {
+	select {
+	case r.changed <- struct{}{}:
+	default:
+	}
+}
+
+// nodePorts returns the named node ports of a Service, the ports it can be
+// reached on at the address of the edge.
+func nodePorts(svc *core.Service) []codec.Port {
+	var ports []codec.Port
+	for _, p := range svc.Spec.Ports {
+		if p.Name == "" || p.NodePort == 0 {
+			continue
+		}
+		ports = append(ports, codec.Port{Name: p.Name, Proto: strings.ToLower(string(p.Protocol)), Port: uint16(p.NodePort)})
+	}
+	return ports
+}
+
+// serviceTTL returns the answer TTL in seconds set on a Service, or 0.
+func (r *Registry) serviceTTL(svc *core.Service) uint32 {
+	value, found := svc.Annotations[annotationTTL]
+	if !found {
+		return 0
+	}
+	dur, err := time.ParseDuration(value)
+	if err != nil || dur < 0 {
+		r.log.Errorf("invalid %s annotation on service %s/%s: %q", annotationTTL, svc.Namespace, svc.Name, value)
+		return 0
+	}
+	return uint32(dur.Seconds())
+}
+
+// serviceName returns the Table key of a Service.
+func serviceName(svc *core.Service) string {
+	return svc.Name + "." + svc.Namespace + "." + serviceDomain
+}
+
+// clusterSite builds the EdgeSite of a cluster from its annotations. The IP is
+// taken from the IP annotation, or else from the host of the API server. Dual
+// stack clusters set their IPv6 address in the IPv6 annotation.
+func clusterSite(cluster *crv1alpha1.Cluster) (EdgeSite, error) {
+	var site EdgeSite
+	lat, err := strconv.ParseFloat(cluster.Annotations[annotationLat], 64)
+	if err != nil {
+		return site, fmt.Errorf("invalid %s annotation: %s", annotationLat, err)
+	}
+	lon, err := strconv.ParseFloat(cluster.Annotations[annotationLon], 64)
+	if err != nil {
+		return site, fmt.Errorf("invalid %s annotation: %s", annotationLon, err)
+	}
+
+	ip := cluster.Annotations[annotationIP]
+	if ip == "" {
+		u, err := url.Parse(cluster.Annotations[annotationAPIServer])
+		if err != nil {
+			return site, fmt.Errorf("invalid %s annotation: %s", annotationAPIServer, err)
+		}
+		ip = u.Hostname()
+	}
+	if net.ParseIP(ip) == nil {
+		return site, errNoClusterIP
+	}
+
+	site = EdgeSite{IP: ip, IPv6: cluster.Annotations[annotationIPv6], Lat: lat, Lon: lon}
+	if err := (Table{cluster.Name: {Sites: []EdgeSite{site}}}).Validate(); err != nil {
+		return site, err
+	}
+	return site, nil
+}
+
+// KubeconfigClient is the default EdgeClientFunc. It builds a client from the
+// kubeconfig stored in the Conf annotation of the cluster, pointed at the
+// APIServer annotation when set.
+func KubeconfigClient(cluster *crv1alpha1.Cluster) (kubernetes.Interface, error) {
+	conf := cluster.Annotations[annotationConf]
+	if conf == "" {
+		return nil, errNoKubeconfig
+	}
+	config, err := clientcmd.RESTConfigFromKubeConfig([]byte(conf))
+	if err != nil {
+		return nil, err
+	}
+	if server := cluster.Annotations[annotationAPIServer]; server != "" {
+		config.Host = server
+	}
+	return kubernetes.NewForConfig(config)
+}
+
+// registryConfig returns the client config for the cluster-registry, read from
+// kubeconfig or from the in-cluster service account if kubeconfig is empty.
+func registryConfig(kubeconfig string) (*rest.Config, error) {
+	if kubeconfig == "" {
+		return rest.InClusterConfig()
+	}
+	return clientcmd.BuildConfigFromFlags("", kubeconfig)
+}
+
+const (
+	serviceDomain = "svc.cluster.external"
+	defaultResync = 5 * time.Minute
+	rebuildDelay  = 500 * time.Millisecond
+)
@@ -0,0 +1,161 @@
+package central
+
+import (
+	"testing"
+	"time"
+
+	core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	crv1alpha1 "k8s.io/cluster-registry/pkg/apis/clusterregistry/v1alpha1"
+	crfake "k8s.io/cluster-registry/pkg/client/clientset/versioned/fake"
+)
+
+func testCluster(name, ip string, lat, lon string) *crv1alpha1.Cluster {
+	return &crv1alpha1.Cluster{ObjectMeta: metav1.ObjectMeta{
+		Name:            name,
+		ResourceVersion: "1",
+		Annotations:     map[string]string{annotationLat: lat, annotationLon: lon, annotationIP: ip},
+	}}
+}
+
+func testService(name, namespace string) *core.Service {
+	return &core.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		Spec: core.ServiceSpec{Ports: []core.ServicePort{
+			{Name: "http", Protocol: core.ProtocolTCP, Port: 80, NodePort: 30082},
+		}},
+	}
+}
+
+// waitForTable reads the tables built by the registry until one satisfies ok.
+func waitForTable(t *testing.T, tables <-chan Table, what string, ok func(Table) bool) Table {
+	t.Helper()
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case table := <-tables:
+			if ok(table) {
+				return table
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	const nginx = "nginx.default." + serviceDomain
+	const redis = "redis.default." + serviceDomain
+
+	edges := map[string]*k8sfake.Clientset{
+		"edge-1": k8sfake.NewSimpleClientset(testService("nginx", "default")),
+		"edge-2": k8sfake.NewSimpleClientset(testService("nginx", "default")),
+	}
+	registry := crfake.NewSimpleClientset(
+		testCluster("edge-1", "172.16.7.102", "55.664023", "12.610126"),
+		testCluster("edge-2", "172.16.7.103", "55.680770", "12.543006"),
+	)
+	edgeClient := func(cluster *crv1alpha1.Cluster) (kubernetes.Interface, error) {
+		return edges[cluster.Name], nil
+	}
+
+	tables := make(chan Table, 16)
+	r := NewRegistry(registry, edgeClient, func(t Table) { tables <- t })
+	stop := make(chan struct{})
+	defer close(stop)
+	go r.Run(stop)
+
+	table := waitForTable(t, tables, "nginx on both edges", func(t Table) bool {
+		return len(t[nginx].Sites) == 2
+	})
+	if ports := table[nginx].Sites[0].Ports; len(ports) != 1 || ports[0].Port != 30082 || ports[0].Proto != "tcp" {
+		t.Errorf("expected the node port of nginx, got %v", ports)
+	}
+
+	// A Service added on one edge.
+	if _, err := edges["edge-2"].CoreV1().Services("default").Create(testService("redis", "default")); err != nil {
+		t.Fatal(err)
+	}
+	table = waitForTable(t, tables, "redis on edge-2", func(t Table) bool {
+		return len(t[redis].Sites) == 1
+	})
+	if ip := table[redis].Sites[0].IP; ip != "172.16.7.103" {
+		t.Errorf("expected redis on 172.16.7.103, got %s", ip)
+	}
+
+	// A Service removed from one edge.
+	if err := edges["edge-1"].CoreV1().Services("default").Delete("nginx", &metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	table = waitForTable(t, tables, "nginx on edge-2 only", func(t Table) bool {
+		return len(t[nginx].Sites) == 1
+	})
+	if ip := table[nginx].Sites[0].IP; ip != "172.16.7.103" {
+		t.Errorf("expected nginx on 172.16.7.103, got %s", ip)
+	}
+
+	// An edge deregistered.
+	if err := registry.ClusterregistryV1alpha1().Clusters().Delete("edge-2", &metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitForTable(t, tables, "an empty table", func(t Table) bool {
+		return len(t) == 0
+	})
+}
+
+func TestClusterSite(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		ip          string
+		err         bool
+	}{
+		{"ip", map[string]string{annotationLat: "55.6", annotationLon: "12.6", annotationIP: "172.16.7.102"}, "172.16.7.102", false},
+		{"api server", map[string]string{annotationLat: "55.6", annotationLon: "12.6", annotationAPIServer: "https://172.16.7.103:6443"}, "172.16.7.103", false},
+		{"no address", map[string]string{annotationLat: "55.6", annotationLon: "12.6"}, "", true},
+		{"no latitude", map[string]string{annotationLon: "12.6", annotationIP: "172.16.7.102"}, "", true},
+		{"off the earth", map[string]string{annotationLat: "95", annotationLon: "12.6", annotationIP: "172.16.7.102"}, "", true},
+	}
+	for _, test := range tests {
+		cluster := &crv1alpha1.Cluster{ObjectMeta: metav1.ObjectMeta{Name: "edge", Annotations: test.annotations}}
+		site, err := clusterSite(cluster)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if site.IP != test.ip {
+			t.Errorf("%s: expected IP %s, got %s", test.name, test.ip, site.IP)
+		}
+	}
+}
+
+func TestServiceTTL(t *testing.T) {
+	tests := []struct {
+		annotation string
+		ttl        uint32
+	}{
+		{"", 0},
+		{"10s", 10},
+		{"1m30s", 90},
+		{"-5s", 0},
+		{"soon", 0},
+	}
+	r := NewRegistry(nil, nil, nil)
+	for _, test := range tests {
+		svc := testService("nginx", "default")
+		if test.annotation != "" {
+			svc.Annotations = map[string]string{annotationTTL: test.annotation}
+		}
+		if ttl := r.serviceTTL(svc); ttl != test.ttl {
+			t.Errorf("%q: expected TTL %d, got %d", test.annotation, test.ttl, ttl)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package central
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// replicator pushes the Table to the management API of the other centrals
+// after every local change, and every interval so peers that were down catch
+// up. Peers only apply a Table newer than their own, so the latest change made
+// on any central wins.
+type replicator struct {
+	peers    []string // Base URLs of the management APIs, e.g. http://10.0.0.2:8090.
+	interval time.Duration
+	changed  chan struct{}
+	client   *http.Client
+	token    string // Bearer token sent to the peers, if not empty.
+}
+
+// replica is the body of PUT /v1/table.
+type replica struct {
+	Generation uint64 `json:"generation"`
+	Table      Table  `json:"table"`
+}
+
+func newReplicator(peers []string) *replicator {
+	for i := range peers {
+		peers[i] = strings.TrimSuffix(peers[i], "/")
+	}
+	return &replicator{
+		peers:    peers,
+		interval: defaultReplicateInterval,
+		changed:  make(chan struct{}, 1),
+		client:   &http.Client{Timeout: replicateTimeout},
+	}
+}
+
+// authenticate makes r authenticate to the peers the way they authenticate
+// their clients: the centrals of a group share the api_token and api_tls
+// properties.
+func (r *replicator) authenticate(auth apiAuth) {
+	r.token = auth.token
+	if auth.tlsConfig != nil {
+		r.client.Transport = &http.Transport{TLSClientConfig: &tls.Config{
+			Certificates: auth.tlsConfig.Certificates,
+			RootCAs:      auth.tlsConfig.RootCAs,
+		}}
+	}
+}
+
+// notify schedules a push without blocking.
+func (r *replicator) notify() {
+	select {
+	case r.changed <- struct{}{}:
+	default:
+	}
+}
+
+// replicate pushes the Table to the peers whenever it changes and every
+// interval until stop is closed.
+func (oc *OptikonCentral) replicate(stop <-chan struct{}) {
+	ticker := time.NewTicker(oc.peers.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-oc.peers.changed:
+		case <-ticker.C:
+		}
+		oc.push()
+	}
+}
+
+// push sends the current Table to every peer.
+func (oc *OptikonCentral) push() {
+	t, gen := oc.snapshot()
+	data, err := json.Marshal(replica{Generation: gen, Table: t})
+	if err != nil {
+		oc.log.Errorf("encoding table for replication: %s", err)
+		return
+	}
+	for _, peer := range oc.peers.peers {
+		if err := oc.peers.send(peer, data); err != nil {
+			oc.log.Errorf("replicating table to %s: %s", peer, err)
+			ReplicationFailureCount.WithLabelValues(peer).Add(1)
+		}
+	}
+}
+
+// send puts a replica on peer. A peer that already has the same or a newer
+// generation is fine.
+func (r *replicator) send(peer string, data []byte) error {
+	req, err := http.NewRequest(http.MethodPut, peer+"/v1/table", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if r.token != "" {
+		req.Header.Set("Authorization", "Bearer "+r.token)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusConflict {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// applyReplica makes the Table of a peer the one served by oc, if it replaces
+// the current one. Replicas are persisted like changes made through the API,
+// but not pushed on: every central pushes its own changes to all peers. A peer
+// sending an older Table is sent the current one in return.
+func (oc *OptikonCentral) applyReplica(rep replica) error {
+	oc.writer.Lock()
+	defer oc.writer.Unlock()
+
+	if rep.Generation > oc.seen {
+		oc.seen = rep.Generation
+	}
+
+	oc.RLock()
+	current := replica{Generation: oc.generation, Table: oc.table}
+	oc.RUnlock()
+	if !rep.replaces(current) {
+		if oc.peers != nil && current.replaces(rep) {
+			oc.peers.notify()
+		}
+		return errStaleGeneration
+	}
+
+	if oc.api != nil && oc.api.persist && oc.file != nil {
+		if err := oc.writeTable(rep.Table); err != nil {
+			return err
+		}
+	}
+	oc.publish(rep.Table, rep.Generation)
+	oc.log.Infof("replicated %d services, generation %d", len(rep.Table), rep.Generation)
+	return nil
+}
+
+// replaces reports whether rep is a later Table than cur: one with a higher
+// generation, or, for changes made at the same time on different centrals,
+// the same generation and a larger digest, so all centrals settle on the same
+// Table.
+func (rep replica) replaces(cur replica) bool {
+	if rep.Generation != cur.Generation {
+		return rep.Generation > cur.Generation
+	}
+	return bytes.Compare(rep.Table.digest(), cur.Table.digest()) > 0
+}
+
+// digest returns the SHA-256 hash of the JSON encoding of t, which lists the
+// services in order.
+func (t Table) digest() []byte {
+	data, err := json.Marshal(t)
+	if err != nil {
+		return nil
+	}
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+// generationHeader carries the table generation in GET /v1/table responses.
+const generationHeader = "Optikon-Generation"
+
+const (
+	defaultReplicateInterval = 30 * time.Second
+	replicateTimeout         = 5 * time.Second
+)
@@ -1,10 +1,21 @@
 package central
 
 import (
+	"crypto/tls"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
 	"github.com/coredns/coredns/core/dnsserver"
 	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/metrics"
+	pkgtls "github.com/coredns/coredns/plugin/pkg/tls"
+	"wwwin-github.cisco.com/edge/optikon-dns/plugin/codec"
+	"wwwin-github.cisco.com/edge/optikon-dns/plugin/logging"
 
 	"github.com/mholt/caddy"
+	crclient "k8s.io/cluster-registry/pkg/client/clientset/versioned"
 )
 
 // Registers plugin upon package import.
@@ -24,8 +35,12 @@ func setup(c *caddy.Controller) error {
 		return plugin.Error("optikon-central", err)
 	}
 
-	// TODO: Don't use hardcoded values in the future.
-	oc.populateTable()
+	// Load the initial table so a broken file fails the server start.
+	if oc.file != nil {
+		if err := oc.loadTable(); err != nil {
+			return plugin.Error("optikon-central", err)
+		}
+	}
 
 	// Add the plugin handler to the dnsserver.
 	dnsserver.GetConfig(c).AddPlugin(func(next plugin.Handler) plugin.Handler {
@@ -33,24 +48,305 @@ func setup(c *caddy.Controller) error {
 		return oc
 	})
 
-	// TODO: START ROUTINE TO LISTEN FOR TABLE UPDATES?
+	// Register Prometheus metrics and start watching the table file.
+	c.OnStartup(func() error {
+		once.Do(func() {
+			metrics.MustRegister(c, TableReloadFailureCount, TableReloadCount, TableGeneration, TableSize,
+				QueryCount, NotServedCount, ReplicationFailureCount, StreamSubscribers)
+		})
+		return oc.OnStartup()
+	})
+
+	c.OnShutdown(func() error {
+		return oc.OnShutdown()
+	})
 
 	return nil
 }
 
+// OnStartup starts the management API and the goroutines watching the table
+// file or the cluster-registry, replicating the table to the peers and
+// streaming it to edges.
+func (oc *OptikonCentral) OnStartup() error {
+	if oc.api != nil {
+		if err := oc.startAPI(); err != nil {
+			return err
+		}
+	}
+	if oc.registry != nil {
+		go oc.registry.Run(oc.stop)
+	}
+	if oc.peers != nil {
+		go oc.replicate(oc.stop)
+	}
+	if oc.stream != nil {
+		if err := oc.startStream(); err != nil {
+			return err
+		}
+	}
+	if oc.file == nil {
+		return nil
+	}
+	if oc.file.reload > 0 {
+		go oc.watchTable(oc.stop)
+	}
+	return nil
+}
+
+// OnShutdown stops the management API, the table stream, watching the table
+// file and the cluster-registry and replicating the table.
+func (oc *OptikonCentral) OnShutdown() error {
+	close(oc.stop)
+	if oc.stream != nil {
+		oc.stopStream()
+	}
+	if oc.api != nil {
+		return oc.stopAPI()
+	}
+	return nil
+}
+
 // Parse the Corefile token.
 func parseOptikonCentral(c *caddy.Controller) (*OptikonCentral, error) {
 
 	// Initialize a new OptikonCentral struct.
 	oc := New()
 
-	// Skip the 'optikon-central' token.
-	c.Next()
+	i := 0
+	for c.Next() {
+		if i > 0 {
+			return nil, plugin.ErrOnce
+		}
+		i++
 
-	// If there are any other arguments, throw an error.
-	if c.NextArg() {
-		return oc, c.ArgErr()
+		// If there are any other arguments, throw an error.
+		if c.NextArg() {
+			return oc, c.ArgErr()
+		}
+
+		for c.NextBlock() {
+			if err := parseBlock(c, oc); err != nil {
+				return oc, err
+			}
+		}
+	}
+
+	// reload may come before table, the file only has a path once both are
+	// read.
+	if oc.file != nil && oc.file.path == "" {
+		return oc, errReloadNoTable
+	}
+	if oc.file != nil && oc.registry != nil {
+		return oc, errTableAndRegistry
+	}
+	if oc.api != nil && oc.api.persist && oc.file == nil {
+		return oc, errPersistNoTable
+	}
+	if oc.health.exclude && oc.api == nil {
+		return oc, errExcludeNoAPI
+	}
+	if oc.peers != nil && oc.api == nil {
+		return oc, errPeersNoAPI
+	}
+	if (oc.auth.token != "" || oc.auth.tlsConfig != nil) && oc.api == nil {
+		return oc, errAuthNoAPI
+	}
+	if oc.peers != nil {
+		oc.peers.authenticate(oc.auth)
 	}
 
 	return oc, nil
 }
+
+func parseBlock(c *caddy.Controller, oc *OptikonCentral) error {
+	switch c.Val() {
+	case "table":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		reload := defaultReload
+		if oc.file != nil {
+			reload = oc.file.reload
+		}
+		oc.file = &tableFile{path: c.Val(), reload: reload}
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+	case "reload":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		dur, err := parseReload(c.Val())
+		if err != nil {
+			return err
+		}
+		if oc.file == nil {
+			oc.file = new(tableFile)
+		}
+		oc.file.reload = dur
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+	case "registry":
+		args := c.RemainingArgs()
+		if len(args) > 1 {
+			return c.ArgErr()
+		}
+		kubeconfig := ""
+		if len(args) == 1 {
+			kubeconfig = args[0]
+		}
+		config, err := registryConfig(kubeconfig)
+		if err != nil {
+			return err
+		}
+		client, err := crclient.NewForConfig(config)
+		if err != nil {
+			return err
+		}
+		oc.registry = NewRegistry(client, KubeconfigClient, oc.setTable)
+		oc.registry.log = oc.log
+	case "ttl":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		dur, err := time.ParseDuration(c.Val())
+		if err != nil {
+			return err
+		}
+		if dur < 0 {
+			return fmt.Errorf("ttl can't be negative: %s", dur)
+		}
+		oc.ttl = uint32(dur.Seconds())
+	case "exclude_unhealthy":
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		oc.health.exclude = true
+	case "api":
+		args := c.RemainingArgs()
+		if len(args) == 0 || len(args) > 2 {
+			return c.ArgErr()
+		}
+		oc.api = &api{addr: args[0]}
+		if len(args) == 2 {
+			if args[1] != "persist" {
+				return c.Errf("unknown api option '%s'", args[1])
+			}
+			oc.api.persist = true
+		}
+	case "api_token":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		token, err := readToken(c.Val())
+		if err != nil {
+			return err
+		}
+		oc.auth.token = token
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+	case "api_tls":
+		args := c.RemainingArgs()
+		if len(args) != 2 && len(args) != 3 {
+			return c.ArgErr()
+		}
+		tlsConfig, err := pkgtls.NewTLSConfigFromArgs(args...)
+		if err != nil {
+			return err
+		}
+		if len(args) == 3 {
+			// Clients, including the peers, must present a certificate
+			// signed by the CA.
+			tlsConfig.ClientCAs = tlsConfig.RootCAs
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+		oc.auth.tlsConfig = tlsConfig
+	case "peers":
+		peers := c.RemainingArgs()
+		if len(peers) == 0 {
+			return c.ArgErr()
+		}
+		for _, peer := range peers {
+			u, err := url.Parse(peer)
+			if err != nil {
+				return err
+			}
+			if u.Scheme != "http" && u.Scheme != "https" {
+				return c.Errf("peer '%s' is not an http(s) URL", peer)
+			}
+		}
+		oc.peers = newReplicator(peers)
+	case "stream":
+		args := c.RemainingArgs()
+		if len(args) != 1 && len(args) != 4 {
+			return c.ArgErr()
+		}
+		oc.stream = newStreamer(args[0], oc)
+		if len(args) == 4 {
+			tlsConfig, err := pkgtls.NewTLSConfig(args[1], args[2], args[3])
+			if err != nil {
+				return err
+			}
+			// Edges must present a certificate signed by the CA.
+			tlsConfig.ClientCAs = tlsConfig.RootCAs
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+			oc.stream.tlsConfig = tlsConfig
+		}
+	case "sign":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		signer, err := codec.LoadSigner(c.Val())
+		if err != nil {
+			return err
+		}
+		oc.signer = signer
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+
+	case "log_level":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		level, err := logging.ParseLevel(c.Val())
+		if err != nil {
+			return err
+		}
+		oc.log.SetLevel(level)
+	case "log_format":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		switch c.Val() {
+		case "text":
+			oc.log.SetJSON(false)
+		case "json":
+			oc.log.SetJSON(true)
+		default:
+			return c.Errf("unknown log format '%s'", c.Val())
+		}
+
+	default:
+		return c.Errf("unknown property '%s'", c.Val())
+	}
+
+	return nil
+}
+
+// parseReload parses a reload interval; a bare "0" disables reloading.
+func parseReload(s string) (time.Duration, error) {
+	if n, err := strconv.Atoi(s); err == nil && n == 0 {
+		return 0, nil
+	}
+	dur, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if dur < 0 {
+		return 0, fmt.Errorf("reload can't be negative: %s", dur)
+	}
+	return dur, nil
+}
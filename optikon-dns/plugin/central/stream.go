@@ -0,0 +1,174 @@
+package central
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+
+	"wwwin-github.cisco.com/edge/optikon-dns/plugin/stream"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// streamer serves the table stream to edges over gRPC: a snapshot of the
+// table when an edge subscribes, followed by the changes to it. With
+// exclude_unhealthy the sites most edges report as down are left out, as they
+// are in answers to queries.
+type streamer struct {
+	addr      string
+	tlsConfig *tls.Config // Certificate and CA of the edges, nil for plain text.
+	oc        *OptikonCentral
+
+	// sent is the table as last streamed to the edges, guarded by the lock
+	// of oc.
+	sent Table
+
+	ln  net.Listener
+	srv *grpc.Server
+
+	sync.Mutex
+	subs map[*subscriber]struct{}
+}
+
+// subscriber is a single subscribed edge.
+type subscriber struct {
+	updates chan *stream.Update
+	dropped chan struct{} // Closed when the edge fell behind.
+}
+
+func newStreamer(addr string, oc *OptikonCentral) *streamer {
+	return &streamer{addr: addr, oc: oc, subs: make(map[*subscriber]struct{})}
+}
+
+// startStream starts serving the table stream.
+func (oc *OptikonCentral) startStream() error {
+	ln, err := net.Listen("tcp", oc.stream.addr)
+	if err != nil {
+		return err
+	}
+	oc.stream.ln = ln
+	opts := []grpc.ServerOption{grpc.CustomCodec(stream.Codec{})}
+	if oc.stream.tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(oc.stream.tlsConfig)))
+	}
+	oc.stream.srv = grpc.NewServer(opts...)
+	stream.RegisterTableServer(oc.stream.srv, oc.stream)
+
+	go func() {
+		oc.stream.srv.Serve(oc.stream.ln)
+	}()
+	return nil
+}
+
+// stopStream ends all table streams and closes the listener.
+func (oc *OptikonCentral) stopStream() {
+	if oc.stream.srv != nil {
+		oc.stream.srv.Stop()
+	}
+}
+
+// Subscribe implements stream.TableServer.
+func (s *streamer) Subscribe(req *stream.SubscribeRequest, ss stream.SubscribeServer) error {
+	sub := &subscriber{
+		updates: make(chan *stream.Update, streamBuffer),
+		dropped: make(chan struct{}),
+	}
+
+	// Take the snapshot and subscribe in one go, so no change is missed or
+	// sent twice.
+	s.oc.RLock()
+	snapshot := stream.Snapshot(s.sent, s.oc.generation)
+	s.add(sub)
+	s.oc.RUnlock()
+	defer s.remove(sub)
+
+	s.oc.log.Infof("edge %s subscribed to the table stream", req.Edge)
+	if err := ss.Send(snapshot); err != nil {
+		return err
+	}
+	for {
+		select {
+		case u := <-sub.updates:
+			if err := ss.Send(u); err != nil {
+				return err
+			}
+		case <-sub.dropped:
+			s.oc.log.Warningf("dropping edge %s from the table stream, it fell behind", req.Edge)
+			return errSubscriberBehind
+		case <-ss.Context().Done():
+			return ss.Context().Err()
+		}
+	}
+}
+
+// streamed returns t as streamed to the edges: without the sites most edges
+// report as down if oc excludes them, as is otherwise.
+func (oc *OptikonCentral) streamed(t Table) Table {
+	if !oc.health.exclude {
+		return t
+	}
+	filtered := make(Table, len(t))
+	for name, svc := range t {
+		svc.Sites = oc.health.filter(svc.Sites)
+		filtered[name] = svc
+	}
+	return filtered
+}
+
+// restream streams the services whose sites changed health since they were
+// last streamed, under the current generation. It is called for every health
+// report, so sites whose reports expired are streamed again with the next
+// report of any edge.
+func (oc *OptikonCentral) restream() {
+	if oc.stream == nil || !oc.health.exclude {
+		return
+	}
+	oc.writer.Lock()
+	defer oc.writer.Unlock()
+
+	streamed := oc.streamed(oc.table)
+	u := stream.Diff(oc.stream.sent, streamed, oc.generation)
+	if len(u.Services) == 0 && len(u.Deleted) == 0 {
+		return
+	}
+	oc.Lock()
+	oc.stream.sent = streamed
+	oc.stream.broadcast(u)
+	oc.Unlock()
+}
+
+func (s *streamer) add(sub *subscriber) {
+	s.Lock()
+	s.subs[sub] = struct{}{}
+	StreamSubscribers.Set(float64(len(s.subs)))
+	s.Unlock()
+}
+
+func (s *streamer) remove(sub *subscriber) {
+	s.Lock()
+	delete(s.subs, sub)
+	StreamSubscribers.Set(float64(len(s.subs)))
+	s.Unlock()
+}
+
+// broadcast queues u for every subscriber without blocking. Subscribers that
+// fell behind are dropped, they subscribe again and start over from a
+// snapshot. The caller must hold the lock of oc, which orders updates with
+// the snapshots taken by Subscribe.
+func (s *streamer) broadcast(u *stream.Update) {
+	s.Lock()
+	defer s.Unlock()
+	for sub := range s.subs {
+		select {
+		case sub.updates <- u:
+		default:
+			close(sub.dropped)
+			delete(s.subs, sub)
+		}
+	}
+	StreamSubscribers.Set(float64(len(s.subs)))
+}
+
+// streamBuffer is the number of updates queued per subscriber.
+const streamBuffer = 64
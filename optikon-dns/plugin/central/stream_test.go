@@ -0,0 +1,49 @@
+package central
+
+import (
+	"testing"
+
+	"wwwin-github.cisco.com/edge/optikon-dns/plugin/stream"
+)
+
+func TestStreamExcludeUnhealthy(t *testing.T) {
+	oc := New()
+	oc.health.exclude = true
+	oc.stream = newStreamer(":0", oc)
+
+	up := EdgeSite{IP: "172.16.7.102"}
+	down := EdgeSite{IP: "172.16.7.103"}
+	oc.publish(Table{"echoserver.default": {Sites: []EdgeSite{up, down}}}, 1)
+	if n := len(oc.stream.sent["echoserver.default"].Sites); n != 2 {
+		t.Fatalf("expected both sites streamed without health reports, got %d", n)
+	}
+
+	sub := &subscriber{updates: make(chan *stream.Update, streamBuffer), dropped: make(chan struct{})}
+	oc.stream.add(sub)
+
+	oc.health.set("edge1", map[string]bool{up.IP: true, down.IP: false})
+	oc.health.set("edge2", map[string]bool{down.IP: false})
+	oc.restream()
+
+	select {
+	case u := <-sub.updates:
+		if u.Generation != 1 {
+			t.Errorf("expected the update under generation 1, got %d", u.Generation)
+		}
+		sites := u.Services["echoserver.default"].Sites
+		if len(sites) != 1 || sites[0].IP != up.IP {
+			t.Errorf("expected only %s streamed, got %v", up.IP, sites)
+		}
+	default:
+		t.Fatal("expected an update after the site went down")
+	}
+
+	// Reports that don't change the health of a site aren't streamed.
+	oc.health.set("edge3", map[string]bool{up.IP: true})
+	oc.restream()
+	select {
+	case u := <-sub.updates:
+		t.Errorf("expected no update, got %v", u)
+	default:
+	}
+}
@@ -0,0 +1,84 @@
+package central
+
+import (
+	"os"
+	"time"
+
+	"wwwin-github.cisco.com/edge/optikon-dns/plugin/codec"
+)
+
+// tableFile tracks the on-disk Table and the file state seen at the last
+// successful read, so that unchanged files are not parsed again.
+type tableFile struct {
+	path   string
+	reload time.Duration
+
+	mtime time.Time
+	size  int64
+}
+
+// LoadTable reads a Table from a JSON or YAML file and validates it, see
+// codec.LoadTable.
+func LoadTable(path string) (Table, error) { return codec.LoadTable(path) }
+
+// ParseTable parses a JSON or YAML encoded Table, see codec.ParseTable.
+func ParseTable(data []byte) (Table, error) { return codec.ParseTable(data) }
+
+// Validate checks every edge site in the Table, see codec.Validate.
+func (t Table) Validate() error { return codec.Validate(t) }
+
+// loadTable loads the table file into oc if it changed since the last read.
+func (oc *OptikonCentral) loadTable() error {
+	oc.writer.Lock()
+	defer oc.writer.Unlock()
+
+	stat, err := os.Stat(oc.file.path)
+	if err != nil {
+		return err
+	}
+	if stat.ModTime().Equal(oc.file.mtime) && stat.Size() == oc.file.size {
+		return nil
+	}
+
+	// Remember the file state up front so a broken file is reported once per
+	// change rather than on every poll.
+	oc.file.mtime = stat.ModTime()
+	oc.file.size = stat.Size()
+
+	t, err := LoadTable(oc.file.path)
+	if err != nil {
+		return err
+	}
+	oc.swap(t)
+	TableReloadCount.Add(1)
+	oc.log.Infof("loaded %d services from %s", len(t), oc.file.path)
+	return nil
+}
+
+// readTable reloads the table file, keeping the last good table in place when
+// the file can't be read or fails to validate.
+func (oc *OptikonCentral) readTable() {
+	if err := oc.loadTable(); err != nil {
+		oc.log.Errorf("keeping last good table, failed to load %s: %s", oc.file.path, err)
+		TableReloadFailureCount.Add(1)
+	}
+}
+
+// watchTable polls the table file every reload interval until stop is closed.
+func (oc *OptikonCentral) watchTable(stop <-chan struct{}) {
+	ticker := time.NewTicker(oc.file.reload)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			oc.readTable()
+		}
+	}
+}
+
+const (
+	defaultReload = 5 * time.Second
+	defaultTTL    = 30 // Seconds.
+)
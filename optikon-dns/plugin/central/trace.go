@@ -0,0 +1,50 @@
+package central
+
+import (
+	"github.com/miekg/dns"
+	ot "github.com/opentracing/opentracing-go"
+	"golang.org/x/net/context"
+	"wwwin-github.cisco.com/edge/optikon-dns/plugin/codec"
+)
+
+// serveSpan starts the span of central answering r and returns it with a
+// context carrying it. If r carries the span context of the edge that asked,
+// the span continues the trace of the edge and follows from the span of the
+// trace plugin, so a single trace shows the query from the client to central.
+// If ctx carries no span the query isn't traced and a no-op span is returned.
+func serveSpan(ctx context.Context, r *dns.Msg) (ot.Span, context.Context) {
+	span := ot.SpanFromContext(ctx)
+	if span == nil {
+		return noopTracer.StartSpan("optikon-central"), ctx
+	}
+	tracer := span.Tracer()
+
+	// The first reference is the parent.
+	refs := []ot.StartSpanOption{ot.FollowsFrom(span.Context())}
+	if edge, err := codec.ExtractSpan(tracer, r); err == nil {
+		refs = append([]ot.StartSpanOption{ot.ChildOf(edge)}, refs...)
+	}
+	child := tracer.StartSpan("optikon-central", refs...)
+	return child, ot.ContextWithSpan(ctx, child)
+}
+
+// childSpan starts a span called name as a child of the span in ctx. If ctx
+// carries no span a no-op span is returned.
+func childSpan(ctx context.Context, name string) ot.Span {
+	span := ot.SpanFromContext(ctx)
+	if span == nil {
+		return noopTracer.StartSpan(name)
+	}
+	return span.Tracer().StartSpan(name, ot.ChildOf(span.Context()))
+}
+
+var noopTracer ot.NoopTracer
+
+// Tags set on the spans of central.
+const (
+	tagService    = "optikon.service"
+	tagFound      = "optikon.found"
+	tagGeneration = "optikon.generation"
+	tagSites      = "optikon.sites"
+	tagSigned     = "optikon.signed"
+)
@@ -0,0 +1,50 @@
+package central
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	ot "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"golang.org/x/net/context"
+
+	"wwwin-github.cisco.com/edge/optikon-dns/plugin/codec"
+)
+
+func TestServeSpan(t *testing.T) {
+	tracer := mocktracer.New()
+
+	// The span of the trace plugin of central, and the span of the edge
+	// connecting to central in another trace.
+	trace := tracer.StartSpan("servedns").(*mocktracer.MockSpan)
+	edge := tracer.StartSpan("connect").(*mocktracer.MockSpan)
+	ctx := ot.ContextWithSpan(context.Background(), trace)
+
+	r := new(dns.Msg)
+	r.SetQuestion("nginx.default.svc.cluster.external.", dns.TypeA)
+	if err := codec.InjectSpan(r, edge); err != nil {
+		t.Fatal(err)
+	}
+	span, _ := serveSpan(ctx, r)
+	span.Finish()
+	got := span.(*mocktracer.MockSpan)
+	if got.ParentID != edge.SpanContext.SpanID || got.SpanContext.TraceID != edge.SpanContext.TraceID {
+		t.Errorf("expected a child of the edge span %d in trace %d, got parent %d in trace %d",
+			edge.SpanContext.SpanID, edge.SpanContext.TraceID, got.ParentID, got.SpanContext.TraceID)
+	}
+
+	// Without the option of an edge the span is a child of the trace plugin.
+	r = new(dns.Msg)
+	r.SetQuestion("nginx.default.svc.cluster.external.", dns.TypeA)
+	span, _ = serveSpan(ctx, r)
+	span.Finish()
+	got = span.(*mocktracer.MockSpan)
+	if got.ParentID != trace.SpanContext.SpanID {
+		t.Errorf("expected a span following from %d, got parent %d", trace.SpanContext.SpanID, got.ParentID)
+	}
+
+	// Untraced queries get a no-op span.
+	if span, _ := serveSpan(context.Background(), r); span.Tracer() != (ot.NoopTracer{}) {
+		t.Errorf("expected a no-op span, got %T", span)
+	}
+}
@@ -0,0 +1,482 @@
+// Package codec implements the encoding of the edge sites optikon-central
+// returns to optikon-edge.
+//
+// The sites are carried in a local/experimental EDNS0 option (OptionCode) as a
+// versioned binary payload. The payload starts with a version byte, followed
+// by type-length-value fields: a one byte type, a two byte big-endian length
+// and the value. Every edge site is a field whose value is again a sequence of
+// fields. Decoders skip fields they don't know, so new fields can be added
+// without bumping the version.
+//
+// Servers that talk to edges which don't ask for the option fall back to a TXT
+// record in the additional section holding the sites as JSON.
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"net"
+)
+
+// EdgeSite is a wrapper around all information needed about edge sites serving
+// content.
+type EdgeSite struct {
+	// IP is the primary address of the site, it also identifies the site.
+	// It is usually an IPv4 address, but may be IPv6 for IPv6-only sites.
+	IP   string `json:"ip"`
+	IPv6 string `json:"ipv6,omitempty"` // IPv6 address of a dual-stack site.
+
+	Lon float64 `json:"lon"`
+	Lat float64 `json:"lat"`
+
+	// Weight is the relative capacity of the site, used by capacity-weighted
+	// selection. Weights can't be negative, tables with one don't parse; a
+	// site without a weight has weight 0.
+	Weight uint32 `json:"weight,omitempty"`
+
+	// Check describes how edges check the service on the site is up. Sites
+	// without a check are assumed to be up.
+	Check *HealthCheck `json:"check,omitempty"`
+
+	// Ports are the ports the service is exposed on at the site, answered in
+	// SRV records.
+	Ports []Port `json:"ports,omitempty"`
+}
+
+// A returns the IPv4 address of the site, or nil if it has none.
+func (es EdgeSite) A() net.IP {
+	return net.ParseIP(es.IP).To4()
+}
+
+// AAAA returns the IPv6 address of the site, or nil if it has none.
+func (es EdgeSite) AAAA() net.IP {
+	if es.IPv6 != "" {
+		return net.ParseIP(es.IPv6)
+	}
+	ip := net.ParseIP(es.IP)
+	if ip == nil || ip.To4() != nil {
+		return nil
+	}
+	return ip
+}
+
+// HealthCheck is a TCP or HTTP probe of the service on an edge site.
+type HealthCheck struct {
+	Proto string `json:"proto"` // "tcp" or "http".
+	Port  uint16 `json:"port"`
+	Path  string `json:"path,omitempty"` // Only used for http.
+}
+
+// Port is a named port of the service on an edge site, as in the SRV query
+// _<name>._<proto>.<service>.
+type Port struct {
+	Name  string `json:"name"`  // Such as "http".
+	Proto string `json:"proto"` // "tcp" or "udp".
+	Port  uint16 `json:"port"`
+}
+
+// Port returns the port of the site called name for proto, if the site has it.
+func (es EdgeSite) Port(name, proto string) (Port, bool) {
+	for _, p := range es.Ports {
+		if p.Name == name && p.Proto == proto {
+			return p, true
+		}
+	}
+	return Port{}, false
+}
+
+// Payload is everything central returns about a service.
+type Payload struct {
+	Sites []EdgeSite
+
+	// TTL is the number of seconds the edge may cache the sites.
+	TTL uint32
+
+	// AnswerTTL is the TTL in seconds of the records edges answer with for
+	// the service, 0 leaves it to the edge.
+	AnswerTTL uint32
+
+	// Generation of the table the sites were taken from. Generations only
+	// go up, the highest one is the latest table of all centrals. 0 if
+	// unknown.
+	Generation uint64
+
+	// Signature is set by Unmarshal for signed payloads, see Signer. Marshal
+	// doesn't write it.
+	Signature *Signature
+}
+
+// Version is the version of the binary encoding written by Marshal.
+const Version = 1
+
+// Top level fields.
+const (
+	fieldSite       = 1
+	fieldTTL        = 2
+	fieldAnswerTTL  = 3
+	fieldGeneration = 4
+	fieldSignature  = 5 // Always the last field.
+)
+
+// Edge site fields.
+const (
+	siteIP     = 1
+	siteLat    = 2
+	siteLon    = 3
+	siteWeight = 4
+	siteCheck  = 5
+	siteIPv6   = 6
+	sitePort   = 7
+)
+
+// Health check fields.
+const (
+	checkProto = 1
+	checkPort  = 2
+	checkPath  = 3
+)
+
+// Port fields.
+const (
+	portName   = 1
+	portProto  = 2
+	portNumber = 3
+)
+
+// Marshal returns the binary encoding of p. It fails if the encoding doesn't
+// fit in an EDNS0 option, whose length is 16 bits.
+func Marshal(p *Payload) ([]byte, error) {
+	b := []byte{Version}
+	b, err := appendField(b, fieldTTL, uint32Bytes(p.TTL))
+	if err != nil {
+		return nil, err
+	}
+	if p.AnswerTTL != 0 {
+		if b, err = appendField(b, fieldAnswerTTL, uint32Bytes(p.AnswerTTL)); err != nil {
+			return nil, err
+		}
+	}
+	if p.Generation != 0 {
+		if b, err = appendField(b, fieldGeneration, uint64Bytes(p.Generation)); err != nil {
+			return nil, err
+		}
+	}
+	for _, es := range p.Sites {
+		site, err := marshalSite(es)
+		if err != nil {
+			return nil, err
+		}
+		if b, err = appendField(b, fieldSite, site); err != nil {
+			return nil, err
+		}
+	}
+	if len(b) > math.MaxUint16 {
+		return nil, errPayloadTooLarge
+	}
+	return b, nil
+}
+
+func marshalSite(es EdgeSite) ([]byte, error) {
+	ip := net.ParseIP(es.IP)
+	if ip == nil {
+		return nil, errInvalidIP
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	var (
+		b   []byte
+		err error
+	)
+	if b, err = appendField(b, siteIP, ip); err != nil {
+		return nil, err
+	}
+	if es.IPv6 != "" {
+		ip6 := net.ParseIP(es.IPv6)
+		if ip6 == nil {
+			return nil, errInvalidIP
+		}
+		if b, err = appendField(b, siteIPv6, ip6.To16()); err != nil {
+			return nil, err
+		}
+	}
+	if b, err = appendField(b, siteLat, float(es.Lat)); err != nil {
+		return nil, err
+	}
+	if b, err = appendField(b, siteLon, float(es.Lon)); err != nil {
+		return nil, err
+	}
+	if es.Weight != 0 {
+		if b, err = appendField(b, siteWeight, uint32Bytes(es.Weight)); err != nil {
+			return nil, err
+		}
+	}
+	if es.Check != nil {
+		check, err := marshalCheck(es.Check)
+		if err != nil {
+			return nil, err
+		}
+		if b, err = appendField(b, siteCheck, check); err != nil {
+			return nil, err
+		}
+	}
+	for _, p := range es.Ports {
+		port, err := marshalPort(p)
+		if err != nil {
+			return nil, err
+		}
+		if b, err = appendField(b, sitePort, port); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+func marshalCheck(hc *HealthCheck) ([]byte, error) {
+	port := make([]byte, 2)
+	binary.BigEndian.PutUint16(port, hc.Port)
+
+	b, err := appendField(nil, checkProto, []byte(hc.Proto))
+	if err != nil {
+		return nil, err
+	}
+	if b, err = appendField(b, checkPort, port); err != nil {
+		return nil, err
+	}
+	if hc.Path != "" {
+		return appendField(b, checkPath, []byte(hc.Path))
+	}
+	return b, nil
+}
+
+func marshalPort(p Port) ([]byte, error) {
+	number := make([]byte, 2)
+	binary.BigEndian.PutUint16(number, p.Port)
+
+	b, err := appendField(nil, portName, []byte(p.Name))
+	if err != nil {
+		return nil, err
+	}
+	if b, err = appendField(b, portProto, []byte(p.Proto)); err != nil {
+		return nil, err
+	}
+	return appendField(b, portNumber, number)
+}
+
+// Unmarshal decodes a payload created by Marshal or Signer.Sign.
+func Unmarshal(b []byte) (*Payload, error) {
+	if len(b) == 0 {
+		return nil, errShortPayload
+	}
+	if b[0] != Version {
+		return nil, errUnknownVersion
+	}
+
+	b, sig, err := splitSignature(b)
+	if err != nil {
+		return nil, err
+	}
+
+	p := new(Payload)
+	err = walkFields(b[1:], func(typ byte, value []byte) error {
+		switch typ {
+		case fieldSite:
+			es, err := unmarshalSite(value)
+			if err != nil {
+				return err
+			}
+			p.Sites = append(p.Sites, es)
+		case fieldTTL:
+			if len(value) != 4 {
+				return errShortPayload
+			}
+			p.TTL = binary.BigEndian.Uint32(value)
+		case fieldAnswerTTL:
+			if len(value) != 4 {
+				return errShortPayload
+			}
+			p.AnswerTTL = binary.BigEndian.Uint32(value)
+		case fieldGeneration:
+			if len(value) != 8 {
+				return errShortPayload
+			}
+			p.Generation = binary.BigEndian.Uint64(value)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if sig != nil {
+		if p.Signature, err = unmarshalSignature(sig, b); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+func unmarshalSite(b []byte) (EdgeSite, error) {
+	var es EdgeSite
+	err := walkFields(b, func(typ byte, value []byte) error {
+		switch typ {
+		case siteIP:
+			if len(value) != net.IPv4len && len(value) != net.IPv6len {
+				return errInvalidIP
+			}
+			es.IP = net.IP(value).String()
+		case siteIPv6:
+			if len(value) != net.IPv6len {
+				return errInvalidIP
+			}
+			es.IPv6 = net.IP(value).String()
+		case siteLat:
+			f, err := unfloat(value)
+			if err != nil {
+				return err
+			}
+			es.Lat = f
+		case siteLon:
+			f, err := unfloat(value)
+			if err != nil {
+				return err
+			}
+			es.Lon = f
+		case siteWeight:
+			if len(value) != 4 {
+				return errShortPayload
+			}
+			es.Weight = binary.BigEndian.Uint32(value)
+		case siteCheck:
+			hc, err := unmarshalCheck(value)
+			if err != nil {
+				return err
+			}
+			es.Check = hc
+		case sitePort:
+			p, err := unmarshalPort(value)
+			if err != nil {
+				return err
+			}
+			es.Ports = append(es.Ports, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return es, err
+	}
+	if es.IP == "" {
+		return es, errInvalidIP
+	}
+	return es, nil
+}
+
+func unmarshalCheck(b []byte) (*HealthCheck, error) {
+	hc := new(HealthCheck)
+	err := walkFields(b, func(typ byte, value []byte) error {
+		switch typ {
+		case checkProto:
+			hc.Proto = string(value)
+		case checkPort:
+			if len(value) != 2 {
+				return errShortPayload
+			}
+			hc.Port = binary.BigEndian.Uint16(value)
+		case checkPath:
+			hc.Path = string(value)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return hc, nil
+}
+
+func unmarshalPort(b []byte) (Port, error) {
+	var p Port
+	err := walkFields(b, func(typ byte, value []byte) error {
+		switch typ {
+		case portName:
+			p.Name = string(value)
+		case portProto:
+			p.Proto = string(value)
+		case portNumber:
+			if len(value) != 2 {
+				return errShortPayload
+			}
+			p.Port = binary.BigEndian.Uint16(value)
+		}
+		return nil
+	})
+	return p, err
+}
+
+// appendField appends a type-length-value field to b.
+func appendField(b []byte, typ byte, value []byte) ([]byte, error) {
+	if len(value) > math.MaxUint16 {
+		return nil, errFieldTooLarge
+	}
+	b = append(b, typ, 0, 0)
+	binary.BigEndian.PutUint16(b[len(b)-2:], uint16(len(value)))
+	return append(b, value...), nil
+}
+
+// walkFields calls fn for every type-length-value field in b.
+func walkFields(b []byte, fn func(typ byte, value []byte) error) error {
+	for len(b) > 0 {
+		if len(b) < 3 {
+			return errShortPayload
+		}
+		typ := b[0]
+		l := int(binary.BigEndian.Uint16(b[1:3]))
+		b = b[3:]
+		if len(b) < l {
+			return errShortPayload
+		}
+		if err := fn(typ, b[:l]); err != nil {
+			return err
+		}
+		b = b[l:]
+	}
+	return nil
+}
+
+func uint32Bytes(i uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, i)
+	return b
+}
+
+func uint64Bytes(i uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, i)
+	return b
+}
+
+func float(f float64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, math.Float64bits(f))
+	return b
+}
+
+func unfloat(b []byte) (float64, error) {
+	if len(b) != 8 {
+		return 0, errShortPayload
+	}
+	f := math.Float64frombits(binary.BigEndian.Uint64(b))
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, errInvalidFloat
+	}
+	return f, nil
+}
+
+var (
+	errShortPayload    = errors.New("edge site payload too short")
+	errUnknownVersion  = errors.New("unknown edge site payload version")
+	errInvalidIP       = errors.New("invalid edge site ip")
+	errInvalidFloat    = errors.New("invalid edge site coordinate")
+	errFieldTooLarge   = errors.New("edge site field too large")
+	errPayloadTooLarge = errors.New("edge site payload too large for an EDNS0 option")
+)
@@ -0,0 +1,126 @@
+package codec
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestMarshalRoundTrip(t *testing.T) {
+	many := make([]EdgeSite, 200)
+	for i := range many {
+		many[i] = EdgeSite{IP: fmt.Sprintf("10.0.%d.%d", i/250, i%250+1), Lat: float64(i%180) - 89.5, Lon: float64(i) - 100.25}
+	}
+
+	tests := []struct {
+		name string
+		p    Payload
+	}{
+		{"empty", Payload{TTL: 30}},
+		{"one site", Payload{TTL: 30, Sites: []EdgeSite{{IP: "172.16.7.102", Lat: 55.664023, Lon: 12.610126}}}},
+		{"many sites", Payload{TTL: 30, Sites: many}},
+		{"ipv6 only", Payload{TTL: 30, Sites: []EdgeSite{{IP: "2001:db8::102", Lat: -33.86, Lon: 151.21}}}},
+		{"dual stack", Payload{TTL: 30, Sites: []EdgeSite{{IP: "172.16.7.102", IPv6: "2001:db8::102", Lat: 55.66, Lon: 12.61}}}},
+		{"ports", Payload{TTL: 30, Sites: []EdgeSite{{
+			IP: "172.16.7.102", Lat: 55.66, Lon: 12.61,
+			Ports: []Port{{Name: "http", Proto: "tcp", Port: 30082}, {Name: "dns", Proto: "udp", Port: 53}},
+		}}}},
+		{"weight and check", Payload{TTL: 30, Sites: []EdgeSite{{
+			IP: "172.16.7.102", Lat: 55.66, Lon: 12.61, Weight: 3,
+			Check: &HealthCheck{Proto: "http", Port: 8080, Path: "/healthz"},
+		}}}},
+		{"answer ttl and generation", Payload{TTL: 30, AnswerTTL: 5, Generation: 1<<40 + 7}},
+	}
+	for _, test := range tests {
+		b, err := Marshal(&test.p)
+		if err != nil {
+			t.Errorf("%s: marshal: %s", test.name, err)
+			continue
+		}
+		p, err := Unmarshal(b)
+		if err != nil {
+			t.Errorf("%s: unmarshal: %s", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(*p, test.p) {
+			t.Errorf("%s: expected %+v, got %+v", test.name, test.p, *p)
+		}
+	}
+}
+
+func TestMarshalInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		p    Payload
+		err  error
+	}{
+		{"invalid ip", Payload{Sites: []EdgeSite{{IP: "edge-1"}}}, errInvalidIP},
+		{"invalid ipv6", Payload{Sites: []EdgeSite{{IP: "172.16.7.102", IPv6: "::g"}}}, errInvalidIP},
+		{"long path", Payload{Sites: []EdgeSite{{IP: "172.16.7.102", Check: &HealthCheck{Proto: "http", Path: string(make([]byte, 1<<16))}}}}, errFieldTooLarge},
+		{"too many sites", Payload{Sites: manySites(2000)}, errPayloadTooLarge},
+	}
+	for _, test := range tests {
+		if _, err := Marshal(&test.p); err != test.err {
+			t.Errorf("%s: expected %v, got %v", test.name, test.err, err)
+		}
+	}
+}
+
+func TestUnmarshalInvalid(t *testing.T) {
+	b, err := Marshal(&Payload{TTL: 30, Sites: []EdgeSite{{IP: "172.16.7.102", Lat: 55.66, Lon: 12.61, Ports: []Port{{Name: "http", Proto: "tcp", Port: 80}}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		b    []byte
+		err  error
+	}{
+		{"empty", nil, errShortPayload},
+		{"unknown version", append([]byte{Version + 1}, b[1:]...), errUnknownVersion},
+		{"truncated field header", b[:3], errShortPayload},
+		{"truncated ttl", b[:6], errShortPayload},
+		{"truncated site", b[:len(b)-1], errShortPayload},
+		{"short ttl", []byte{Version, fieldTTL, 0, 2, 0, 30}, errShortPayload},
+		{"short ip", []byte{Version, fieldSite, 0, 5, siteIP, 0, 2, 10, 0}, errInvalidIP},
+		{"site without ip", []byte{Version, fieldSite, 0, 7, siteWeight, 0, 4, 0, 0, 0, 1}, errInvalidIP},
+		{"nan latitude", []byte{Version, fieldSite, 0, 18, siteIP, 0, 4, 10, 0, 0, 1, siteLat, 0, 8, 0x7f, 0xf8, 0, 0, 0, 0, 0, 1}, errInvalidFloat},
+	}
+	for _, test := range tests {
+		if _, err := Unmarshal(test.b); err != test.err {
+			t.Errorf("%s: expected %v, got %v", test.name, test.err, err)
+		}
+	}
+}
+
+func TestUnmarshalUnknownField(t *testing.T) {
+	b, err := Marshal(&Payload{TTL: 30, Sites: []EdgeSite{{IP: "172.16.7.102", Lat: 55.66, Lon: 12.61}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A field added by a later central.
+	b = append(b, 200, 0, 3, 1, 2, 3)
+
+	p, err := Unmarshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Sites) != 1 || p.Sites[0].IP != "172.16.7.102" {
+		t.Errorf("expected the site to survive an unknown field, got %+v", p.Sites)
+	}
+}
+
+// manySites returns n edge sites with distinct IPs and ports.
+func manySites(n int) []EdgeSite {
+	sites := make([]EdgeSite, n)
+	for i := range sites {
+		sites[i] = EdgeSite{
+			IP:    fmt.Sprintf("10.%d.%d.1", i/256, i%256),
+			Lat:   55.66,
+			Lon:   12.61,
+			Ports: []Port{{Name: "http", Proto: "tcp", Port: 80}},
+		}
+	}
+	return sites
+}
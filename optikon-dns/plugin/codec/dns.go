@@ -0,0 +1,164 @@
+package codec
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// OptionCode is the EDNS0 option code carrying the payload. It lies in the
+// range reserved for local/experimental use (RFC 6891).
+const OptionCode = 65301
+
+// Request marks m as coming from an edge that understands the EDNS0 option.
+// An OPT record is added to m if it doesn't have one.
+func Request(m *dns.Msg) {
+	o := m.IsEdns0()
+	if o == nil {
+		m.SetEdns0(dns.DefaultMsgSize, false)
+		o = m.IsEdns0()
+	}
+	for _, opt := range o.Option {
+		if opt.Option() == OptionCode {
+			return
+		}
+	}
+	o.Option = append(o.Option, &dns.EDNS0_LOCAL{Code: OptionCode})
+}
+
+// Requested reports whether the sender of m understands the EDNS0 option.
+func Requested(m *dns.Msg) bool {
+	o := m.IsEdns0()
+	if o == nil {
+		return false
+	}
+	for _, opt := range o.Option {
+		if opt.Option() == OptionCode {
+			return true
+		}
+	}
+	return false
+}
+
+// SetOption adds p as an EDNS0 option to the response m. The caller must have
+// added the OPT record to m already.
+func SetOption(m *dns.Msg, p *Payload) error {
+	data, err := Marshal(p)
+	if err != nil {
+		return err
+	}
+	return setOption(m, data)
+}
+
+func setOption(m *dns.Msg, data []byte) error {
+	o := m.IsEdns0()
+	if o == nil {
+		return errNoOPT
+	}
+	o.Option = append(o.Option, &dns.EDNS0_LOCAL{Code: OptionCode, Data: data})
+	return nil
+}
+
+// TXT returns the fallback TXT record holding the sites of p as JSON. The JSON
+// is split over as many strings as needed to stay within 255 bytes each on the
+// wire, the TTL of p becomes the TTL of the record. The AnswerTTL of p isn't
+// carried, edges fall back to their default.
+func TXT(name string, class uint16, p *Payload) (*dns.TXT, error) {
+	data, err := json.Marshal(p.Sites)
+	if err != nil {
+		return nil, err
+	}
+
+	txt := new(dns.TXT)
+	txt.Hdr = dns.RR_Header{Name: name, Rrtype: dns.TypeTXT, Class: class, Ttl: p.TTL}
+	for len(data) > maxTxtString {
+		txt.Txt = append(txt.Txt, escapeTxt(data[:maxTxtString]))
+		data = data[maxTxtString:]
+	}
+	txt.Txt = append(txt.Txt, escapeTxt(data))
+	return txt, nil
+}
+
+// escapeTxt returns b in the presentation format of TXT strings used by the
+// dns package, which unescapes them when packing.
+func escapeTxt(b []byte) string {
+	s := make([]byte, 0, len(b))
+	for _, c := range b {
+		if c == '\\' || c == '"' {
+			s = append(s, '\\')
+		}
+		s = append(s, c)
+	}
+	return string(s)
+}
+
+// unescapeTxt returns the bytes of the TXT string s in presentation format,
+// where the dns package escapes quotes and backslashes with a backslash and
+// unprintable bytes as \DDD.
+func unescapeTxt(s string) []byte {
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			b = append(b, s[i])
+			continue
+		}
+		i++
+		if i+2 < len(s) && isDigit(s[i]) && isDigit(s[i+1]) && isDigit(s[i+2]) {
+			b = append(b, (s[i]-'0')*100+(s[i+1]-'0')*10+(s[i+2]-'0'))
+			i += 2
+			continue
+		}
+		b = append(b, s[i])
+	}
+	return b
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+
+// Extract returns the payload carried by m, either in the EDNS0 option or
+// in the fallback TXT record, and removes it from m. Only a TXT record owned
+// by the question name is taken for the fallback, other TXT records in the
+// additional section are left alone. ErrNoPayload is returned if m carries
+// neither.
+func Extract(m *dns.Msg) (*Payload, error) {
+	if o := m.IsEdns0(); o != nil {
+		for i, opt := range o.Option {
+			local, ok := opt.(*dns.EDNS0_LOCAL)
+			if !ok || local.Code != OptionCode || len(local.Data) == 0 {
+				continue
+			}
+			o.Option = append(o.Option[:i], o.Option[i+1:]...)
+			return Unmarshal(local.Data)
+		}
+	}
+
+	for i, rr := range m.Extra {
+		txt, ok := rr.(*dns.TXT)
+		if !ok || len(m.Question) == 0 || !strings.EqualFold(txt.Hdr.Name, m.Question[0].Name) {
+			continue
+		}
+		m.Extra = append(m.Extra[:i], m.Extra[i+1:]...)
+
+		p := &Payload{TTL: txt.Hdr.Ttl}
+		var data []byte
+		for _, s := range txt.Txt {
+			data = append(data, unescapeTxt(s)...)
+		}
+		if err := json.Unmarshal(data, &p.Sites); err != nil {
+			return nil, err
+		}
+		return p, nil
+	}
+
+	return nil, ErrNoPayload
+}
+
+// ErrNoPayload is returned by Extract for messages that don't carry edge sites.
+var ErrNoPayload = errors.New("no edge site payload in message")
+
+var errNoOPT = errors.New("no OPT record in message")
+
+// maxTxtString is the maximum length of a single character-string in a TXT record.
+const maxTxtString = 255
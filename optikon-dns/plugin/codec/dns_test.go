@@ -0,0 +1,133 @@
+package codec
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestTXT(t *testing.T) {
+	sites := make([]EdgeSite, 20)
+	for i := range sites {
+		sites[i] = EdgeSite{IP: fmt.Sprintf("172.16.7.%d", i+100), Lat: 55.664023, Lon: 12.610126}
+	}
+	// Quotes, backslashes and bytes beyond ASCII are escaped in TXT strings.
+	sites[0].Check = &HealthCheck{Proto: "http", Port: 8080, Path: `/health\\"z/æøå`}
+	p := &Payload{TTL: 30, Sites: sites}
+
+	txt, err := TXT("nginx.default.svc.cluster.external.", dns.ClassINET, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txt.Txt) < 2 {
+		t.Fatalf("expected the sites to be split over several strings, got %d", len(txt.Txt))
+	}
+	for i, s := range txt.Txt {
+		if l := len(unescapeTxt(s)); l > maxTxtString {
+			t.Errorf("string %d is %d bytes long", i, l)
+		}
+	}
+	if txt.Hdr.Ttl != 30 {
+		t.Errorf("expected TTL 30, got %d", txt.Hdr.Ttl)
+	}
+
+	// The record must survive the wire, where every string is length prefixed.
+	m := new(dns.Msg)
+	m.SetQuestion("nginx.default.svc.cluster.external.", dns.TypeA)
+	m.Extra = append(m.Extra, txt)
+	wire, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m = new(dns.Msg)
+	if err := m.Unpack(wire); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := Extract(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, p) {
+		t.Errorf("expected %+v, got %+v", p, got)
+	}
+	if len(m.Extra) != 0 {
+		t.Errorf("expected the TXT record to be removed, got %v", m.Extra)
+	}
+}
+
+func TestExtractTXTName(t *testing.T) {
+	p := &Payload{TTL: 30, Sites: []EdgeSite{{IP: "172.16.7.102", Lat: 55.66, Lon: 12.61}}}
+	other, err := TXT("redis.default.svc.cluster.external.", dns.ClassINET, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion("nginx.default.svc.cluster.external.", dns.TypeA)
+	m.Extra = append(m.Extra, other)
+	if _, err := Extract(m); err != ErrNoPayload {
+		t.Errorf("expected %v for a TXT record of another name, got %v", ErrNoPayload, err)
+	}
+	if len(m.Extra) != 1 {
+		t.Errorf("expected the TXT record of another name to be left alone")
+	}
+
+	// Names compare case insensitively.
+	own, err := TXT("nginx.default.svc.cluster.external.", dns.ClassINET, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Question[0].Name = "NGINX.default.svc.cluster.external."
+	m.Extra = append(m.Extra, own)
+	got, err := Extract(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, p) {
+		t.Errorf("expected %+v, got %+v", p, got)
+	}
+	if len(m.Extra) != 1 || m.Extra[0] != other {
+		t.Errorf("expected only the TXT record of another name to be left, got %v", m.Extra)
+	}
+}
+
+func TestOption(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("nginx.default.svc.cluster.external.", dns.TypeA)
+	if Requested(req) {
+		t.Errorf("expected a plain query not to request the option")
+	}
+	Request(req)
+	Request(req)
+	if !Requested(req) {
+		t.Errorf("expected the query to request the option")
+	}
+	if n := len(req.IsEdns0().Option); n != 1 {
+		t.Errorf("expected a single option, got %d", n)
+	}
+
+	p := &Payload{TTL: 30, AnswerTTL: 5, Generation: 3, Sites: []EdgeSite{{IP: "2001:db8::102", Lat: -33.86, Lon: 151.21}}}
+	m := new(dns.Msg)
+	m.SetReply(req)
+	if err := SetOption(m, p); err != errNoOPT {
+		t.Errorf("expected %v without an OPT record, got %v", errNoOPT, err)
+	}
+	m.SetEdns0(dns.DefaultMsgSize, false)
+	if err := SetOption(m, p); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := Extract(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, p) {
+		t.Errorf("expected %+v, got %+v", p, got)
+	}
+	if _, err := Extract(m); err != ErrNoPayload {
+		t.Errorf("expected the option to be removed, got %v", err)
+	}
+}
@@ -0,0 +1,29 @@
+//go:build gofuzz
+// +build gofuzz
+
+package codec
+
+import "reflect"
+
+// Fuzz checks that Unmarshal doesn't panic on arbitrary input and that every
+// payload it accepts, less its signature, survives a round trip through Marshal.
+func Fuzz(data []byte) int {
+	p, err := Unmarshal(data)
+	if err != nil {
+		return 0
+	}
+	// Marshal doesn't write signatures.
+	p.Signature = nil
+	b, err := Marshal(p)
+	if err != nil {
+		panic(err)
+	}
+	p2, err := Unmarshal(b)
+	if err != nil {
+		panic(err)
+	}
+	if !reflect.DeepEqual(p, p2) {
+		panic("payload changed in round trip")
+	}
+	return 1
+}
@@ -0,0 +1,80 @@
+package codec
+
+import (
+	"net"
+	"strings"
+)
+
+// Name is a query name split into the service it is about and the labels edges
+// put in front of service names.
+type Name struct {
+	Service string // Table key of the service, without the trailing dot.
+	Port    string // Port name of an SRV query, without the underscore.
+	Proto   string // Protocol of an SRV query, without the underscore.
+	Site    string // IP of the edge site an SRV target name refers to.
+}
+
+// ParseName splits qname. SRV queries for _<port>._<proto>.<service> and the
+// names of SRV targets, <site>._site.<service> (see SiteTarget), are both about
+// <service>. Service names can't hold underscores, so neither form is taken
+// for a service name.
+func ParseName(qname string) Name {
+	name := strings.TrimSuffix(strings.ToLower(qname), ".")
+	n := Name{Service: name}
+
+	first, rest, ok := splitLabel(name)
+	if !ok {
+		return n
+	}
+	second, service, ok := splitLabel(rest)
+	if !ok || service == "" {
+		return n
+	}
+	if second == siteLabel {
+		if ip := siteAddress(first); ip != nil {
+			n.Site, n.Service = ip.String(), service
+		}
+		return n
+	}
+	if !isUnderscored(first) || !isUnderscored(second) {
+		return n
+	}
+	n.Port, n.Proto, n.Service = first[1:], second[1:], service
+	return n
+}
+
+// SiteTarget returns the name of the edge site with address ip under service,
+// used as target of SRV records. The name itself resolves to ip.
+func SiteTarget(ip, service string) string {
+	label := strings.Map(func(r rune) rune {
+		if r == '.' || r == ':' {
+			return '-'
+		}
+		return r
+	}, ip)
+	return label + "." + siteLabel + "." + service + "."
+}
+
+// siteAddress parses the address in a site label, IPv4 and IPv6 addresses have
+// their dots or colons replaced by dashes.
+func siteAddress(label string) net.IP {
+	if ip := net.ParseIP(strings.Replace(label, "-", ".", -1)); ip != nil && ip.To4() != nil {
+		return ip
+	}
+	return net.ParseIP(strings.Replace(label, "-", ":", -1))
+}
+
+// splitLabel splits the first label off name.
+func splitLabel(name string) (string, string, bool) {
+	i := strings.IndexByte(name, '.')
+	if i < 0 {
+		return "", "", false
+	}
+	return name[:i], name[i+1:], true
+}
+
+func isUnderscored(label string) bool { return len(label) > 1 && label[0] == '_' }
+
+// siteLabel is the label between the address of an edge site and the service
+// in the names of SRV targets.
+const siteLabel = "_site"
@@ -0,0 +1,38 @@
+package codec
+
+import "testing"
+
+func TestParseName(t *testing.T) {
+	tests := []struct {
+		qname string
+		want  Name
+	}{
+		{"nginx.default.svc.cluster.external.", Name{Service: "nginx.default.svc.cluster.external"}},
+		{"NGINX.default.svc.cluster.external.", Name{Service: "nginx.default.svc.cluster.external"}},
+		{"_http._tcp.nginx.default.svc.cluster.external.", Name{Service: "nginx.default.svc.cluster.external", Port: "http", Proto: "tcp"}},
+		{"10-0-0-1._site.nginx.default.svc.cluster.external.", Name{Service: "nginx.default.svc.cluster.external", Site: "10.0.0.1"}},
+		{"2001-db8--1._site.nginx.default.svc.cluster.external.", Name{Service: "nginx.default.svc.cluster.external", Site: "2001:db8::1"}},
+		// Services whose names merely look like SRV targets.
+		{"site-10-0-0-1.nginx.default.svc.cluster.external.", Name{Service: "site-10-0-0-1.nginx.default.svc.cluster.external"}},
+		{"10-0-0-1.nginx.default.svc.cluster.external.", Name{Service: "10-0-0-1.nginx.default.svc.cluster.external"}},
+		{"web._site.nginx.default.svc.cluster.external.", Name{Service: "web._site.nginx.default.svc.cluster.external"}},
+		// Half of an SRV query name.
+		{"_http.nginx.default.svc.cluster.external.", Name{Service: "_http.nginx.default.svc.cluster.external"}},
+		{"external.", Name{Service: "external"}},
+	}
+	for _, test := range tests {
+		if got := ParseName(test.qname); got != test.want {
+			t.Errorf("%s: expected %+v, got %+v", test.qname, test.want, got)
+		}
+	}
+}
+
+func TestSiteTarget(t *testing.T) {
+	for _, ip := range []string{"10.0.0.1", "2001:db8::1"} {
+		target := SiteTarget(ip, "nginx.default.svc.cluster.external")
+		n := ParseName(target)
+		if n.Site != ip || n.Service != "nginx.default.svc.cluster.external" {
+			t.Errorf("%s: expected %s to parse back to the site and service, got %+v", ip, target, n)
+		}
+	}
+}
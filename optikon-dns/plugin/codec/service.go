@@ -0,0 +1,36 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// Service is everything central has about a service: the edge sites running
+// it and the TTL of the answers edges give for it.
+type Service struct {
+	Sites []EdgeSite `json:"sites"`
+
+	// TTL is in seconds, 0 leaves it to the edges.
+	TTL uint32 `json:"ttl,omitempty"`
+}
+
+// UnmarshalJSON accepts a service either as an object or, as in tables
+// without per-service settings, as the bare list of its edge sites.
+func (s *Service) UnmarshalJSON(data []byte) error {
+	if data = bytes.TrimSpace(data); len(data) > 0 && data[0] == '[' {
+		*s = Service{}
+		return json.Unmarshal(data, &s.Sites)
+	}
+	type service Service // Without the UnmarshalJSON method.
+	return json.Unmarshal(data, (*service)(s))
+}
+
+// MarshalJSON writes services without a TTL as the bare list of their edge
+// sites, so tables that don't use TTLs keep their format.
+func (s Service) MarshalJSON() ([]byte, error) {
+	if s.TTL == 0 {
+		return json.Marshal(s.Sites)
+	}
+	type service Service // Without the MarshalJSON method.
+	return json.Marshal(service(s))
+}
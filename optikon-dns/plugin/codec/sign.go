@@ -0,0 +1,265 @@
+package codec
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/ed25519"
+)
+
+// Signature authenticates a payload as sent by central for a query name. It is
+// the last field of a signed payload and covers the query name, all fields
+// before it, the key id and the time of signing, so a payload can't be
+// altered or replayed for another name.
+type Signature struct {
+	KeyID    string
+	SignedAt time.Time // Truncated to the second.
+	Value    []byte
+
+	signed []byte // The encoded payload up to the signature.
+}
+
+// Signer signs payloads with an ed25519 private key.
+type Signer struct {
+	KeyID string
+	Key   ed25519.PrivateKey
+}
+
+// Sign returns the encoding of p signed for the query name qname at now. Like
+// Marshal, it fails if the signed encoding doesn't fit in an EDNS0 option.
+func (s *Signer) Sign(p *Payload, qname string, now time.Time) ([]byte, error) {
+	b, err := Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	at := now.Unix()
+	value := ed25519.Sign(s.Key, signedMessage(qname, b, s.KeyID, at))
+
+	sig, err := appendField(nil, sigKeyID, []byte(s.KeyID))
+	if err != nil {
+		return nil, err
+	}
+	if sig, err = appendField(sig, sigTime, uint64Bytes(uint64(at))); err != nil {
+		return nil, err
+	}
+	if sig, err = appendField(sig, sigValue, value); err != nil {
+		return nil, err
+	}
+	if b, err = appendField(b, fieldSignature, sig); err != nil {
+		return nil, err
+	}
+	if len(b) > math.MaxUint16 {
+		return nil, errPayloadTooLarge
+	}
+	return b, nil
+}
+
+// SetOption adds p signed for the query name qname as an EDNS0 option to the
+// response m, see SetOption.
+func (s *Signer) SetOption(m *dns.Msg, qname string, p *Payload, now time.Time) error {
+	data, err := s.Sign(p, qname, now)
+	if err != nil {
+		return err
+	}
+	return setOption(m, data)
+}
+
+// KeySet holds the public keys payloads are verified with, by key id. Keys are
+// rotated by adding the new key to the set of every edge, switching central to
+// it, and then removing the old key.
+type KeySet map[string]ed25519.PublicKey
+
+// Verify checks that p carries a valid signature for the query name qname,
+// made with a key in ks no more than maxAge away from now. A maxAge of 0 skips
+// the age check.
+func (ks KeySet) Verify(p *Payload, qname string, maxAge time.Duration, now time.Time) error {
+	sig := p.Signature
+	if sig == nil {
+		return ErrUnsigned
+	}
+	key, found := ks[sig.KeyID]
+	if !found {
+		return ErrUnknownKey
+	}
+	if !ed25519.Verify(key, signedMessage(qname, sig.signed, sig.KeyID, sig.SignedAt.Unix()), sig.Value) {
+		return ErrBadSignature
+	}
+	if maxAge > 0 {
+		if age := now.Sub(sig.SignedAt); age > maxAge || age < -maxAge {
+			return ErrExpiredSignature
+		}
+	}
+	return nil
+}
+
+// signedMessage returns the message a signature is made over.
+func signedMessage(qname string, payload []byte, keyID string, at int64) []byte {
+	m := make([]byte, 0, len(signContext)+len(qname)+len(payload)+len(keyID)+11)
+	m = append(m, signContext...)
+	m = append(m, strings.ToLower(dns.Fqdn(qname))...)
+	m = append(m, 0)
+	m = append(m, payload...)
+	m = append(m, keyID...)
+	m = append(m, 0)
+	return append(m, uint64Bytes(uint64(at))...)
+}
+
+// splitSignature splits the encoded payload b into the payload up to the
+// signature field and the value of that field, nil if b isn't signed. The
+// signature must be the last field.
+func splitSignature(b []byte) ([]byte, []byte, error) {
+	for off := 1; off < len(b); {
+		if len(b)-off < 3 {
+			return nil, nil, errShortPayload
+		}
+		typ := b[off]
+		end := off + 3 + int(binary.BigEndian.Uint16(b[off+1:off+3]))
+		if end > len(b) {
+			return nil, nil, errShortPayload
+		}
+		if typ == fieldSignature {
+			if end != len(b) {
+				return nil, nil, errFieldAfterSignature
+			}
+			return b[:off], b[off+3 : end], nil
+		}
+		off = end
+	}
+	return b, nil, nil
+}
+
+func unmarshalSignature(b, signed []byte) (*Signature, error) {
+	sig := &Signature{signed: signed}
+	err := walkFields(b, func(typ byte, value []byte) error {
+		switch typ {
+		case sigKeyID:
+			sig.KeyID = string(value)
+		case sigTime:
+			if len(value) != 8 {
+				return errShortPayload
+			}
+			sig.SignedAt = time.Unix(int64(binary.BigEndian.Uint64(value)), 0)
+		case sigValue:
+			sig.Value = value
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(sig.Value) != ed25519.SignatureSize {
+		return nil, errInvalidSignature
+	}
+	return sig, nil
+}
+
+// LoadSigner reads the signing key from path. The file holds a line with the
+// key id and the base64 encoded ed25519 private key or its 32 byte seed,
+// separated by whitespace. Empty lines and lines starting with # are ignored.
+func LoadSigner(path string) (*Signer, error) {
+	keys, err := readKeyFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) != 1 {
+		return nil, fmt.Errorf("%s: want exactly one key, got %d", path, len(keys))
+	}
+	id, key := keys[0].id, keys[0].key
+	switch len(key) {
+	case ed25519.SeedSize:
+		return &Signer{KeyID: id, Key: ed25519.NewKeyFromSeed(key)}, nil
+	case ed25519.PrivateKeySize:
+		return &Signer{KeyID: id, Key: ed25519.PrivateKey(key)}, nil
+	}
+	return nil, fmt.Errorf("%s: key %s is not an ed25519 private key", path, id)
+}
+
+// LoadKeySet reads the public keys in paths. Every line of the files holds a
+// key id and the base64 encoded ed25519 public key, separated by whitespace.
+// Empty lines and lines starting with # are ignored.
+func LoadKeySet(paths ...string) (KeySet, error) {
+	ks := make(KeySet)
+	for _, path := range paths {
+		keys, err := readKeyFile(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, k := range keys {
+			id, key := k.id, k.key
+			if len(key) != ed25519.PublicKeySize {
+				return nil, fmt.Errorf("%s: key %s is not an ed25519 public key", path, id)
+			}
+			if _, dup := ks[id]; dup {
+				return nil, fmt.Errorf("%s: duplicate key id %s", path, id)
+			}
+			ks[id] = ed25519.PublicKey(key)
+		}
+	}
+	return ks, nil
+}
+
+// keyLine is a key in a key file.
+type keyLine struct {
+	id  string
+	key []byte
+}
+
+// readKeyFile returns the key ids and decoded keys in the key file at path.
+func readKeyFile(path string) ([]keyLine, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var keys []keyLine
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: want a key id and a key", path, line)
+		}
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, line, err)
+		}
+		keys = append(keys, keyLine{id: fields[0], key: key})
+	}
+	return keys, scanner.Err()
+}
+
+// signContext separates signatures over payloads from any other use of the
+// keys.
+const signContext = "optikon payload signature v1\x00"
+
+// Signature fields.
+const (
+	sigKeyID = 1
+	sigTime  = 2
+	sigValue = 3
+)
+
+// Errors returned by KeySet.Verify.
+var (
+	ErrUnsigned         = errors.New("edge site payload is not signed")
+	ErrUnknownKey       = errors.New("edge site payload signed with unknown key")
+	ErrBadSignature     = errors.New("edge site payload signature is invalid")
+	ErrExpiredSignature = errors.New("edge site payload signature is stale")
+)
+
+var (
+	errFieldAfterSignature = errors.New("edge site payload field after signature")
+	errInvalidSignature    = errors.New("invalid edge site payload signature")
+)
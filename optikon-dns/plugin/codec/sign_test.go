@@ -0,0 +1,211 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// testSigner returns a signer with the key derived from seed.
+func testSigner(id string, seed byte) *Signer {
+	return &Signer{KeyID: id, Key: ed25519.NewKeyFromSeed(bytes.Repeat([]byte{seed}, ed25519.SeedSize))}
+}
+
+func (s *Signer) public() ed25519.PublicKey { return s.Key.Public().(ed25519.PublicKey) }
+
+func TestVerify(t *testing.T) {
+	const qname = "nginx.default.svc.cluster.external."
+	now := time.Unix(1523527445, 0)
+	old, cur := testSigner("2018-01", 1), testSigner("2018-04", 2)
+	p := &Payload{TTL: 30, Generation: 7, Sites: []EdgeSite{{IP: "172.16.7.102", Lat: 55.66, Lon: 12.61}}}
+
+	sign := func(s *Signer, at time.Time) []byte {
+		b, err := s.Sign(p, qname, at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	unsigned, err := Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The signature of p spliced onto another payload.
+	other, err := Marshal(&Payload{TTL: 3600, Generation: 7, Sites: p.Sites})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := append(other, sign(cur, now)[len(unsigned):]...)
+
+	both := KeySet{old.KeyID: old.public(), cur.KeyID: cur.public()}
+	rotated := KeySet{cur.KeyID: cur.public()}
+
+	tests := []struct {
+		name   string
+		b      []byte
+		qname  string
+		keys   KeySet
+		maxAge time.Duration
+		err    error
+	}{
+		{"valid", sign(cur, now), qname, rotated, time.Minute, nil},
+		{"qname case", sign(cur, now), strings.ToUpper(qname), rotated, time.Minute, nil},
+		{"unsigned", unsigned, qname, rotated, time.Minute, ErrUnsigned},
+		{"unknown key", sign(cur, now), qname, KeySet{old.KeyID: old.public()}, time.Minute, ErrUnknownKey},
+		{"key under another id", sign(cur, now), qname, KeySet{cur.KeyID: old.public()}, time.Minute, ErrBadSignature},
+		{"tampered field", tampered, qname, rotated, time.Minute, ErrBadSignature},
+		{"other qname", sign(cur, now), "redis.default.svc.cluster.external.", rotated, time.Minute, ErrBadSignature},
+		{"max age", sign(cur, now.Add(-time.Minute)), qname, rotated, time.Minute, nil},
+		{"too old", sign(cur, now.Add(-time.Minute-time.Second)), qname, rotated, time.Minute, ErrExpiredSignature},
+		{"too far in the future", sign(cur, now.Add(time.Minute+time.Second)), qname, rotated, time.Minute, ErrExpiredSignature},
+		{"no max age", sign(cur, now.Add(-24*time.Hour)), qname, rotated, 0, nil},
+		{"rotation old key", sign(old, now), qname, both, time.Minute, nil},
+		{"rotation new key", sign(cur, now), qname, both, time.Minute, nil},
+		{"rotated out", sign(old, now), qname, rotated, time.Minute, ErrUnknownKey},
+	}
+	for _, test := range tests {
+		got, err := Unmarshal(test.b)
+		if err != nil {
+			t.Errorf("%s: unmarshal: %s", test.name, err)
+			continue
+		}
+		if err := test.keys.Verify(got, test.qname, test.maxAge, now); err != test.err {
+			t.Errorf("%s: expected %v, got %v", test.name, test.err, err)
+		}
+	}
+}
+
+func TestSignInvalid(t *testing.T) {
+	s := testSigner("2018-04", 2)
+
+	b, err := s.Sign(&Payload{TTL: 30}, "nginx.default.svc.cluster.external.", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err = appendField(b, fieldTTL, uint32Bytes(3600))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Unmarshal(b); err != errFieldAfterSignature {
+		t.Errorf("expected %v for a field after the signature, got %v", errFieldAfterSignature, err)
+	}
+
+	// The most sites that fit in an EDNS0 option unsigned don't fit signed.
+	n := sort.Search(4000, func(n int) bool {
+		_, err := Marshal(&Payload{Sites: manySites(n)})
+		return err != nil
+	}) - 1
+	if _, err := s.Sign(&Payload{Sites: manySites(n)}, "nginx.default.svc.cluster.external.", time.Now()); err != errPayloadTooLarge {
+		t.Errorf("expected %v for %d signed sites, got %v", errPayloadTooLarge, n, err)
+	}
+}
+
+// keyFile writes lines to a temporary key file and returns its path.
+func keyFile(t *testing.T, lines ...string) string {
+	t.Helper()
+	f, err := ioutil.TempFile("", "optikon-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(strings.Join(lines, "\n") + "\n"); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func encode(b []byte) string { return base64.StdEncoding.EncodeToString(b) }
+
+func TestLoadSigner(t *testing.T) {
+	s := testSigner("2018-04", 2)
+
+	tests := []struct {
+		name string
+		line string
+		err  string
+	}{
+		{"seed", "2018-04 " + encode(s.Key.Seed()), ""},
+		{"private key", "2018-04 " + encode(s.Key), ""},
+		{"short key", "2018-04 " + encode(s.Key.Seed()[:16]), "not an ed25519 private key"},
+		{"no key", "2018-04", "want a key id and a key"},
+		{"not base64", "2018-04 ed25519!", "illegal base64 data"},
+	}
+	for _, test := range tests {
+		path := keyFile(t, "# Signing key", "", test.line)
+		got, err := LoadSigner(path)
+		os.Remove(path)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: expected an error containing %q, got %v", test.name, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if got.KeyID != s.KeyID || !bytes.Equal(got.Key, s.Key) {
+			t.Errorf("%s: expected key %s, got %s", test.name, s.KeyID, got.KeyID)
+		}
+	}
+
+	path := keyFile(t, "2018-01 "+encode(testSigner("2018-01", 1).Key.Seed()), "2018-04 "+encode(s.Key.Seed()))
+	defer os.Remove(path)
+	if _, err := LoadSigner(path); err == nil || !strings.Contains(err.Error(), "want exactly one key") {
+		t.Errorf("expected an error for two signing keys, got %v", err)
+	}
+}
+
+func TestLoadKeySet(t *testing.T) {
+	old, cur := testSigner("2018-01", 1), testSigner("2018-04", 2)
+	oldLine, curLine := "2018-01 "+encode(old.public()), "2018-04 "+encode(cur.public())
+
+	tests := []struct {
+		name  string
+		files [][]string
+		ids   []string
+		err   string
+	}{
+		{"one file", [][]string{{"# Central", oldLine, curLine}}, []string{"2018-01", "2018-04"}, ""},
+		{"two files", [][]string{{oldLine}, {curLine}}, []string{"2018-01", "2018-04"}, ""},
+		{"duplicate id", [][]string{{curLine, "2018-04 " + encode(old.public())}}, nil, "duplicate key id 2018-04"},
+		{"duplicate id across files", [][]string{{curLine}, {curLine}}, nil, "duplicate key id 2018-04"},
+		{"private key", [][]string{{"2018-04 " + encode(cur.Key)}}, nil, "not an ed25519 public key"},
+		{"short key", [][]string{{"2018-04 " + encode(cur.public()[:16])}}, nil, "not an ed25519 public key"},
+	}
+	for _, test := range tests {
+		var paths []string
+		for _, lines := range test.files {
+			paths = append(paths, keyFile(t, lines...))
+		}
+		ks, err := LoadKeySet(paths...)
+		for _, path := range paths {
+			os.Remove(path)
+		}
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: expected an error containing %q, got %v", test.name, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if len(ks) != len(test.ids) {
+			t.Errorf("%s: expected keys %v, got %d keys", test.name, test.ids, len(ks))
+		}
+		for _, id := range test.ids {
+			if _, found := ks[id]; !found {
+				t.Errorf("%s: expected key %s", test.name, id)
+			}
+		}
+	}
+}
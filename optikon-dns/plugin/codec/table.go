@@ -0,0 +1,95 @@
+package codec
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+
+	"github.com/ghodss/yaml"
+)
+
+// LoadTable reads a table of services, keyed by service name, from a JSON or
+// YAML file and validates it.
+func LoadTable(path string) (map[string]Service, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseTable(data)
+}
+
+// ParseTable parses a JSON or YAML encoded table of services, normalizes the
+// service names and validates every edge site.
+func ParseTable(data []byte) (map[string]Service, error) {
+	var raw map[string]Service
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	t := make(map[string]Service, len(raw))
+	for name, svc := range raw {
+		key := NormalizeService(name)
+		if key == "" {
+			return nil, ErrEmptyServiceName
+		}
+		if _, dup := t[key]; dup {
+			return nil, fmt.Errorf("duplicate service %q", key)
+		}
+		t[key] = svc
+	}
+	if err := Validate(t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Validate checks that every edge site in t has a usable IP, an IPv6 address
+// if it has one, coordinates that lie on the surface of the Earth and well
+// formed health checks and ports.
+func Validate(t map[string]Service) error {
+	for name, svc := range t {
+		for i, site := range svc.Sites {
+			if net.ParseIP(site.IP) == nil {
+				return fmt.Errorf("service %q: site %d: invalid ip %q", name, i, site.IP)
+			}
+			if site.IPv6 != "" {
+				if ip := net.ParseIP(site.IPv6); ip == nil || ip.To4() != nil {
+					return fmt.Errorf("service %q: site %d: invalid ipv6 %q", name, i, site.IPv6)
+				}
+			}
+			if site.Lat < -90 || site.Lat > 90 {
+				return fmt.Errorf("service %q: site %d: latitude out of range: %f", name, i, site.Lat)
+			}
+			if site.Lon < -180 || site.Lon > 180 {
+				return fmt.Errorf("service %q: site %d: longitude out of range: %f", name, i, site.Lon)
+			}
+			if hc := site.Check; hc != nil {
+				if hc.Proto != "tcp" && hc.Proto != "http" {
+					return fmt.Errorf("service %q: site %d: unknown check proto %q", name, i, hc.Proto)
+				}
+				if hc.Port == 0 {
+					return fmt.Errorf("service %q: site %d: check without port", name, i)
+				}
+			}
+			for _, p := range site.Ports {
+				if p.Name == "" || p.Port == 0 {
+					return fmt.Errorf("service %q: site %d: port without name or number", name, i)
+				}
+				if p.Proto != "tcp" && p.Proto != "udp" {
+					return fmt.Errorf("service %q: site %d: unknown port proto %q", name, i, p.Proto)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// NormalizeService lowercases a service name and strips the trailing dot, the
+// form used for table keys.
+func NormalizeService(name string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(name)), ".")
+}
+
+// ErrEmptyServiceName is returned for a service without a name.
+var ErrEmptyServiceName = errors.New("empty service name in table")
@@ -0,0 +1,84 @@
+package codec
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseTable(t *testing.T) {
+	data := `
+Echoserver.Default.:
+  - ip: 172.16.7.102
+    lat: 55.6761
+    lon: 12.5683
+nginx.default:
+  ttl: 20
+  sites:
+  - ip: 172.16.7.103
+    ipv6: "2001:db8::1"
+    lat: 40.7128
+    lon: -74.0060
+`
+	table, err := ParseTable([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(table) != 2 {
+		t.Fatalf("expected 2 services, got %d", len(table))
+	}
+	if svc := table["echoserver.default"]; len(svc.Sites) != 1 || svc.Sites[0].IP != "172.16.7.102" || svc.TTL != 0 {
+		t.Errorf("expected echoserver.default with 172.16.7.102 and no TTL, got %+v", svc)
+	}
+	if svc := table["nginx.default"]; len(svc.Sites) != 1 || svc.Sites[0].IPv6 != "2001:db8::1" || svc.TTL != 20 {
+		t.Errorf("expected nginx.default with 2001:db8::1 and TTL 20, got %+v", svc)
+	}
+
+	// JSON is YAML as well.
+	table, err = ParseTable([]byte(`{"echoserver.default": [{"ip": "172.16.7.102", "lat": 55.6761, "lon": 12.5683}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(table["echoserver.default"].Sites) != 1 {
+		t.Errorf("expected echoserver.default with a site, got %v", table)
+	}
+}
+
+func TestParseTableInvalid(t *testing.T) {
+	tests := []struct {
+		data string
+		err  string
+	}{
+		{`{"": []}`, ErrEmptyServiceName.Error()},
+		{`{"a.default": [], "A.default.": []}`, "duplicate service"},
+		{`{"a.default": [{"ip": "nowhere"}]}`, "invalid ip"},
+		{`{"a.default": [{"ip": "10.0.0.1", "ipv6": "10.0.0.2"}]}`, "invalid ipv6"},
+		{`{"a.default": [{"ip": "10.0.0.1", "lat": 91}]}`, "latitude out of range"},
+		{`{"a.default": [{"ip": "10.0.0.1", "lon": -181}]}`, "longitude out of range"},
+		{`{"a.default": [{"ip": "10.0.0.1", "weight": -1}]}`, "weight"},
+		{`{"a.default": [{"ip": "10.0.0.1", "check": {"proto": "udp", "port": 80}}]}`, "unknown check proto"},
+		{`{"a.default": [{"ip": "10.0.0.1", "check": {"proto": "tcp"}}]}`, "check without port"},
+		{`{"a.default": [{"ip": "10.0.0.1", "ports": [{"name": "http", "proto": "tcp"}]}]}`, "port without name or number"},
+		{`{"a.default": [{"ip": "10.0.0.1", "ports": [{"name": "http", "proto": "sctp", "port": 80}]}]}`, "unknown port proto"},
+		{`[`, ""},
+	}
+	for _, test := range tests {
+		_, err := ParseTable([]byte(test.data))
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: expected an error containing %q, got %v", test.data, test.err, err)
+		}
+	}
+}
+
+func TestNormalizeService(t *testing.T) {
+	tests := []struct{ name, want string }{
+		{"echoserver.default", "echoserver.default"},
+		{"Echoserver.Default.", "echoserver.default"},
+		{" echoserver.default. ", "echoserver.default"},
+		{".", ""},
+	}
+	for _, test := range tests {
+		if got := NormalizeService(test.name); got != test.want {
+			t.Errorf("%q: expected %q, got %q", test.name, test.want, got)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package codec
+
+import (
+	"encoding/json"
+
+	"github.com/miekg/dns"
+	ot "github.com/opentracing/opentracing-go"
+)
+
+// TraceOptionCode is the EDNS0 option code carrying the span context of the
+// edge to central, so both show up in a single trace. Like OptionCode it lies
+// in the range reserved for local/experimental use.
+const TraceOptionCode = 65302
+
+// InjectSpan adds the context of span as an EDNS0 option to the request m. An
+// OPT record is added to m if it doesn't have one.
+func InjectSpan(m *dns.Msg, span ot.Span) error {
+	carrier := ot.TextMapCarrier{}
+	if err := span.Tracer().Inject(span.Context(), ot.TextMap, carrier); err != nil {
+		return err
+	}
+	data, err := json.Marshal(carrier)
+	if err != nil {
+		return err
+	}
+
+	o := m.IsEdns0()
+	if o == nil {
+		m.SetEdns0(dns.DefaultMsgSize, false)
+		o = m.IsEdns0()
+	}
+	for i, opt := range o.Option {
+		if opt.Option() == TraceOptionCode {
+			o.Option = append(o.Option[:i], o.Option[i+1:]...)
+			break
+		}
+	}
+	o.Option = append(o.Option, &dns.EDNS0_LOCAL{Code: TraceOptionCode, Data: data})
+	return nil
+}
+
+// ExtractSpan returns the span context carried by the request m, as injected
+// by InjectSpan. ot.ErrSpanContextNotFound is returned if m carries none.
+func ExtractSpan(tracer ot.Tracer, m *dns.Msg) (ot.SpanContext, error) {
+	o := m.IsEdns0()
+	if o == nil {
+		return nil, ot.ErrSpanContextNotFound
+	}
+	for _, opt := range o.Option {
+		local, ok := opt.(*dns.EDNS0_LOCAL)
+		if !ok || local.Code != TraceOptionCode {
+			continue
+		}
+		carrier := ot.TextMapCarrier{}
+		if err := json.Unmarshal(local.Data, &carrier); err != nil {
+			return nil, ot.ErrSpanContextCorrupted
+		}
+		return tracer.Extract(ot.TextMap, carrier)
+	}
+	return nil, ot.ErrSpanContextNotFound
+}
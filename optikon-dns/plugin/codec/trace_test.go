@@ -0,0 +1,71 @@
+package codec
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	ot "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+)
+
+func TestInjectSpan(t *testing.T) {
+	tracer := mocktracer.New()
+	span := tracer.StartSpan("connect").(*mocktracer.MockSpan)
+	m := new(dns.Msg)
+	m.SetQuestion("nginx.default.svc.cluster.external.", dns.TypeA)
+
+	if _, err := ExtractSpan(tracer, m); err != ot.ErrSpanContextNotFound {
+		t.Fatalf("expected no span context, got %v", err)
+	}
+
+	// Injecting twice, as a retried exchange does, keeps a single option.
+	for i := 0; i < 2; i++ {
+		if err := InjectSpan(m, span); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n := 0
+	for _, opt := range m.IsEdns0().Option {
+		if opt.Option() == TraceOptionCode {
+			n++
+		}
+	}
+	if n != 1 {
+		t.Errorf("expected a single trace option, got %d", n)
+	}
+
+	// The option survives the wire.
+	buf, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := new(dns.Msg)
+	if err := r.Unpack(buf); err != nil {
+		t.Fatal(err)
+	}
+	sc, err := ExtractSpan(tracer, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := sc.(mocktracer.MockSpanContext)
+	if got.TraceID != span.SpanContext.TraceID || got.SpanID != span.SpanContext.SpanID {
+		t.Errorf("expected trace %d span %d, got trace %d span %d", span.SpanContext.TraceID, span.SpanContext.SpanID, got.TraceID, got.SpanID)
+	}
+
+	// A child started from it belongs to the same trace.
+	child := tracer.StartSpan("optikon-central", ot.ChildOf(sc)).(*mocktracer.MockSpan)
+	if child.ParentID != span.SpanContext.SpanID || child.SpanContext.TraceID != span.SpanContext.TraceID {
+		t.Errorf("expected a child of span %d, got parent %d", span.SpanContext.SpanID, child.ParentID)
+	}
+}
+
+func TestExtractSpanCorrupted(t *testing.T) {
+	m := new(dns.Msg)
+	m.SetQuestion("nginx.default.svc.cluster.external.", dns.TypeA)
+	m.SetEdns0(dns.DefaultMsgSize, false)
+	o := m.IsEdns0()
+	o.Option = append(o.Option, &dns.EDNS0_LOCAL{Code: TraceOptionCode, Data: []byte("{")})
+	if _, err := ExtractSpan(mocktracer.New(), m); err != ot.ErrSpanContextCorrupted {
+		t.Errorf("expected a corrupted span context, got %v", err)
+	}
+}
@@ -0,0 +1,396 @@
+package edge
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/coredns/coredns/request"
+	"wwwin-github.cisco.com/edge/optikon-dns/plugin/codec"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+)
+
+// admin is the HTTP debug interface of optikon-edge. It reports the state of
+// the edge and explains how queries are answered.
+type admin struct {
+	addr string
+
+	ln  net.Listener
+	mux *http.ServeMux
+}
+
+// startAdmin starts serving the admin endpoint.
+func (oe *OptikonEdge) startAdmin() error {
+	ln, err := net.Listen("tcp", oe.admin.addr)
+	if err != nil {
+		return err
+	}
+	oe.admin.ln = ln
+	oe.admin.mux = http.NewServeMux()
+	oe.admin.mux.HandleFunc("/v1/state", oe.serveState)
+	oe.admin.mux.HandleFunc("/v1/cache", oe.serveCache)
+	oe.admin.mux.HandleFunc("/v1/explain", oe.serveExplain)
+
+	go func() {
+		http.Serve(oe.admin.ln, oe.admin.mux)
+	}()
+	return nil
+}
+
+// stopAdmin closes the listener of the admin endpoint.
+func (oe *OptikonEdge) stopAdmin() error {
+	if oe.admin.ln != nil {
+		return oe.admin.ln.Close()
+	}
+	return nil
+}
+
+// edgeState is the body of GET /v1/state.
+type edgeState struct {
+	Lon       float64        `json:"lon"`
+	Lat       float64        `json:"lat"`
+	Self      string         `json:"self,omitempty"`
+	From      string         `json:"from"`
+	Selection string         `json:"selection"`
+	Proxies   []proxyState   `json:"proxies"`
+	Replica   *replicaStatus `json:"replica,omitempty"`
+}
+
+// proxyState is an upstream proxy as reported by GET /v1/state.
+type proxyState struct {
+	Addr  string `json:"addr"`
+	Fails uint32 `json:"fails"`
+	Down  bool   `json:"down"`
+	Conns *int   `json:"conns,omitempty"` // Pooled connections, not known for https upstreams.
+}
+
+// replicaStatus is the table stream as reported by GET /v1/state.
+type replicaStatus struct {
+	Addr       string `json:"addr"`
+	Live       bool   `json:"live"`
+	Generation uint64 `json:"generation"`
+	Services   int    `json:"services"`
+}
+
+// serveState handles GET /v1/state.
+func (oe *OptikonEdge) serveState(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	st := edgeState{Lon: oe.lon, Lat: oe.lat, From: oe.from, Selection: oe.selector.String()}
+	if oe.self != nil {
+		st.Self = oe.self.String()
+	}
+	for _, p := range oe.proxies {
+		ps := proxyState{Addr: p.addr, Fails: atomic.LoadUint32(&p.fails), Down: p.Down(oe.maxfails)}
+		if p.doh == nil {
+			conns := p.transport.Len()
+			ps.Conns = &conns
+		}
+		st.Proxies = append(st.Proxies, ps)
+	}
+	if oe.replica != nil {
+		st.Replica = oe.replica.status()
+	}
+	oe.writeJSON(w, st)
+}
+
+// cachedService is a cache entry as reported by GET /v1/cache.
+type cachedService struct {
+	Negative   bool             `json:"negative,omitempty"`
+	Sites      []codec.EdgeSite `json:"sites,omitempty"`
+	Generation uint64           `json:"generation,omitempty"`
+	Expires    time.Time        `json:"expires"`
+	Expired    bool             `json:"expired,omitempty"`
+}
+
+// serveCache handles GET /v1/cache, the cached edge sites by service.
+func (oe *OptikonEdge) serveCache(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	cached := make(map[string]cachedService)
+	if oe.cache != nil {
+		now := time.Now()
+		for name, e := range oe.cache.snapshot() {
+			cs := cachedService{Negative: e.negative, Expires: e.expires, Expired: now.After(e.expires)}
+			if e.payload != nil {
+				cs.Sites, cs.Generation = e.payload.Sites, e.payload.Generation
+			}
+			cached[name] = cs
+		}
+	}
+	oe.writeJSON(w, cached)
+}
+
+// explanation is the body of GET /v1/explain.
+type explanation struct {
+	Name       string      `json:"name"`
+	Service    string      `json:"service"`
+	Type       string      `json:"type"`
+	Source     string      `json:"source"` // Where the edge sites came from.
+	Origin     Query       `json:"origin"`
+	Selection  string      `json:"selection"`
+	Candidates []candidate `json:"candidates"`
+	Chosen     []string    `json:"chosen"`
+	Reason     string      `json:"reason"`
+}
+
+// candidate is an edge site considered by the selection.
+type candidate struct {
+	IP         string   `json:"ip"`
+	Lat        float64  `json:"lat"`
+	Lon        float64  `json:"lon"`
+	Weight     uint32   `json:"weight,omitempty"`
+	Distance   float64  `json:"distance_km"`
+	RTT        *float64 `json:"rtt_ms,omitempty"` // Only with probe.
+	HasAddress bool     `json:"has_address"`      // Has an address of the queried type.
+	Up         bool     `json:"up"`               // Passes the site health checks.
+	Chosen     bool     `json:"chosen"`
+}
+
+// serveExplain handles GET /v1/explain?name=NAME[&type=A|AAAA][&client=IP].
+// It looks up the edge sites of the service the way queries do, runs the
+// selection for a client at IP, or at this edge without one, and explains the
+// outcome. Random strategies are only sampled once.
+func (oe *OptikonEdge) serveExplain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	name := dns.Fqdn(strings.ToLower(r.URL.Query().Get("name")))
+	if name == "." {
+		http.Error(w, "missing name", http.StatusBadRequest)
+		return
+	}
+	qtype := dns.TypeA
+	if t := r.URL.Query().Get("type"); t != "" {
+		var ok bool
+		if qtype, ok = dns.StringToType[strings.ToUpper(t)]; !ok || (qtype != dns.TypeA && qtype != dns.TypeAAAA) {
+			http.Error(w, fmt.Sprintf("type must be A or AAAA: %s", t), http.StatusBadRequest)
+			return
+		}
+	}
+	var client net.IP
+	if c := r.URL.Query().Get("client"); c != "" {
+		if client = net.ParseIP(c); client == nil {
+			http.Error(w, fmt.Sprintf("invalid client address: %s", c), http.StatusBadRequest)
+			return
+		}
+	}
+
+	ex := explanation{
+		Name:      name,
+		Service:   codec.ParseName(name).Service,
+		Type:      dns.TypeToString[qtype],
+		Origin:    oe.explainOrigin(name, client),
+		Selection: oe.selector.String(),
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	state := request.Request{W: &adminWriter{client: client}, Req: m}
+	payload, source, err := oe.lookupSites(r.Context(), state, ex.Service)
+	ex.Source = source
+	if err != nil {
+		ex.Reason = fmt.Sprintf("central can't be reached: %s", err)
+		oe.writeJSON(w, ex)
+		return
+	}
+	if payload == nil || len(payload.Sites) == 0 {
+		ex.Reason = "central doesn't serve the service, queries go to the next plugin"
+		oe.writeJSON(w, ex)
+		return
+	}
+
+	eligible := oe.up(withAddress(payload.Sites, qtype))
+	var chosen []codec.EdgeSite
+	if len(eligible) > 0 {
+		chosen, ex.Reason = oe.explainChoice(ex.Origin, eligible)
+	} else {
+		ex.Reason = fmt.Sprintf("no site with an %s address is up, the answer is NODATA", ex.Type)
+	}
+
+	for _, es := range payload.Sites {
+		c := candidate{
+			IP:         es.IP,
+			Lat:        es.Lat,
+			Lon:        es.Lon,
+			Weight:     es.Weight,
+			Distance:   Distance(ex.Origin.Lat, ex.Origin.Lon, es.Lat, es.Lon),
+			HasAddress: len(withAddress([]codec.EdgeSite{es}, qtype)) > 0,
+			Up:         oe.health == nil || !oe.health.Down(es),
+			Chosen:     containsSite(chosen, es),
+		}
+		if oe.prober != nil {
+			if rtt, ok := oe.prober.RTT(es.IP); ok {
+				ms := rtt.Seconds() * 1000
+				c.RTT = &ms
+			}
+		}
+		ex.Candidates = append(ex.Candidates, c)
+	}
+	for _, es := range chosen {
+		ex.Chosen = append(ex.Chosen, es.IP)
+	}
+	oe.writeJSON(w, ex)
+}
+
+// explainOrigin returns the origin of a query for name from client, located
+// as its ECS option would be.
+func (oe *OptikonEdge) explainOrigin(name string, client net.IP) Query {
+	q := Query{Name: name, Lat: oe.lat, Lon: oe.lon, Client: client}
+	if oe.geo == nil || client == nil {
+		return q
+	}
+	if lat, lon, _, ok := oe.geo.Locate(client); ok {
+		q.Lat, q.Lon, q.Subnet = lat, lon, true
+	}
+	return q
+}
+
+// lookupSites returns the edge sites of service the way ServeDNS finds them,
+// without touching the cache or the metrics, and where they came from.
+func (oe *OptikonEdge) lookupSites(ctx context.Context, state request.Request, service string) (*codec.Payload, string, error) {
+	if oe.replica != nil {
+		if payload, live := oe.replica.lookup(service); live {
+			return payload, "replica", nil
+		}
+	}
+	now := time.Now()
+	if oe.cache != nil {
+		if e, found := oe.cache.get(service, now); found {
+			return e.payload, "cache", nil
+		}
+	}
+	payload, err := oe.ask(ctx, state)
+	if err == nil {
+		return payload, "central", nil
+	}
+	if oe.cache != nil {
+		if e, found := oe.cache.stale(service, now); found {
+			return e.payload, "stale", nil
+		}
+	}
+	if svc, found := oe.fallback[service]; found && len(svc.Sites) > 0 {
+		return &codec.Payload{Sites: svc.Sites}, "fallback", nil
+	}
+	return nil, "central", err
+}
+
+// ask asks the first healthy upstream for the edge sites of the name in state
+// like resolve does, but without recording metrics, traces or failures of the
+// upstream. A nil payload is returned if central doesn't serve the name.
+func (oe *OptikonEdge) ask(ctx context.Context, state request.Request) (*codec.Payload, error) {
+	req := state.Req.Copy()
+	codec.Request(req)
+	upstream := request.Request{W: state.W, Req: req}
+
+	err := errNoHealthy
+	for _, proxy := range oe.list() {
+		if proxy.Down(oe.maxfails) {
+			continue
+		}
+		var ret *dns.Msg
+		ret, err = truncated(proxy.connect(ctx, upstream, oe.forceTCP, false))
+		if err != nil {
+			continue
+		}
+		payload, err := payloadOf(state, ret)
+		if payload == nil || err != nil {
+			return nil, err
+		}
+		if oe.keys != nil {
+			if err := oe.keys.Verify(payload, state.Name(), oe.maxAge, time.Now()); err != nil {
+				return nil, err
+			}
+		}
+		return payload, nil
+	}
+	return nil, err
+}
+
+// explainChoice runs the selection like choose, without updating metrics or
+// the prober, and says why the chosen sites won.
+func (oe *OptikonEdge) explainChoice(q Query, sites []codec.EdgeSite) ([]codec.EdgeSite, string) {
+	if oe.self != nil && !q.Subnet {
+		for _, es := range sites {
+			if hasAddress(es, oe.self) {
+				return []codec.EdgeSite{es}, "this edge site runs the service itself (self)"
+			}
+		}
+	}
+	chosen := oe.selector.Select(q, sites)
+	return chosen, explainSelection(oe.selector, q, sites, chosen)
+}
+
+// explainSelection says why selector picked chosen out of sites for q.
+func explainSelection(selector SiteSelector, q Query, sites, chosen []codec.EdgeSite) string {
+	first := chosen[0]
+	dist := Distance(q.Lat, q.Lon, first.Lat, first.Lon)
+	closest := fmt.Sprintf("%s is the closest site to the origin, %.0f km away", first.IP, dist)
+
+	switch s := selector.(type) {
+	case *nearest:
+		return closest
+	case *weightedRandom:
+		return fmt.Sprintf("%s was drawn at random out of %d sites weighted by the inverse of their distance, it is %.0f km away", first.IP, len(sites), dist)
+	case *topN:
+		return fmt.Sprintf("the %d sites closest to the origin, best first", len(chosen))
+	case *capacity:
+		for _, es := range sites {
+			if es.Weight != 0 {
+				return fmt.Sprintf("%s was drawn at random out of %d sites weighted by their capacity, it has weight %d", first.IP, len(sites), first.Weight)
+			}
+		}
+		return "no site has a weight, " + closest
+	case *consistentHash:
+		if q.Client == nil {
+			return "no client address, " + closest
+		}
+		return fmt.Sprintf("%s has the highest rendezvous hash for client subnet %s", first.IP, clientSubnet(q.Client))
+	case *latency:
+		if rtt, ok := s.p.RTT(first.IP); ok {
+			return fmt.Sprintf("%s has the lowest round trip time, %s, sites within %s are ordered by distance", first.IP, rtt, latencyTolerance)
+		}
+		return "no site has been probed yet, " + closest
+	}
+	return fmt.Sprintf("picked by %s", selector)
+}
+
+// adminWriter is the dns.ResponseWriter of the queries the admin endpoint
+// sends to central on behalf of a client. Nothing is written to it.
+type adminWriter struct {
+	client net.IP
+}
+
+func (w *adminWriter) LocalAddr() net.Addr { return &net.UDPAddr{IP: net.IPv4zero, Port: 53} }
+func (w *adminWriter) RemoteAddr() net.Addr {
+	if w.client == nil {
+		return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	}
+	return &net.UDPAddr{IP: w.client}
+}
+func (w *adminWriter) WriteMsg(*dns.Msg) error     { return nil }
+func (w *adminWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *adminWriter) Close() error                { return nil }
+func (w *adminWriter) TsigStatus() error           { return nil }
+func (w *adminWriter) TsigTimersOnly(bool)         {}
+func (w *adminWriter) Hijack()                     {}
+
+func (oe *OptikonEdge) writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		oe.log.Errorf("writing admin response: %s", err)
+	}
+}
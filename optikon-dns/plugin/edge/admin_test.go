@@ -0,0 +1,215 @@
+package edge
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/mholt/caddy"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"wwwin-github.cisco.com/edge/optikon-dns/plugin/codec"
+)
+
+// adminEdge returns an edge in Malmö with a cache, asking a central that
+// serves nginx from Copenhagen and Tokyo. Stop the returned server and proxy.
+func adminEdge(t *testing.T) (*OptikonEdge, *dnstest.Server) {
+	t.Helper()
+	srv := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		if !strings.HasPrefix(r.Question[0].Name, "nginx.") {
+			ret.SetRcode(r, dns.RcodeNameError)
+			w.WriteMsg(ret)
+			return
+		}
+		ret.SetReply(r)
+		ret.SetEdns0(dns.DefaultMsgSize, false)
+		codec.SetOption(ret, &codec.Payload{TTL: 60, Generation: 3, Sites: []codec.EdgeSite{
+			{IP: "10.0.0.1", Lat: 55.6761, Lon: 12.5683},
+			{IP: "10.0.0.2", Lat: 35.6762, Lon: 139.6503},
+		}})
+		w.WriteMsg(ret)
+	})
+
+	oe := New()
+	oe.lat, oe.lon = 55.6050, 13.0038
+	oe.from = "cluster.external."
+	oe.cache = newSiteCache()
+	oe.proxies = append(oe.proxies, NewProxy(srv.Addr, nil))
+	return oe, srv
+}
+
+// get serves GET target with handler and decodes the JSON body into v.
+func get(t *testing.T, handler http.HandlerFunc, target string, v interface{}) int {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodGet, target, nil))
+	if w.Code == http.StatusOK {
+		if err := json.NewDecoder(w.Body).Decode(v); err != nil {
+			t.Fatalf("%s: %s", target, err)
+		}
+	}
+	return w.Code
+}
+
+// gatherMetrics returns the current values of the metrics of the plugin, but
+// SocketGauge: it follows the connection pool, which the admin endpoint shares
+// with the queries.
+func gatherMetrics(t *testing.T) string {
+	t.Helper()
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(RequestCount, RcodeCount, RequestDuration, HealthcheckFailureCount,
+		HealthcheckBrokenCount,
+		LocalityCount, ProbeRTTGauge, ProbeFailureCount, SiteHealthFailureCount, SiteHealthFailOpenCount,
+		ClientSubnetCount, CacheHitCount, CacheMissCount, CachePrefetchCount, CacheSize, StaleGenerationCount,
+		StreamConnected, ReplicaSize, SignatureFailureCount, DegradedCount,
+		SelectionCount, SelectionDistance, TableParseFailureCount, NextCount)
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s []string
+	for _, mf := range mfs {
+		s = append(s, mf.String())
+	}
+	return strings.Join(s, "\n")
+}
+
+func TestAdminState(t *testing.T) {
+	oe, srv := adminEdge(t)
+	defer srv.Close()
+	defer oe.proxies[0].transport.Stop()
+
+	var st edgeState
+	if code := get(t, oe.serveState, "/v1/state", &st); code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", code)
+	}
+	if st.Lat != oe.lat || st.Lon != oe.lon || st.From != oe.from || st.Selection != "nearest" {
+		t.Errorf("expected the location, zone and selection of the edge, got %+v", st)
+	}
+	if len(st.Proxies) != 1 || st.Proxies[0].Addr != srv.Addr || st.Proxies[0].Down || st.Proxies[0].Conns == nil {
+		t.Errorf("expected the upstream %s up with its connections, got %+v", srv.Addr, st.Proxies)
+	}
+	if st.Replica != nil {
+		t.Errorf("expected no replica without a table stream, got %+v", st.Replica)
+	}
+
+	w := httptest.NewRecorder()
+	oe.serveState(w, httptest.NewRequest(http.MethodPost, "/v1/state", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected status 405 for POST, got %d", w.Code)
+	}
+}
+
+func TestAdminCache(t *testing.T) {
+	oe, srv := adminEdge(t)
+	defer srv.Close()
+	defer oe.proxies[0].transport.Stop()
+
+	now := time.Now()
+	oe.cache.set("nginx.default.svc.cluster.external.", &codec.Payload{TTL: 60, Generation: 3, Sites: []codec.EdgeSite{{IP: "10.0.0.1"}}}, now)
+	oe.cache.setNegative("redis.default.svc.cluster.external.", now)
+
+	var cached map[string]cachedService
+	if code := get(t, oe.serveCache, "/v1/cache", &cached); code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", code)
+	}
+	if len(cached) != 2 {
+		t.Fatalf("expected 2 cached services, got %v", cached)
+	}
+	nginx := cached["nginx.default.svc.cluster.external."]
+	if nginx.Negative || nginx.Generation != 3 || len(nginx.Sites) != 1 || nginx.Sites[0].IP != "10.0.0.1" || nginx.Expired {
+		t.Errorf("expected the edge sites of nginx at generation 3, got %+v", nginx)
+	}
+	if redis := cached["redis.default.svc.cluster.external."]; !redis.Negative || len(redis.Sites) != 0 {
+		t.Errorf("expected a negative entry for redis, got %+v", redis)
+	}
+}
+
+func TestAdminExplain(t *testing.T) {
+	oe, srv := adminEdge(t)
+	defer srv.Close()
+	defer oe.proxies[0].transport.Stop()
+
+	tests := []struct {
+		target string
+		source string
+		chosen []string
+		reason string
+	}{
+		{"/v1/explain?name=nginx.default.svc.cluster.external", "central", []string{"10.0.0.1"}, "closest site to the origin"},
+		{"/v1/explain?name=nginx.default.svc.cluster.external.&type=aaaa", "central", nil, "no site with an AAAA address is up"},
+		{"/v1/explain?name=redis.default.svc.cluster.external.", "central", nil, "central doesn't serve the service"},
+	}
+	before := gatherMetrics(t)
+	for _, tc := range tests {
+		var ex explanation
+		if code := get(t, oe.serveExplain, tc.target, &ex); code != http.StatusOK {
+			t.Errorf("%s: expected status 200, got %d", tc.target, code)
+			continue
+		}
+		if ex.Source != tc.source {
+			t.Errorf("%s: expected source %s, got %s", tc.target, tc.source, ex.Source)
+		}
+		if strings.Join(ex.Chosen, ",") != strings.Join(tc.chosen, ",") {
+			t.Errorf("%s: expected chosen %v, got %v", tc.target, tc.chosen, ex.Chosen)
+		}
+		if !strings.Contains(ex.Reason, tc.reason) {
+			t.Errorf("%s: expected a reason containing %q, got %q", tc.target, tc.reason, ex.Reason)
+		}
+	}
+	if after := gatherMetrics(t); after != before {
+		t.Errorf("expected explain to leave the metrics alone, got\n%s\ninstead of\n%s", after, before)
+	}
+	if n := oe.cache.Len(); n != 0 {
+		t.Errorf("expected explain to leave the cache alone, got %d entries", n)
+	}
+
+	// Cached edge sites are explained without asking central.
+	service := codec.ParseName("nginx.default.svc.cluster.external.").Service
+	oe.cache.set(service, &codec.Payload{TTL: 60, Sites: []codec.EdgeSite{{IP: "10.0.0.3", Lat: 35.6762, Lon: 139.6503}}}, time.Now())
+	var ex explanation
+	get(t, oe.serveExplain, "/v1/explain?name=nginx.default.svc.cluster.external.", &ex)
+	if ex.Source != "cache" || len(ex.Candidates) != 1 || !ex.Candidates[0].Chosen {
+		t.Errorf("expected the cached site chosen, got %+v", ex)
+	}
+
+	for _, target := range []string{"/v1/explain", "/v1/explain?name=nginx.default.svc.cluster.external.&type=TXT", "/v1/explain?name=nginx.default.svc.cluster.external.&client=nowhere"} {
+		w := httptest.NewRecorder()
+		oe.serveExplain(w, httptest.NewRequest(http.MethodGet, target, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", target, w.Code)
+		}
+	}
+}
+
+func TestAdminAddress(t *testing.T) {
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{":8092", "localhost:8092"}, // Without a host, loopback only.
+		{"localhost:8092", "localhost:8092"},
+		{"0.0.0.0:8092", "0.0.0.0:8092"},
+		{"[::1]:8092", "[::1]:8092"},
+	}
+	for _, tc := range tests {
+		c := caddy.NewTestController("dns", "optikon-edge 13.0038 55.6050 cluster.external. 127.0.0.1:53 {\nadmin "+tc.addr+"\n}")
+		oe, err := parseOptikonEdge(c)
+		if err != nil {
+			t.Errorf("%s: %s", tc.addr, err)
+			continue
+		}
+		for _, p := range oe.proxies {
+			p.transport.Stop()
+		}
+		if oe.admin == nil || oe.admin.addr != tc.want {
+			t.Errorf("%s: expected the endpoint on %s, got %+v", tc.addr, tc.want, oe.admin)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package edge
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"wwwin-github.cisco.com/edge/optikon-dns/plugin/codec"
+)
+
+// siteCache caches the edge sites central returned per service.
+type siteCache struct {
+	sync.RWMutex
+	entries map[string]*cacheEntry
+
+	capacity int
+	negTTL   time.Duration // How long "not an optikon service" answers are cached.
+	prefetch float64       // Refresh entries with less than this fraction of their TTL left.
+	maxStale time.Duration // Serve expired entries for this long when central is down.
+}
+
+// cacheEntry holds what central returned for a single service. A negative
+// entry records that central doesn't know the name.
+type cacheEntry struct {
+	payload  *codec.Payload
+	negative bool
+
+	stored  time.Time
+	expires time.Time
+
+	prefetching int32
+}
+
+func newSiteCache() *siteCache {
+	return &siteCache{
+		entries:  make(map[string]*cacheEntry),
+		capacity: defaultCacheCapacity,
+		negTTL:   defaultNegativeTTL,
+	}
+}
+
+// get returns the entry for name if it hasn't expired. The returned entry must
+// not be modified.
+func (c *siteCache) get(name string, now time.Time) (*cacheEntry, bool) {
+	c.RLock()
+	e, found := c.entries[name]
+	c.RUnlock()
+	if !found || !now.Before(e.expires) {
+		return nil, false
+	}
+	return e, true
+}
+
+// stale returns the entry for name if it expired no longer than maxStale ago.
+// Negative entries are never served stale.
+func (c *siteCache) stale(name string, now time.Time) (*cacheEntry, bool) {
+	if c.maxStale == 0 {
+		return nil, false
+	}
+	c.RLock()
+	e, found := c.entries[name]
+	c.RUnlock()
+	if !found || e.negative || now.After(e.expires.Add(c.maxStale)) {
+		return nil, false
+	}
+	return e, true
+}
+
+// set caches p for name for the TTL central set on it and returns the entry to
+// answer with. Nothing is cached for a zero TTL. If the cached payload is from
+// a newer table generation and hasn't expired, a central that is behind
+// answered; the cached entry is kept as it is, with its own expiry, and
+// returned instead.
+func (c *siteCache) set(name string, p *codec.Payload, now time.Time) *cacheEntry {
+	c.RLock()
+	e, found := c.entries[name]
+	c.RUnlock()
+	if found && !e.negative && e.payload.Generation > p.Generation && now.Before(e.expires) {
+		StaleGenerationCount.Add(1)
+		return e
+	}
+
+	e = &cacheEntry{payload: p, stored: now, expires: now.Add(time.Duration(p.TTL) * time.Second)}
+	if p.TTL > 0 {
+		c.add(name, e)
+	}
+	return e
+}
+
+// setNegative records that central doesn't serve name.
+func (c *siteCache) setNegative(name string, now time.Time) {
+	if c.negTTL <= 0 {
+		return
+	}
+	c.add(name, &cacheEntry{negative: true, stored: now, expires: now.Add(c.negTTL)})
+}
+
+func (c *siteCache) add(name string, e *cacheEntry) {
+	c.Lock()
+	defer c.Unlock()
+
+	if _, found := c.entries[name]; !found && len(c.entries) >= c.capacity {
+		// Evict a random entry, map iteration order is random enough.
+		for k := range c.entries {
+			delete(c.entries, k)
+			break
+		}
+	}
+	c.entries[name] = e
+	CacheSize.Set(float64(len(c.entries)))
+}
+
+// shouldPrefetch reports whether e is close enough to expiry to be refreshed
+// in the background. It returns true at most once per entry.
+func (c *siteCache) shouldPrefetch(e *cacheEntry, now time.Time) bool {
+	if c.prefetch == 0 || e.negative {
+		return false
+	}
+	ttl := e.expires.Sub(e.stored)
+	if float64(e.expires.Sub(now)) > c.prefetch*float64(ttl) {
+		return false
+	}
+	return atomic.CompareAndSwapInt32(&e.prefetching, 0, 1)
+}
+
+// snapshot returns the entries by name. The entries must not be modified.
+func (c *siteCache) snapshot() map[string]*cacheEntry {
+	c.RLock()
+	defer c.RUnlock()
+	entries := make(map[string]*cacheEntry, len(c.entries))
+	for name, e := range c.entries {
+		entries[name] = e
+	}
+	return entries
+}
+
+// Len returns the number of cached names.
+func (c *siteCache) Len() int {
+	c.RLock()
+	defer c.RUnlock()
+	return len(c.entries)
+}
+
+const (
+	defaultCacheCapacity = 10000
+	defaultNegativeTTL   = 30 * time.Second
+	defaultPrefetch      = 0.1
+	defaultMaxStale      = time.Hour
+)
@@ -0,0 +1,119 @@
+package edge
+
+import (
+	"testing"
+	"time"
+
+	"wwwin-github.cisco.com/edge/optikon-dns/plugin/codec"
+)
+
+const cachedService = "nginx.default.svc.cluster.external"
+
+func TestCacheSet(t *testing.T) {
+	c := newSiteCache()
+	now := time.Now()
+
+	p := &codec.Payload{TTL: 30, Sites: []codec.EdgeSite{copenhagen}}
+	e := c.set(cachedService, p, now)
+	if e.payload != p || !e.expires.Equal(now.Add(30*time.Second)) {
+		t.Errorf("expected p cached for 30s, got %+v", e)
+	}
+	if got, found := c.get(cachedService, now.Add(29*time.Second)); !found || got != e {
+		t.Errorf("expected the entry before it expires")
+	}
+	if _, found := c.get(cachedService, now.Add(30*time.Second)); found {
+		t.Errorf("expected no entry once it expired")
+	}
+
+	// Nothing is cached for a zero TTL, p is still answered with.
+	c = newSiteCache()
+	zero := &codec.Payload{Sites: []codec.EdgeSite{copenhagen}}
+	if e := c.set(cachedService, zero, now); e.payload != zero {
+		t.Errorf("expected to answer with the payload without a TTL")
+	}
+	if c.Len() != 0 {
+		t.Errorf("expected nothing cached for a zero TTL")
+	}
+}
+
+func TestCacheGeneration(t *testing.T) {
+	c := newSiteCache()
+	now := time.Now()
+
+	newer := &codec.Payload{TTL: 30, Generation: 5, Sites: []codec.EdgeSite{tokyo}}
+	kept := c.set(cachedService, newer, now)
+
+	// A central that is behind answers: the newer entry is kept, and its
+	// expiry is not extended.
+	older := &codec.Payload{TTL: 30, Generation: 3, Sites: []codec.EdgeSite{copenhagen}}
+	e := c.set(cachedService, older, now.Add(20*time.Second))
+	if e != kept {
+		t.Fatalf("expected the entry of generation 5 to be kept, got generation %d", e.payload.Generation)
+	}
+	if !e.expires.Equal(now.Add(30 * time.Second)) {
+		t.Errorf("expected the kept entry to expire at its own time, got %s later", e.expires.Sub(now))
+	}
+
+	// Once it expired, the older generation is taken.
+	e = c.set(cachedService, older, now.Add(31*time.Second))
+	if e.payload != older {
+		t.Errorf("expected generation 3 after the entry of generation 5 expired, got %d", e.payload.Generation)
+	}
+
+	// A newer generation always replaces the entry.
+	e = c.set(cachedService, newer, now.Add(32*time.Second))
+	if e.payload != newer {
+		t.Errorf("expected generation 5 to replace generation 3, got %d", e.payload.Generation)
+	}
+}
+
+func TestCacheNegative(t *testing.T) {
+	c := newSiteCache()
+	now := time.Now()
+
+	c.setNegative(cachedService, now)
+	e, found := c.get(cachedService, now)
+	if !found || !e.negative {
+		t.Fatalf("expected a negative entry")
+	}
+	if _, found := c.stale(cachedService, now.Add(c.negTTL+time.Second)); found {
+		t.Errorf("expected negative entries never to be served stale")
+	}
+
+	// Edge sites replace a negative entry.
+	p := &codec.Payload{TTL: 30, Sites: []codec.EdgeSite{copenhagen}}
+	if e := c.set(cachedService, p, now); e.payload != p {
+		t.Errorf("expected the edge sites to replace the negative entry")
+	}
+}
+
+func TestCacheStale(t *testing.T) {
+	c := newSiteCache()
+	c.maxStale = time.Minute
+	now := time.Now()
+
+	c.set(cachedService, &codec.Payload{TTL: 30, Sites: []codec.EdgeSite{copenhagen}}, now)
+	if _, found := c.stale(cachedService, now.Add(90*time.Second)); !found {
+		t.Errorf("expected the entry to be served stale within max stale")
+	}
+	if _, found := c.stale(cachedService, now.Add(91*time.Second)); found {
+		t.Errorf("expected no stale entry after max stale")
+	}
+}
+
+func TestCachePrefetch(t *testing.T) {
+	c := newSiteCache()
+	c.prefetch = defaultPrefetch
+	now := time.Now()
+
+	e := c.set(cachedService, &codec.Payload{TTL: 100, Sites: []codec.EdgeSite{copenhagen}}, now)
+	if c.shouldPrefetch(e, now.Add(80*time.Second)) {
+		t.Errorf("expected no prefetch with 20%% of the TTL left")
+	}
+	if !c.shouldPrefetch(e, now.Add(95*time.Second)) {
+		t.Errorf("expected a prefetch with 5%% of the TTL left")
+	}
+	if c.shouldPrefetch(e, now.Add(96*time.Second)) {
+		t.Errorf("expected a single prefetch per entry")
+	}
+}
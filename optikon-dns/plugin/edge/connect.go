@@ -13,6 +13,17 @@ import (
 func (p *Proxy) connect(ctx context.Context, state request.Request, forceTCP, metric bool) (*dns.Msg, error) {
 	start := time.Now()
 
+	if p.doh != nil {
+		ret, err := p.doh.exchange(ctx, state.Req)
+		if err != nil {
+			return nil, err
+		}
+		if metric {
+			p.observe(ret, start)
+		}
+		return ret, nil
+	}
+
 	proto := state.Proto()
 	if forceTCP {
 		proto = "tcp"
@@ -45,15 +56,20 @@ func (p *Proxy) connect(ctx context.Context, state request.Request, forceTCP, me
 	p.Yield(conn)
 
 	if metric {
-		rc, ok := dns.RcodeToString[ret.Rcode]
-		if !ok {
-			rc = strconv.Itoa(ret.Rcode)
-		}
-
-		RequestCount.WithLabelValues(p.addr).Add(1)
-		RcodeCount.WithLabelValues(rc, p.addr).Add(1)
-		RequestDuration.WithLabelValues(p.addr).Observe(time.Since(start).Seconds())
+		p.observe(ret, start)
 	}
 
 	return ret, nil
 }
+
+// observe records the metrics of the reply ret to a request sent at start.
+func (p *Proxy) observe(ret *dns.Msg, start time.Time) {
+	rc, ok := dns.RcodeToString[ret.Rcode]
+	if !ok {
+		rc = strconv.Itoa(ret.Rcode)
+	}
+
+	RequestCount.WithLabelValues(p.addr).Add(1)
+	RcodeCount.WithLabelValues(rc, p.addr).Add(1)
+	RequestDuration.WithLabelValues(p.addr).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,191 @@
+package edge
+
+import (
+	"encoding/json"
+	"io"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/request"
+	"wwwin-github.cisco.com/edge/optikon-dns/plugin/codec"
+	"wwwin-github.cisco.com/edge/optikon-dns/plugin/logging"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+)
+
+// decisionLog writes a JSON record for a sample of the queries, describing how
+// each was answered, so routing decisions can be audited offline.
+type decisionLog struct {
+	path   string  // File to append to, or "stdout".
+	sample float64 // Fraction of the queries logged.
+
+	sync.Mutex
+	w io.WriteCloser
+
+	log *logging.Logger
+}
+
+func newDecisionLog(path string, sample float64, log *logging.Logger) *decisionLog {
+	return &decisionLog{path: path, sample: sample, log: log}
+}
+
+// open opens the file records are written to.
+func (l *decisionLog) open() error {
+	if l.path == "stdout" {
+		l.w = nopCloser{os.Stdout}
+		return nil
+	}
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	l.w = f
+	return nil
+}
+
+// close closes the file records are written to.
+func (l *decisionLog) close() error {
+	l.Lock()
+	defer l.Unlock()
+	if l.w == nil {
+		return nil
+	}
+	err := l.w.Close()
+	l.w = nil
+	return err
+}
+
+// sampled reports whether the next query is to be logged.
+func (l *decisionLog) sampled() bool {
+	return l.sample >= 1 || rand.Float64() < l.sample
+}
+
+// write writes d as a single line.
+func (l *decisionLog) write(d *decision) {
+	data, err := json.Marshal(d)
+	if err != nil {
+		l.log.Errorf("encoding decision log record: %s", err)
+		return
+	}
+	l.Lock()
+	defer l.Unlock()
+	if l.w == nil {
+		return
+	}
+	if _, err := l.w.Write(append(data, '\n')); err != nil {
+		l.log.Errorf("writing decision log: %s", err)
+	}
+}
+
+// decision is the decision log record of a single query. All its methods may
+// be called on nil, for queries that aren't sampled.
+type decision struct {
+	Time     time.Time `json:"ts"`
+	Name     string    `json:"qname"`
+	Type     string    `json:"qtype"`
+	Client   string    `json:"client"`
+	Origin   *Query    `json:"origin,omitempty"`
+	Source   string    `json:"source"` // replica, cache, central, stale, fallback or next.
+	CacheHit bool      `json:"cache_hit"`
+	Upstream string    `json:"upstream,omitempty"` // Central that was asked.
+
+	Candidates []siteScore `json:"candidates,omitempty"`
+	Chosen     []siteScore `json:"chosen,omitempty"`
+	Answers    int         `json:"answers"`
+	Next       bool        `json:"next,omitempty"` // Passed to the next plugin.
+}
+
+// siteScore is an edge site in a decision log record.
+type siteScore struct {
+	IP       string   `json:"ip"`
+	Distance float64  `json:"distance_km"`
+	RTT      *float64 `json:"rtt_ms,omitempty"` // Only with probe.
+}
+
+func newDecision(state request.Request) *decision {
+	return &decision{
+		Time:   time.Now().UTC(),
+		Name:   state.Name(),
+		Type:   dns.TypeToString[state.QType()],
+		Client: state.IP(),
+	}
+}
+
+type decisionKey struct{}
+
+// withDecision returns ctx carrying d.
+func withDecision(ctx context.Context, d *decision) context.Context {
+	return context.WithValue(ctx, decisionKey{}, d)
+}
+
+// decisionFrom returns the decision carried by ctx, nil if the query isn't
+// logged.
+func decisionFrom(ctx context.Context) *decision {
+	d, _ := ctx.Value(decisionKey{}).(*decision)
+	return d
+}
+
+// answeredFrom records where the edge sites came from.
+func (d *decision) answeredFrom(source string) {
+	if d == nil {
+		return
+	}
+	d.Source = source
+	d.CacheHit = source == "cache" || source == "stale"
+}
+
+// askedUpstream records the central that answered.
+func (d *decision) askedUpstream(addr string) {
+	if d == nil {
+		return
+	}
+	d.Upstream = addr
+}
+
+// selected records the sites chosen out of candidates for q.
+func (d *decision) selected(p *prober, q Query, candidates, chosen []codec.EdgeSite) {
+	if d == nil {
+		return
+	}
+	d.Origin = &q
+	d.Candidates = scoreSites(p, q, candidates)
+	d.Chosen = scoreSites(p, q, chosen)
+}
+
+// passed records that the query was passed to the next plugin.
+func (d *decision) passed() {
+	if d == nil {
+		return
+	}
+	d.Next = true
+}
+
+// answered records the number of records in the answer.
+func (d *decision) answered(n int) {
+	if d == nil {
+		return
+	}
+	d.Answers = n
+}
+
+func scoreSites(p *prober, q Query, sites []codec.EdgeSite) []siteScore {
+	scores := make([]siteScore, len(sites))
+	for i, es := range sites {
+		scores[i] = siteScore{IP: es.IP, Distance: Distance(q.Lat, q.Lon, es.Lat, es.Lon)}
+		if p == nil {
+			continue
+		}
+		if rtt, ok := p.RTT(es.IP); ok {
+			ms := rtt.Seconds() * 1000
+			scores[i].RTT = &ms
+		}
+	}
+	return scores
+}
+
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
@@ -0,0 +1,104 @@
+package edge
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+	"golang.org/x/net/http2"
+)
+
+// dohTransport sends queries to an upstream over DNS over HTTPS (RFC 8484).
+// Connections are pooled by the HTTP/2 transport and closed after being idle
+// for the expire duration of the proxy.
+type dohTransport struct {
+	url    string
+	tr     *http.Transport
+	client *http.Client
+}
+
+func newDoHTransport(url string, tlsConfig *tls.Config, expire time.Duration) (*dohTransport, error) {
+	// http2.ConfigureTransport adds h2 to the protocols of the config, which
+	// is shared with tls:// upstreams.
+	if tlsConfig != nil {
+		tlsConfig = tlsConfig.Clone()
+	}
+	tr := &http.Transport{
+		DialContext:         (&net.Dialer{Timeout: dialTimeout}).DialContext,
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: dialTimeout,
+		MaxIdleConnsPerHost: dohMaxIdleConns,
+		IdleConnTimeout:     expire,
+	}
+	if err := http2.ConfigureTransport(tr); err != nil {
+		return nil, err
+	}
+	return &dohTransport{url: url, tr: tr, client: &http.Client{Transport: tr}}, nil
+}
+
+// exchange POSTs m to the upstream and returns its reply.
+func (d *dohTransport) exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	// The ID is 0 on the wire so replies can be cached by HTTP caches, m
+	// itself may be in use by concurrent exchanges.
+	id := m.Id
+	req := m.Copy()
+	req.Id = 0
+	buf, err := req.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequest(http.MethodPost, d.url, bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", dohMediaType)
+	httpReq.Header.Set("Accept", dohMediaType)
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	resp, err := d.client.Do(httpReq.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d from %s", resp.StatusCode, d.url)
+	}
+	if resp.Header.Get("Content-Type") != dohMediaType {
+		return nil, errDoHContentType
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+
+	ret := new(dns.Msg)
+	if err := ret.Unpack(body); err != nil {
+		return nil, err
+	}
+	ret.Id = id
+	return ret, nil
+}
+
+// close closes the idle connections, connections in use are closed once
+// their exchange is done.
+func (d *dohTransport) close() { d.tr.CloseIdleConnections() }
+
+// dohMediaType is the media type of DNS messages in DNS over HTTPS.
+const dohMediaType = "application/dns-message"
+
+// dohMaxIdleConns is the number of idle connections kept per upstream. With
+// HTTP/2 a single connection carries all concurrent queries.
+const dohMaxIdleConns = 2
+
+var errDoHContentType = errors.New("unexpected content type in DNS over HTTPS reply")
@@ -0,0 +1,164 @@
+package edge
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+)
+
+// dohServer returns a DNS over HTTPS server answering every A query with
+// 192.0.2.1, and the TLS config trusting it.
+func dohServer(t *testing.T) (*httptest.Server, *tls.Config) {
+	t.Helper()
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != dohMediaType {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		buf, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		req := new(dns.Msg)
+		if err := req.Unpack(buf); err != nil || req.Id != 0 {
+			http.Error(w, "bad query", http.StatusBadRequest)
+			return
+		}
+		ret := new(dns.Msg)
+		ret.SetReply(req)
+		if req.Question[0].Qtype == dns.TypeA {
+			ret.Answer = append(ret.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.ParseIP("192.0.2.1"),
+			})
+		}
+		buf, err = ret.Pack()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", dohMediaType)
+		w.Write(buf)
+	}))
+
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+	return srv, &tls.Config{RootCAs: pool}
+}
+
+func TestDoHExchange(t *testing.T) {
+	srv, tlsConfig := dohServer(t)
+	defer srv.Close()
+
+	d, err := newDoHTransport(srv.URL+dohPath, tlsConfig, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.close()
+
+	m := new(dns.Msg)
+	m.SetQuestion("nginx.default.svc.cluster.external.", dns.TypeA)
+	id := m.Id
+	ret, err := d.exchange(context.Background(), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ret.Id != id || m.Id != id {
+		t.Errorf("expected the ID %d on the reply and the query, got %d and %d", id, ret.Id, m.Id)
+	}
+	if len(ret.Answer) != 1 || ret.Answer[0].(*dns.A).A.String() != "192.0.2.1" {
+		t.Errorf("expected an answer with 192.0.2.1, got %v", ret.Answer)
+	}
+}
+
+func TestDoHErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		err     string
+	}{
+		{"status", func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		}, "unexpected status 503"},
+		{"content type", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<html></html>"))
+		}, errDoHContentType.Error()},
+		{"garbage", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", dohMediaType)
+			w.Write([]byte{0x01})
+		}, ""},
+	}
+	for _, tc := range tests {
+		srv := httptest.NewTLSServer(tc.handler)
+		pool := x509.NewCertPool()
+		pool.AddCert(srv.Certificate())
+
+		d, err := newDoHTransport(srv.URL+dohPath, &tls.Config{RootCAs: pool}, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := new(dns.Msg)
+		m.SetQuestion("nginx.default.svc.cluster.external.", dns.TypeA)
+		_, err = d.exchange(context.Background(), m)
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: expected an error containing %q, got %v", tc.name, tc.err, err)
+		}
+		d.close()
+		srv.Close()
+	}
+}
+
+func TestDoHUntrusted(t *testing.T) {
+	srv, _ := dohServer(t)
+	defer srv.Close()
+
+	d, err := newDoHTransport(srv.URL+dohPath, new(tls.Config), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.close()
+
+	m := new(dns.Msg)
+	m.SetQuestion("nginx.default.svc.cluster.external.", dns.TypeA)
+	if _, err := d.exchange(context.Background(), m); err == nil {
+		t.Error("expected an error for a server certificate that isn't trusted")
+	}
+}
+
+func TestDoHHealthcheck(t *testing.T) {
+	srv, tlsConfig := dohServer(t)
+
+	p := NewProxy(strings.TrimPrefix(srv.URL, "https://"), nil)
+	if err := p.SetDoH(srv.URL+dohPath, tlsConfig); err != nil {
+		t.Fatal(err)
+	}
+	defer p.doh.close()
+	defer p.transport.Stop()
+
+	if err := p.Check(); err != nil {
+		t.Errorf("expected the upstream healthy, got %s", err)
+	}
+	if fails := atomic.LoadUint32(&p.fails); fails != 0 {
+		t.Errorf("expected no failed health checks, got %d", fails)
+	}
+
+	srv.Close()
+	if err := p.Check(); err == nil {
+		t.Error("expected the health check to fail once the upstream is gone")
+	}
+	if fails := atomic.LoadUint32(&p.fails); fails != 1 {
+		t.Errorf("expected 1 failed health check, got %d", fails)
+	}
+}
@@ -0,0 +1,188 @@
+package edge
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+	maxminddb "github.com/oschwald/maxminddb-golang"
+)
+
+// Geolocator finds the coordinates of a client subnet.
+type Geolocator interface {
+	// Locate returns the coordinates of ip and the prefix length of the
+	// network they were found for, which is 0 if that isn't known.
+	Locate(ip net.IP) (lat, lon float64, prefix int, ok bool)
+	Close() error
+}
+
+// mmdbLocator looks up coordinates in a MaxMind format (mmdb) database.
+type mmdbLocator struct {
+	db *maxminddb.Reader
+}
+
+// mmdbRecord is the part of a GeoIP2/GeoLite2 City record we need.
+type mmdbRecord struct {
+	Location struct {
+		Latitude  *float64 `maxminddb:"latitude"`
+		Longitude *float64 `maxminddb:"longitude"`
+	} `maxminddb:"location"`
+}
+
+func newMMDBLocator(path string) (*mmdbLocator, error) {
+	db, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &mmdbLocator{db: db}, nil
+}
+
+func (m *mmdbLocator) Locate(ip net.IP) (float64, float64, int, bool) {
+	var rec mmdbRecord
+	if err := m.db.Lookup(ip, &rec); err != nil {
+		return 0, 0, 0, false
+	}
+	if rec.Location.Latitude == nil || rec.Location.Longitude == nil {
+		return 0, 0, 0, false
+	}
+	return *rec.Location.Latitude, *rec.Location.Longitude, 0, true
+}
+
+func (m *mmdbLocator) Close() error { return m.db.Close() }
+
+// cidrLocator looks up coordinates in a static list of networks, read from a
+// file with one "CIDR LAT LON" entry per line. The most specific network
+// containing the address wins.
+type cidrLocator struct {
+	entries []cidrEntry // Most specific networks first.
+}
+
+type cidrEntry struct {
+	net      *net.IPNet
+	prefix   int
+	lat, lon float64
+}
+
+func newCIDRLocator(path string) (*cidrLocator, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	c := new(cidrLocator)
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := scanner.Text()
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = text[:i]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s:%d: expected CIDR LAT LON", path, line)
+		}
+		_, ipnet, err := net.ParseCIDR(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, line, err)
+		}
+		lat, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, line, err)
+		}
+		lon, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, line, err)
+		}
+		prefix, _ := ipnet.Mask.Size()
+		c.entries = append(c.entries, cidrEntry{net: ipnet, prefix: prefix, lat: lat, lon: lon})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(c.entries, func(i, j int) bool { return c.entries[i].prefix > c.entries[j].prefix })
+	return c, nil
+}
+
+func (c *cidrLocator) Locate(ip net.IP) (float64, float64, int, bool) {
+	for _, e := range c.entries {
+		if e.net.Contains(ip) {
+			return e.lat, e.lon, e.prefix, true
+		}
+	}
+	return 0, 0, 0, false
+}
+
+func (c *cidrLocator) Close() error { return nil }
+
+// clientSubnetOption returns the EDNS Client Subnet option (RFC 7871) of m,
+// if any.
+func clientSubnetOption(m *dns.Msg) *dns.EDNS0_SUBNET {
+	o := m.IsEdns0()
+	if o == nil {
+		return nil
+	}
+	for _, opt := range o.Option {
+		if ecs, ok := opt.(*dns.EDNS0_SUBNET); ok {
+			return ecs
+		}
+	}
+	return nil
+}
+
+// origin returns the query for selecting edge sites for the client in state.
+// When the client sent an ECS option that can be geolocated, the subnet's
+// coordinates are used as origin instead of the edge's own. The returned ECS
+// option, if not nil, must be echoed in the response.
+func (oe *OptikonEdge) origin(state request.Request) (Query, *dns.EDNS0_SUBNET) {
+	q := Query{Name: state.Name(), Lat: oe.lat, Lon: oe.lon, Client: net.ParseIP(state.IP())}
+	if oe.geo == nil {
+		return q, nil
+	}
+
+	ecs := clientSubnetOption(state.Req)
+	if ecs == nil {
+		return q, nil
+	}
+
+	reply := &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        ecs.Family,
+		SourceNetmask: ecs.SourceNetmask,
+		Address:       ecs.Address,
+	}
+	if ecs.SourceNetmask == 0 {
+		// The client asked not to use its subnet.
+		ClientSubnetCount.WithLabelValues("skipped").Add(1)
+		return q, reply
+	}
+
+	lat, lon, prefix, ok := oe.geo.Locate(ecs.Address)
+	if !ok {
+		// The answer doesn't depend on the subnet, scope 0 lets caches share it.
+		ClientSubnetCount.WithLabelValues("unknown").Add(1)
+		return q, reply
+	}
+	ClientSubnetCount.WithLabelValues("located").Add(1)
+
+	q.Lat, q.Lon = lat, lon
+	q.Client = ecs.Address
+	q.Subnet = true
+	reply.SourceScope = ecs.SourceNetmask
+	if prefix > 0 && uint8(prefix) < reply.SourceScope {
+		reply.SourceScope = uint8(prefix)
+	}
+	return q, reply
+}
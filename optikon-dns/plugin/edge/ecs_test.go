@@ -0,0 +1,215 @@
+package edge
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+
+	"wwwin-github.cisco.com/edge/optikon-dns/plugin/codec"
+)
+
+// cidrFile writes lines to a temporary CIDR file and returns its path.
+func cidrFile(t *testing.T, lines ...string) string {
+	t.Helper()
+	f, err := ioutil.TempFile("", "optikon-cidr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(strings.Join(lines, "\n") + "\n"); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+// subnetQuery answers a query for name from payload, sent with an ECS option
+// for subnet, and returns the request and the reply written.
+func subnetQuery(t *testing.T, oe *OptikonEdge, name, subnet string, payload *codec.Payload) (*dns.Msg, *dns.Msg) {
+	t.Helper()
+	_, ipnet, err := net.ParseCIDR(subnet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefix, _ := ipnet.Mask.Size()
+	r := new(dns.Msg)
+	r.SetQuestion(name, dns.TypeA)
+	r.SetEdns0(4096, true)
+	o := r.IsEdns0()
+	o.Option = append(o.Option, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: uint8(prefix), Address: ipnet.IP})
+
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := oe.answer(context.Background(), request.Request{W: rec, Req: r}, payload, 0); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Msg == nil {
+		t.Fatalf("no reply to %s from %s", name, subnet)
+	}
+	return r, rec.Msg
+}
+
+// subnetOptions returns the ECS options of m.
+func subnetOptions(m *dns.Msg) []*dns.EDNS0_SUBNET {
+	var ecs []*dns.EDNS0_SUBNET
+	if o := m.IsEdns0(); o != nil {
+		for _, opt := range o.Option {
+			if e, ok := opt.(*dns.EDNS0_SUBNET); ok {
+				ecs = append(ecs, e)
+			}
+		}
+	}
+	return ecs
+}
+
+func TestAnswerClientSubnet(t *testing.T) {
+	const name = "nginx.default.svc.cluster.external."
+	path := cidrFile(t, "203.0.113.0/24 35.6895 139.6917")
+	defer os.Remove(path)
+	geo, err := newCIDRLocator(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oe := New()
+	oe.lat, oe.lon = 55.6050, 13.0038
+	oe.geo = geo
+	payload := &codec.Payload{AnswerTTL: 20, Sites: []codec.EdgeSite{
+		{IP: "10.0.0.1", Lat: 55.6761, Lon: 12.5683},
+		{IP: "10.0.0.2", Lat: 35.6762, Lon: 139.6503},
+	}}
+
+	r, ret := subnetQuery(t, oe, name, "203.0.113.0/24", payload)
+	if len(ret.Answer) != 1 || ret.Answer[0].(*dns.A).A.String() != "10.0.0.2" {
+		t.Errorf("expected the site closest to the client subnet, got %v", ret.Answer)
+	}
+
+	o := ret.IsEdns0()
+	if o == nil {
+		t.Fatal("expected an OPT record in the reply")
+	}
+	if o.UDPSize() != 4096 || !o.Do() {
+		t.Errorf("expected the size and DO bit of the request, got %d and %t", o.UDPSize(), o.Do())
+	}
+	if ecs := subnetOptions(ret); len(ecs) != 1 || ecs[0].SourceScope != 24 {
+		t.Errorf("expected a single ECS option with scope 24, got %v", ecs)
+	}
+	if o == r.IsEdns0() {
+		t.Error("expected the reply to have an OPT record of its own")
+	}
+	if ecs := subnetOptions(r); len(ecs) != 1 || ecs[0].SourceScope != 0 {
+		t.Errorf("expected the request left alone, got %v", ecs)
+	}
+}
+
+func TestCIDRLocator(t *testing.T) {
+	path := cidrFile(t,
+		"# Offices",
+		"10.0.0.0/8     59.3293 18.0686",
+		"10.1.0.0/16    55.6050 13.0038 # Malmö",
+		"",
+		"2001:db8::/32  35.6762 139.6503",
+	)
+	defer os.Remove(path)
+	geo, err := newCIDRLocator(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ip       string
+		lat, lon float64
+		prefix   int
+		ok       bool
+	}{
+		{"10.2.3.4", 59.3293, 18.0686, 8, true},
+		{"10.1.3.4", 55.6050, 13.0038, 16, true}, // The most specific network wins.
+		{"2001:db8::1", 35.6762, 139.6503, 32, true},
+		{"192.0.2.1", 0, 0, 0, false},
+	}
+	for _, tc := range tests {
+		lat, lon, prefix, ok := geo.Locate(net.ParseIP(tc.ip))
+		if lat != tc.lat || lon != tc.lon || prefix != tc.prefix || ok != tc.ok {
+			t.Errorf("%s: expected %v %v /%d %t, got %v %v /%d %t", tc.ip, tc.lat, tc.lon, tc.prefix, tc.ok, lat, lon, prefix, ok)
+		}
+	}
+}
+
+func TestCIDRLocatorInvalid(t *testing.T) {
+	tests := []struct {
+		line string
+		err  string
+	}{
+		{"10.0.0.0/8 59.3293", "expected CIDR LAT LON"},
+		{"10.0.0.0/33 59.3293 18.0686", "invalid CIDR address"},
+		{"10.0.0.0/8 north 18.0686", "invalid syntax"},
+		{"10.0.0.0/8 59.3293 east", "invalid syntax"},
+	}
+	for _, tc := range tests {
+		path := cidrFile(t, "# Offices", tc.line)
+		_, err := newCIDRLocator(path)
+		os.Remove(path)
+		if err == nil {
+			t.Errorf("%q: expected an error", tc.line)
+			continue
+		}
+		if !strings.HasPrefix(err.Error(), path+":2: ") || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%q: expected %q at %s:2, got %q", tc.line, tc.err, path, err)
+		}
+	}
+}
+
+func TestOrigin(t *testing.T) {
+	path := cidrFile(t,
+		"198.51.100.0/24 35.6895 139.6917",
+		"203.0.113.0/26  59.3293 18.0686",
+	)
+	defer os.Remove(path)
+	geo, err := newCIDRLocator(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oe := New()
+	oe.lat, oe.lon = 55.6050, 13.0038
+	oe.geo = geo
+
+	tests := []struct {
+		subnet   string
+		lat, lon float64
+		scope    uint8
+	}{
+		{"198.51.100.0/24", 35.6895, 139.6917, 24},
+		{"198.51.100.128/25", 35.6895, 139.6917, 24}, // Scoped to the network it was located in.
+		{"203.0.113.0/26", 59.3293, 18.0686, 26},
+		{"192.0.2.0/24", 55.6050, 13.0038, 0}, // Unknown, the edge's own coordinates.
+	}
+	for _, tc := range tests {
+		_, ipnet, _ := net.ParseCIDR(tc.subnet)
+		prefix, _ := ipnet.Mask.Size()
+		r := new(dns.Msg)
+		r.SetQuestion("nginx.default.svc.cluster.external.", dns.TypeA)
+		r.SetEdns0(4096, false)
+		o := r.IsEdns0()
+		o.Option = append(o.Option, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: uint8(prefix), Address: ipnet.IP})
+
+		q, ecs := oe.origin(request.Request{W: &test.ResponseWriter{}, Req: r})
+		if q.Lat != tc.lat || q.Lon != tc.lon {
+			t.Errorf("%s: expected origin %v %v, got %v %v", tc.subnet, tc.lat, tc.lon, q.Lat, q.Lon)
+		}
+		if q.Subnet != (tc.scope > 0) {
+			t.Errorf("%s: expected the subnet used %t, got %t", tc.subnet, tc.scope > 0, q.Subnet)
+		}
+		if ecs == nil {
+			t.Fatalf("%s: expected an ECS option to echo", tc.subnet)
+		}
+		if ecs.SourceNetmask != uint8(prefix) || ecs.SourceScope != tc.scope || !ecs.Address.Equal(ipnet.IP) {
+			t.Errorf("%s: expected source /%d scope /%d, got %v", tc.subnet, prefix, tc.scope, ecs)
+		}
+	}
+}
@@ -2,21 +2,20 @@ package edge
 
 import (
 	"crypto/tls"
-	"encoding/json"
 	"errors"
-	"fmt"
 	"io"
+	"math"
 	"net"
-	"regexp"
-	"strconv"
 	"time"
 
 	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/pkg/dnsutil"
 	"github.com/coredns/coredns/request"
-	"wwwin-github.cisco.com/edge/optikon-dns/plugin/central"
+	"wwwin-github.cisco.com/edge/optikon-dns/plugin/codec"
+	"wwwin-github.cisco.com/edge/optikon-dns/plugin/logging"
 
 	"github.com/miekg/dns"
-	ot "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
 	"golang.org/x/net/context"
 )
 
@@ -35,18 +34,47 @@ type OptikonEdge struct {
 	maxfails      uint32
 	expire        time.Duration
 
-	forceTCP bool // also here for testing
+	forceTCP  bool // also here for testing
+	reconcile bool // Ask all upstreams and use the answer from the latest table.
 
 	Next plugin.Handler
 
 	lon      float64
 	lat      float64
+	self     net.IP // Address of this edge site, preferred when it runs the service.
+	selector SiteSelector
+	prober   *prober
+	health   *siteHealth
+	geo      Geolocator // Locates ECS client subnets, nil if ECS is not used.
 	services []string
+
+	// TTL of the answers in seconds, unless central sets one for the service,
+	// and the range that is clamped to.
+	ttl    uint32
+	minTTL uint32
+	maxTTL uint32
+
+	cache   *siteCache
+	replica *replica // Table streamed from central, nil if not used.
+
+	// Keys the answers of central must be signed with, nil if they aren't
+	// verified, and how far from now they may have been signed.
+	keys   codec.KeySet
+	maxAge time.Duration
+
+	// Edge sites answered with while central is unreachable and the cache
+	// has nothing, by service.
+	fallback map[string]codec.Service
+
+	admin     *admin       // HTTP debug endpoint, nil if not used.
+	decisions *decisionLog // Nil if decisions aren't logged.
+
+	log *logging.Logger // Set up by the log_level and log_format properties.
 }
 
 // New returns a new OptikonEdge.
 func New() *OptikonEdge {
-	oe := &OptikonEdge{maxfails: 2, tlsConfig: new(tls.Config), expire: defaultExpire, p: new(random), from: ".", hcInterval: hcDuration}
+	oe := &OptikonEdge{maxfails: 2, tlsConfig: new(tls.Config), expire: defaultExpire, p: new(random), from: ".", hcInterval: hcDuration, selector: new(nearest), ttl: defaultTTL, maxTTL: defaultMaxTTL, maxAge: defaultMaxAge, log: logging.New("optikon-edge")}
 	return oe
 }
 
@@ -70,10 +98,146 @@ func (oe *OptikonEdge) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dn
 		return plugin.NextOrFailure(oe.Name(), oe.Next, ctx, w, r)
 	}
 
+	// Edge sites are cached per service, SRV queries and SRV target names have
+	// extra labels in front of it.
+	service := codec.ParseName(state.Name()).Service
+
+	// Record how the query is answered for a sample of the queries.
+	if oe.decisions != nil && oe.decisions.sampled() {
+		d := newDecision(state)
+		ctx = withDecision(ctx, d)
+		defer oe.decisions.write(d)
+	}
+	d := decisionFrom(ctx)
+
+	// Answer from the table streamed by central while we follow it.
+	if oe.replica != nil {
+		if payload, live := oe.replica.lookup(service); live {
+			d.answeredFrom("replica")
+			if payload == nil || len(payload.Sites) == 0 {
+				d.passed()
+				NextCount.WithLabelValues("not_served").Add(1)
+				return plugin.NextOrFailure(oe.Name(), oe.Next, ctx, w, r)
+			}
+			return oe.answer(ctx, state, payload, 0)
+		}
+	}
+
+	// Answer from the cache of edge sites if we can.
+	if oe.cache != nil {
+		now := time.Now()
+		span, _ := childSpan(ctx, "cache")
+		e, found := oe.cache.get(service, now)
+		span.SetTag(tagCacheHit, found)
+		if found {
+			span.SetTag(tagNegative, e.negative)
+		}
+		span.Finish()
+		if found {
+			d.answeredFrom("cache")
+			if e.negative {
+				CacheHitCount.WithLabelValues("negative").Add(1)
+				d.passed()
+				NextCount.WithLabelValues("not_served").Add(1)
+				return plugin.NextOrFailure(oe.Name(), oe.Next, ctx, w, r)
+			}
+			CacheHitCount.WithLabelValues("positive").Add(1)
+			if oe.cache.shouldPrefetch(e, now) {
+				CachePrefetchCount.Add(1)
+				// The refresh outlives the query, it gets a copy of
+				// the request and none of its writer.
+				go oe.refresh(request.Request{Req: state.Req.Copy()}, service)
+			}
+			return oe.answer(ctx, state, e.payload, now.Sub(e.stored))
+		}
+		CacheMissCount.Add(1)
+	}
+
+	_, payload, err := oe.resolve(ctx, state)
+	if err == errUpstreamMismatch {
+		formerr := state.ErrorMessage(dns.RcodeFormatError)
+		w.WriteMsg(formerr)
+		return 0, nil
+	}
+	if err != nil {
+		return oe.degrade(ctx, state, service)
+	}
+	d.answeredFrom("central")
+
+	// If central doesn't serve the name, or has no edge sites for it, call
+	// the next plugin (proxy). Whatever central answered for a name it
+	// doesn't serve is dropped, like it is for the hits of the negative
+	// cache, so every query for the name is answered the same way.
+	if payload == nil || len(payload.Sites) == 0 {
+		if oe.cache != nil {
+			oe.cache.setNegative(service, time.Now())
+		}
+		d.passed()
+		NextCount.WithLabelValues("not_served").Add(1)
+		return plugin.NextOrFailure(oe.Name(), oe.Next, ctx, w, r)
+	}
+
+	if oe.cache != nil {
+		now := time.Now()
+		e := oe.cache.set(service, payload, now)
+		return oe.answer(ctx, state, e.payload, now.Sub(e.stored))
+	}
+
+	return oe.answer(ctx, state, payload, 0)
+}
+
+// degrade answers the query in state while central is unreachable: with the
+// last known edge sites of service if they expired no longer than serve_stale
+// ago (RFC 8767), else with the edge sites in the fallback table, else by
+// passing it to the next plugin.
+func (oe *OptikonEdge) degrade(ctx context.Context, state request.Request, service string) (int, error) {
+	d := decisionFrom(ctx)
+	if oe.cache != nil {
+		if e, found := oe.cache.stale(service, time.Now()); found {
+			CacheHitCount.WithLabelValues("stale").Add(1)
+			DegradedCount.WithLabelValues("stale").Add(1)
+			d.answeredFrom("stale")
+			return oe.answer(ctx, state, degraded(e.payload), 0)
+		}
+	}
+	if svc, found := oe.fallback[service]; found && len(svc.Sites) > 0 {
+		DegradedCount.WithLabelValues("fallback").Add(1)
+		d.answeredFrom("fallback")
+		return oe.answer(ctx, state, degraded(&codec.Payload{Sites: svc.Sites, AnswerTTL: svc.TTL}), 0)
+	}
+	DegradedCount.WithLabelValues("next").Add(1)
+	d.answeredFrom("next")
+	d.passed()
+	NextCount.WithLabelValues("unreachable").Add(1)
+	return plugin.NextOrFailure(oe.Name(), oe.Next, ctx, state.W, state.Req)
+}
+
+// degraded returns a copy of p whose answers have a TTL of at most
+// staleAnswerTTL, so clients ask again soon after central is back.
+func degraded(p *codec.Payload) *codec.Payload {
+	d := *p
+	if d.AnswerTTL == 0 || d.AnswerTTL > staleAnswerTTL {
+		d.AnswerTTL = staleAnswerTTL
+	}
+	return &d
+}
+
+// resolve asks the upstream proxies for the edge sites of the name in state.
+// If central doesn't serve the name, the upstream response is returned with a
+// nil payload.
+func (oe *OptikonEdge) resolve(ctx context.Context, state request.Request) (*dns.Msg, *codec.Payload, error) {
+
+	// Ask central for the edge sites in the EDNS0 option.
+	req := state.Req.Copy()
+	codec.Request(req)
+	upstream := request.Request{W: state.W, Req: req}
+
+	if oe.reconcile && len(oe.proxies) > 1 {
+		return oe.resolveAll(ctx, state, upstream)
+	}
+
 	fails := 0
-	var span, child ot.Span
 	var upstreamErr error
-	span = ot.SpanFromContext(ctx)
 
 	for _, proxy := range oe.list() {
 		if proxy.Down(oe.maxfails) {
@@ -89,130 +253,525 @@ func (oe *OptikonEdge) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dn
 			HealthcheckBrokenCount.Add(1)
 		}
 
-		if span != nil {
-			child = span.Tracer().StartSpan("connect", ot.ChildOf(span.Context()))
-			ctx = ot.ContextWithSpan(ctx, child)
-		}
+		ret, err := oe.exchange(ctx, proxy, upstream)
+		upstreamErr = err
 
-		var (
-			ret *dns.Msg
-			err error
-		)
-		stop := false
-		for {
-			ret, err = proxy.connect(ctx, state, oe.forceTCP, true)
-			if err != nil && err == io.EOF && !stop { // Remote side closed conn, can only happen with TCP.
-				stop = true
+		if err != nil {
+			if fails < len(oe.proxies) {
 				continue
 			}
 			break
 		}
 
-		if child != nil {
-			child.Finish()
-		}
+		decisionFrom(ctx).askedUpstream(proxy.addr)
+		return oe.decode(ctx, state, ret)
+	}
 
-		ret, err = truncated(ret, err)
-		upstreamErr = err
+	if upstreamErr != nil {
+		return nil, nil, upstreamErr
+	}
 
-		if err != nil {
-			// Kick off health check to see if *our* upstream is broken.
-			if oe.maxfails != 0 {
-				proxy.Healthcheck()
-			}
+	return nil, nil, errNoHealthy
+}
 
-			if fails < len(oe.proxies) {
-				continue
+// resolveAll asks all healthy upstream proxies at once and returns the reply
+// from the latest table, the one with the highest generation. Replies without
+// edge sites are only used if no central returned any.
+func (oe *OptikonEdge) resolveAll(ctx context.Context, state, upstream request.Request) (*dns.Msg, *codec.Payload, error) {
+	var up []*Proxy
+	for _, proxy := range oe.proxies {
+		if !proxy.Down(oe.maxfails) {
+			up = append(up, proxy)
+		}
+	}
+	if len(up) == 0 {
+		// All upstream proxies are dead, assume healtcheck is completely broken.
+		up = append(up, new(random).List(oe.proxies)[0])
+		HealthcheckBrokenCount.Add(1)
+	}
+
+	type result struct {
+		proxy   *Proxy
+		ret     *dns.Msg
+		payload *codec.Payload
+		err     error
+	}
+	results := make(chan result, len(up))
+	for _, proxy := range up {
+		go func(proxy *Proxy) {
+			// Every exchange gets its own copy of the request.
+			req := request.Request{W: upstream.W, Req: upstream.Req.Copy()}
+			r := result{proxy: proxy}
+			r.ret, r.err = oe.exchange(ctx, proxy, req)
+			if r.err == nil {
+				r.ret, r.payload, r.err = oe.decode(ctx, state, r.ret)
 			}
-			break
+			results <- r
+		}(proxy)
+	}
+
+	var (
+		best    *result
+		lastErr error
+	)
+	for range up {
+		r := <-results
+		if r.err != nil {
+			lastErr = r.err
+			continue
 		}
+		if best == nil || newer(r.payload, best.payload) {
+			best = &r
+		}
+	}
+	if best == nil {
+		return nil, nil, lastErr
+	}
+	decisionFrom(ctx).askedUpstream(best.proxy.addr)
+	return best.ret, best.payload, nil
+}
+
+// newer reports whether p is from a newer table than q. A nil payload is older
+// than any other.
+func newer(p, q *codec.Payload) bool {
+	if p == nil {
+		return false
+	}
+	return q == nil || p.Generation > q.Generation
+}
 
-		// Check if the reply is correct; if not return FormErr.
-		if !state.Match(ret) {
-			formerr := state.ErrorMessage(dns.RcodeFormatError)
-			w.WriteMsg(formerr)
-			return 0, nil
+// exchange sends the upstream request to proxy. Responses that were truncated
+// over UDP are retried over TCP, large edge site lists may not fit. Traced
+// requests carry the context of the span, so central continues the trace.
+func (oe *OptikonEdge) exchange(ctx context.Context, proxy *Proxy, upstream request.Request) (*dns.Msg, error) {
+	span, ctx := childSpan(ctx, "connect")
+	span.SetTag(tagUpstream, proxy.addr)
+	if traced(ctx) {
+		if err := codec.InjectSpan(upstream.Req, span); err != nil {
+			oe.log.Debugf("unable to inject span context: %s", err)
 		}
+	}
 
-		ret.Compress = true
-		// When using force_tcp the upstream can send a message that is too big for
-		// the udp buffer, hence we need to truncate the message to at least make it
-		// fit the udp buffer.
-		ret, _ = state.Scrub(ret)
-
-		// Assert an additional entry for the table exists.
-		if len(ret.Extra) == 0 {
-			if len(ret.Answer) == 0 {
-				fmt.Println("ERROR: No Additional entries returned!")
-				return dns.RcodeServerFailure, errTableParseFailure
-			}
-			w.WriteMsg(ret)
-			return 0, nil
+	var (
+		ret *dns.Msg
+		err error
+	)
+	stop := false
+	for {
+		ret, err = proxy.connect(ctx, upstream, oe.forceTCP, true)
+		if err != nil && err == io.EOF && !stop { // Remote side closed conn, can only happen with TCP.
+			stop = true
+			continue
 		}
+		break
+	}
+
+	if err == nil && ret.Truncated && !oe.forceTCP && upstream.Proto() == "udp" {
+		ret, err = proxy.connect(ctx, upstream, true, true)
+	}
+
+	ret, err = truncated(ret, err)
+	if err != nil {
+		ext.Error.Set(span, true)
+	}
+	span.Finish()
 
-		// Extract the edge sites from the response.
-		edgeSiteRR := ret.Extra[0]
-		edgeSiteSubmatches := edgeSiteRegex.FindStringSubmatch(edgeSiteRR.String())
-		if len(edgeSiteSubmatches) < 2 {
-			fmt.Println("EDGESITERR:", edgeSiteRR)
-			fmt.Println("EDGESITESUBMATCHES:", edgeSiteSubmatches)
-			return dns.RcodeServerFailure, errTableParseFailure
+	if err != nil {
+		// Kick off health check to see if *our* upstream is broken.
+		if oe.maxfails != 0 {
+			proxy.Healthcheck()
 		}
-		edgeSiteStr, err := strconv.Unquote(fmt.Sprintf("\"%s\"", edgeSiteSubmatches[1]))
-		if err != nil {
-			fmt.Println("EDGESITESTR:", edgeSiteStr)
-			return dns.RcodeServerFailure, errTableParseFailure
+		return nil, err
+	}
+	return ret, nil
+}
+
+// decode extracts the edge sites from the upstream reply ret to the query in
+// state.
+func (oe *OptikonEdge) decode(ctx context.Context, state request.Request, ret *dns.Msg) (*dns.Msg, *codec.Payload, error) {
+	span, _ := childSpan(ctx, "decode")
+	defer span.Finish()
+
+	ret, payload, err := oe.extract(state, ret)
+	if err != nil {
+		ext.Error.Set(span, true)
+	} else if payload != nil {
+		span.SetTag(tagGeneration, payload.Generation)
+		span.SetTag(tagSites, len(payload.Sites))
+	}
+	return ret, payload, err
+}
+
+// extract does the work of decode.
+func (oe *OptikonEdge) extract(state request.Request, ret *dns.Msg) (*dns.Msg, *codec.Payload, error) {
+	payload, err := payloadOf(state, ret)
+	if err == errUpstreamMismatch {
+		return nil, nil, err
+	}
+	if err != nil {
+		oe.log.Errorf("unable to decode edge sites for %s: %s", state.Name(), err)
+		TableParseFailureCount.Add(1)
+		return nil, nil, errTableParseFailure
+	}
+
+	ret.Compress = true
+
+	// Replies without a payload, for names central doesn't serve, aren't
+	// verified: nothing is answered from them, the query goes to the next
+	// plugin.
+	if payload != nil && oe.keys != nil {
+		if err := oe.verify(state, payload); err != nil {
+			return nil, nil, err
+		}
+	}
+	return ret, payload, nil
+}
+
+// payloadOf returns the edge sites in the reply ret of central to the query in
+// state. Central passes the names it doesn't serve to its next plugin and
+// returns whatever that answered, NXDOMAIN and NODATA included, without a
+// payload; a nil payload is returned for those.
+func payloadOf(state request.Request, ret *dns.Msg) (*codec.Payload, error) {
+	// Check if the reply is correct; if not return FormErr.
+	if !state.Match(ret) {
+		return nil, errUpstreamMismatch
+	}
+	payload, err := codec.Extract(ret)
+	if err == codec.ErrNoPayload {
+		return nil, nil
+	}
+	return payload, err
+}
+
+// verify checks the signature of the payload central returned for the query in
+// state.
+func (oe *OptikonEdge) verify(state request.Request, payload *codec.Payload) error {
+	err := oe.keys.Verify(payload, state.Name(), oe.maxAge, time.Now())
+	if err == nil {
+		return nil
+	}
+	SignatureFailureCount.WithLabelValues(signatureFailure(err)).Add(1)
+	oe.log.Errorf("rejecting answer from central for %s: %s", state.Name(), err)
+	return errUnverified
+}
+
+// signatureFailure returns the reason label of a verification error.
+func signatureFailure(err error) string {
+	switch err {
+	case codec.ErrUnsigned:
+		return "unsigned"
+	case codec.ErrUnknownKey:
+		return "unknown_key"
+	case codec.ErrExpiredSignature:
+		return "stale"
+	}
+	return "bad_signature"
+}
+
+// refresh fetches the edge sites for the service in state ahead of the expiry
+// of its cache entry. state has no writer, central is asked over UDP like for
+// a client over UDP.
+func (oe *OptikonEdge) refresh(state request.Request, service string) {
+	state.W = prefetchWriter{}
+	_, payload, err := oe.resolve(context.Background(), state)
+	if err != nil || payload == nil || len(payload.Sites) == 0 {
+		return
+	}
+	oe.cache.set(service, payload, time.Now())
+}
+
+// prefetchWriter is the dns.ResponseWriter of refreshes, which have no client.
+// It reports a client over UDP, nothing is written to it.
+type prefetchWriter struct{}
+
+func (prefetchWriter) LocalAddr() net.Addr         { return &net.UDPAddr{IP: net.IPv4zero, Port: 53} }
+func (prefetchWriter) RemoteAddr() net.Addr        { return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)} }
+func (prefetchWriter) WriteMsg(*dns.Msg) error     { return nil }
+func (prefetchWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (prefetchWriter) Close() error                { return nil }
+func (prefetchWriter) TsigStatus() error           { return nil }
+func (prefetchWriter) TsigTimersOnly(bool)         {}
+func (prefetchWriter) Hijack()                     {}
+
+// answer writes the addresses of the chosen edge sites to the client. Only the
+// sites with an address of the queried type take part in the choice. If there
+// are none, or the query isn't for addresses, the answer is NODATA. SRV queries
+// for _<port>._<proto>.<service> are answered with the port on every site, the
+// names of their targets with the address of the site they name. age is how
+// long ago central returned payload, if it comes from the cache.
+func (oe *OptikonEdge) answer(ctx context.Context, state request.Request, payload *codec.Payload, age time.Duration) (int, error) {
+
+	q, ecs := oe.origin(state)
+	name := codec.ParseName(state.Name())
+	edgeSites := payload.Sites
+	ttl := oe.answerTTL(payload, age)
+
+	ret := new(dns.Msg)
+	ret.SetReply(state.Req)
+	ret.Compress = true
+
+	// Write the chosen cluster IPs as DNS records.
+	qtype := state.QType()
+	switch {
+	case name.Site != "":
+		site := net.ParseIP(name.Site)
+		for _, edgeSite := range withAddress(edgeSites, qtype) {
+			if hasAddress(edgeSite, site) {
+				ret.Answer = addressRecords(state.QName(), state.QClass(), qtype, ttl, edgeSite)
+				break
+			}
 		}
-		var edgeSites []central.EdgeSite
-		if err := json.Unmarshal([]byte(edgeSiteStr), &edgeSites); err != nil {
-			fmt.Println("EDGESITESTR:", edgeSiteStr)
-			return dns.RcodeServerFailure, errTableParseFailure
+	case name.Port != "":
+		if qtype == dns.TypeSRV {
+			ret.Answer, ret.Extra = oe.srv(ctx, state, q, name, ttl, edgeSites)
 		}
+	default:
+		if candidates := oe.up(withAddress(edgeSites, qtype)); len(candidates) > 0 {
+			chosen := oe.choose(ctx, q, candidates)
+			decisionFrom(ctx).selected(oe.prober, q, candidates, chosen)
+			countSelection(name.Service, q, chosen)
+			for _, edgeSite := range chosen {
+				ret.Answer = append(ret.Answer, addressRecords(state.QName(), state.QClass(), qtype, ttl, edgeSite)...)
+			}
+		}
+	}
+	// The name exists but has no records of the queried type (NODATA), the
+	// SOA lets resolvers cache that for as long as an answer (RFC 2308).
+	if len(ret.Answer) == 0 {
+		ret.Ns = []dns.RR{oe.soa(state.QClass(), ttl)}
+	}
+	// The response gets an OPT record of its own. The one of the request
+	// carries the options of the client, its ECS option included, which
+	// must not be echoed next to the scoped one (RFC 7871 section 7.2.1).
+	if state.Req.IsEdns0() != nil {
+		ret.SetEdns0(uint16(state.Size()), state.Do())
+		if ecs != nil {
+			o := ret.IsEdns0()
+			o.Option = append(o.Option, ecs)
+		}
+	}
 
-		// Remove the Table entry from the return message.
-		ret.Extra = ret.Extra[1:]
+	decisionFrom(ctx).answered(len(ret.Answer))
 
-		// If the list is empty, call the next plugin (proxy).
-		if len(edgeSites) == 0 {
-			return plugin.NextOrFailure(oe.Name(), oe.Next, ctx, w, r)
+	// Write the response message.
+	oe.reply(ctx, state, ret)
+
+	return 0, nil
+}
+
+// srv returns the SRV records of the edge sites exposing the port in name, with
+// the addresses of their targets as glue. The sites picked by the selector get
+// priority 0, the others follow one by one in order of distance. Weights are
+// the capacities of the sites.
+func (oe *OptikonEdge) srv(ctx context.Context, state request.Request, q Query, name codec.Name, ttl uint32, edgeSites []codec.EdgeSite) (answer, extra []dns.RR) {
+	var candidates []codec.EdgeSite
+	for _, edgeSite := range edgeSites {
+		if _, ok := edgeSite.Port(name.Port, name.Proto); ok {
+			candidates = append(candidates, edgeSite)
 		}
+	}
+	candidates = oe.up(candidates)
+	if len(candidates) == 0 {
+		return nil, nil
+	}
 
-		// Compute the distance to the first edge site.
-		closest := edgeSites[0].IP
-		minDist := Distance(oe.lat, oe.lon, edgeSites[0].Lat, edgeSites[0].Lon)
-		for _, edgeSite := range edgeSites {
-			dist := Distance(oe.lat, oe.lon, edgeSite.Lat, edgeSite.Lon)
-			if dist < minDist {
-				minDist = dist
-				closest = edgeSite.IP
+	chosen := oe.choose(ctx, q, candidates)
+	decisionFrom(ctx).selected(oe.prober, q, candidates, chosen)
+	countSelection(name.Service, q, chosen)
+	ranked := [][]codec.EdgeSite{chosen}
+	for _, edgeSite := range byDistance(q, candidates) {
+		if !containsSite(chosen, edgeSite) {
+			ranked = append(ranked, []codec.EdgeSite{edgeSite})
+		}
+	}
+
+	for priority, sites := range ranked {
+		for _, edgeSite := range sites {
+			port, _ := edgeSite.Port(name.Port, name.Proto)
+			weight := edgeSite.Weight
+			if weight > math.MaxUint16 {
+				weight = math.MaxUint16
 			}
+			target := codec.SiteTarget(edgeSite.IP, name.Service)
+			answer = append(answer, &dns.SRV{
+				Hdr:      dns.RR_Header{Name: state.QName(), Rrtype: dns.TypeSRV, Class: state.QClass(), Ttl: ttl},
+				Priority: uint16(priority),
+				Weight:   uint16(weight),
+				Port:     port.Port,
+				Target:   target,
+			})
+			extra = append(extra, addressRecords(target, state.QClass(), dns.TypeANY, ttl, edgeSite)...)
 		}
+	}
+	return answer, extra
+}
 
-		// Write the closest cluster IP as a DNS record.
-		var rr dns.RR
-		switch state.Family() {
-		case 1:
-			rr = new(dns.A)
-			rr.(*dns.A).Hdr = dns.RR_Header{Name: state.QName(), Rrtype: dns.TypeA, Class: state.QClass()}
-			rr.(*dns.A).A = net.ParseIP(closest).To4()
-		case 2:
-			rr = new(dns.AAAA)
-			rr.(*dns.AAAA).Hdr = dns.RR_Header{Name: state.QName(), Rrtype: dns.TypeAAAA, Class: state.QClass()}
-			rr.(*dns.AAAA).AAAA = net.ParseIP(closest)
+// countSelection records the edge sites chosen for service in the metrics.
+func countSelection(service string, q Query, chosen []codec.EdgeSite) {
+	for _, es := range chosen {
+		SelectionCount.WithLabelValues(service, es.IP).Add(1)
+	}
+	SelectionDistance.Observe(Distance(q.Lat, q.Lon, chosen[0].Lat, chosen[0].Lon))
+}
+
+// withAddress returns the edge sites that have an address to answer a query of
+// type qtype with. For ANY that is every site, any other type that isn't A or
+// AAAA (CNAME, SRV, HTTPS, ...) has none.
+func withAddress(edgeSites []codec.EdgeSite, qtype uint16) []codec.EdgeSite {
+	switch qtype {
+	case dns.TypeANY:
+		return edgeSites
+	case dns.TypeA, dns.TypeAAAA:
+	default:
+		return nil
+	}
+
+	var ret []codec.EdgeSite
+	for _, edgeSite := range edgeSites {
+		if qtype == dns.TypeA && edgeSite.A() != nil || qtype == dns.TypeAAAA && edgeSite.AAAA() != nil {
+			ret = append(ret, edgeSite)
 		}
-		ret.Answer = []dns.RR{rr}
+	}
+	return ret
+}
 
-		// Write the response message.
-		w.WriteMsg(ret)
+// addressRecords returns the A and/or AAAA records of edgeSite for name,
+// answering a query of type qtype.
+func addressRecords(name string, class, qtype uint16, ttl uint32, edgeSite codec.EdgeSite) []dns.RR {
+	var rrs []dns.RR
+	if ip := edgeSite.A(); ip != nil && qtype != dns.TypeAAAA {
+		rrs = append(rrs, &dns.A{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: class, Ttl: ttl},
+			A:   ip,
+		})
+	}
+	if ip := edgeSite.AAAA(); ip != nil && qtype != dns.TypeA {
+		rrs = append(rrs, &dns.AAAA{
+			Hdr:  dns.RR_Header{Name: name, Rrtype: dns.TypeAAAA, Class: class, Ttl: ttl},
+			AAAA: ip,
+		})
+	}
+	return rrs
+}
 
-		return 0, nil
+// soa returns the SOA record of the zone the edge answers for, with ttl as
+// both its TTL and its minimum, so negative answers are cached for ttl.
+func (oe *OptikonEdge) soa(class uint16, ttl uint32) *dns.SOA {
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: oe.from, Rrtype: dns.TypeSOA, Class: class, Ttl: ttl},
+		Ns:      dnsutil.Join([]string{"ns.dns", oe.from}),
+		Mbox:    dnsutil.Join([]string{"hostmaster", oe.from}),
+		Serial:  uint32(time.Now().Unix()),
+		Refresh: soaRefresh,
+		Retry:   soaRetry,
+		Expire:  soaExpire,
+		Minttl:  ttl,
 	}
+}
 
-	if upstreamErr != nil {
-		return dns.RcodeServerFailure, upstreamErr
+// answerTTL returns the TTL of the records answering for the service in
+// payload: the TTL central set for the service, or else the default, clamped
+// to the configured range. Central returned payload age ago, the time spent in
+// the cache counts against the TTL down to min_ttl.
+func (oe *OptikonEdge) answerTTL(payload *codec.Payload, age time.Duration) uint32 {
+	ttl := payload.AnswerTTL
+	if ttl == 0 {
+		ttl = oe.ttl
+	}
+	if ttl < oe.minTTL {
+		ttl = oe.minTTL
+	}
+	if ttl > oe.maxTTL {
+		ttl = oe.maxTTL
 	}
+	if elapsed := uint32(age / time.Second); elapsed >= ttl-oe.minTTL {
+		ttl = oe.minTTL
+	} else {
+		ttl -= elapsed
+	}
+	return ttl
+}
 
-	return dns.RcodeServerFailure, errNoHealthy
+// hasAddress reports whether ip is one of the addresses of edgeSite.
+func hasAddress(edgeSite codec.EdgeSite, ip net.IP) bool {
+	return ip.Equal(net.ParseIP(edgeSite.IP)) || ip.Equal(edgeSite.AAAA())
+}
+
+// containsSite reports whether edgeSite is one of sites.
+func containsSite(sites []codec.EdgeSite, edgeSite codec.EdgeSite) bool {
+	for _, es := range sites {
+		if es.IP == edgeSite.IP {
+			return true
+		}
+	}
+	return false
+}
+
+// up returns the edge sites whose service isn't down, or all of them if all
+// are.
+func (oe *OptikonEdge) up(edgeSites []codec.EdgeSite) []codec.EdgeSite {
+	if oe.health == nil || len(edgeSites) == 0 {
+		return edgeSites
+	}
+	return oe.health.filter(edgeSites)
+}
+
+// choose returns the local edge site if it runs the service, and the edge
+// sites picked by the selector otherwise. The local edge site isn't preferred
+// for clients located through ECS, they may be anywhere. edgeSites must not be
+// empty.
+func (oe *OptikonEdge) choose(ctx context.Context, q Query, edgeSites []codec.EdgeSite) (chosen []codec.EdgeSite) {
+	span, _ := childSpan(ctx, "select")
+	defer func() {
+		span.SetTag(tagCandidates, len(edgeSites))
+		span.SetTag(tagSite, chosen[0].IP)
+		span.SetTag(tagDistance, Distance(q.Lat, q.Lon, chosen[0].Lat, chosen[0].Lon))
+		span.Finish()
+	}()
+
+	// Keep measuring all sites even while this one is used, so the latency
+	// selector has round trip times as soon as this site goes away.
+	if oe.prober != nil {
+		ips := make([]string, len(edgeSites))
+		for i, edgeSite := range edgeSites {
+			ips[i] = edgeSite.IP
+		}
+		oe.prober.learn(ips)
+	}
+
+	if oe.self != nil && !q.Subnet {
+		for _, edgeSite := range edgeSites {
+			if hasAddress(edgeSite, oe.self) {
+				LocalityCount.WithLabelValues("local").Add(1)
+				return []codec.EdgeSite{edgeSite}
+			}
+		}
+	}
+	LocalityCount.WithLabelValues("remote").Add(1)
+
+	return oe.selector.Select(q, edgeSites)
+}
+
+// reply writes ret to the client in state. The OPT record is dropped if the
+// client didn't send one, it was only added for the upstream query. When using
+// force_tcp the upstream can send a message that is too big for the udp buffer,
+// hence we need to truncate the message to at least make it fit the udp buffer.
+func (oe *OptikonEdge) reply(ctx context.Context, state request.Request, ret *dns.Msg) {
+	span, _ := childSpan(ctx, "write")
+	defer span.Finish()
+	span.SetTag(tagAnswers, len(ret.Answer))
+
+	if state.Req.IsEdns0() == nil {
+		extra := ret.Extra[:0]
+		for _, rr := range ret.Extra {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				extra = append(extra, rr)
+			}
+		}
+		ret.Extra = extra
+	}
+	ret, _ = state.Scrub(ret)
+	state.W.WriteMsg(ret)
 }
 
 func (oe *OptikonEdge) match(state request.Request) bool {
@@ -247,6 +806,14 @@ var (
 	errNoOptikonEdge         = errors.New("no optikon-edge defined")
 	errTableParseFailure     = errors.New("unable to parse Table returned from central")
 	errFindingClosestCluster = errors.New("unable to compute closest edge cluster")
+	errUpstreamMismatch      = errors.New("upstream reply doesn't match the request")
+	errLatencyNoProbe        = errors.New("latency selection requires a probe")
+	errIntervalNoProbe       = errors.New("probe_interval requires a probe")
+	errTTLRange              = errors.New("min_ttl can't be larger than max_ttl")
+	errUnverified            = errors.New("answer from central failed signature verification")
+	errVerifyStream          = errors.New("verify requires a stream over TLS")
+	errSelectionArgs         = errors.New("wrong number of arguments to selection")
+	errEmptyToken            = errors.New("empty api token")
 )
 
 // policy tells forward what policy for selecting upstream it uses.
@@ -256,7 +823,3 @@ const (
 	randomPolicy policy = iota
 	roundRobinPolicy
 )
-
-var (
-	edgeSiteRegex = regexp.MustCompile(`^.*\t0\tIN\tTXT\t\"(\[.*\])\"$`)
-)
@@ -0,0 +1,193 @@
+package edge
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/net/context"
+
+	"wwwin-github.cisco.com/edge/optikon-dns/plugin/codec"
+)
+
+// answerQuery answers a query for name of type qtype from payload and returns
+// the reply written.
+func answerQuery(t *testing.T, oe *OptikonEdge, name string, qtype uint16, payload *codec.Payload) *dns.Msg {
+	t.Helper()
+	r := new(dns.Msg)
+	r.SetQuestion(name, qtype)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := oe.answer(context.Background(), request.Request{W: rec, Req: r}, payload, 0); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Msg == nil {
+		t.Fatalf("no reply to %s %s", name, dns.TypeToString[qtype])
+	}
+	return rec.Msg
+}
+
+func TestAnswerNoData(t *testing.T) {
+	const name = "nginx.default.svc.cluster.external."
+	oe := New()
+	oe.from = "cluster.external."
+	payload := &codec.Payload{AnswerTTL: 20, Sites: []codec.EdgeSite{{IP: "10.0.0.1", Lat: 55.6761, Lon: 12.5683}}}
+
+	tests := []struct {
+		qtype  uint16
+		answer bool
+	}{
+		{dns.TypeA, true},
+		{dns.TypeAAAA, false}, // The site has no IPv6 address.
+		{dns.TypeTXT, false},
+		{dns.TypeCNAME, false},
+	}
+	for _, tc := range tests {
+		ret := answerQuery(t, oe, name, tc.qtype, payload)
+		qtype := dns.TypeToString[tc.qtype]
+		if ret.Rcode != dns.RcodeSuccess {
+			t.Errorf("%s: expected NOERROR, got %s", qtype, dns.RcodeToString[ret.Rcode])
+		}
+		if tc.answer {
+			if len(ret.Answer) == 0 || len(ret.Ns) != 0 {
+				t.Errorf("%s: expected an answer without authority, got %d answers and %d authority", qtype, len(ret.Answer), len(ret.Ns))
+			}
+			continue
+		}
+		if len(ret.Answer) != 0 || len(ret.Ns) != 1 {
+			t.Fatalf("%s: expected NODATA with an SOA record, got %d answers and %d authority", qtype, len(ret.Answer), len(ret.Ns))
+		}
+		soa, ok := ret.Ns[0].(*dns.SOA)
+		if !ok {
+			t.Fatalf("%s: expected an SOA record, got %s", qtype, ret.Ns[0])
+		}
+		if soa.Hdr.Name != oe.from || soa.Hdr.Ttl != 20 || soa.Minttl != 20 {
+			t.Errorf("%s: expected the SOA of %s with TTL and minimum 20, got %s", qtype, oe.from, soa)
+		}
+	}
+}
+
+func TestAnswerTTL(t *testing.T) {
+	oe := New()
+	oe.minTTL = 5
+	oe.maxTTL = 300
+
+	tests := []struct {
+		answerTTL uint32
+		age       time.Duration
+		want      uint32
+	}{
+		{0, 0, defaultTTL},
+		{60, 0, 60},
+		{600, 0, 300},
+		{1, 0, 5},
+		{60, 10 * time.Second, 50},
+		{60, 10*time.Second + 900*time.Millisecond, 50},
+		{60, 55 * time.Second, 5},
+		{60, 58 * time.Second, 5},
+		{60, time.Hour, 5},
+		{600, 20 * time.Second, 280},
+		{1, 20 * time.Second, 5},
+	}
+	for _, test := range tests {
+		payload := &codec.Payload{AnswerTTL: test.answerTTL}
+		if got := oe.answerTTL(payload, test.age); got != test.want {
+			t.Errorf("answer TTL %d after %s: expected %d, got %d", test.answerTTL, test.age, test.want, got)
+		}
+	}
+}
+
+func TestAnswerSRVSelection(t *testing.T) {
+	const name = "_http._tcp.nginx.default.svc.cluster.external."
+	oe := New()
+	oe.lat, oe.lon = 55.6050, 13.0038
+	exposed := []codec.Port{{Name: "http", Proto: "tcp", Port: 30080}}
+	payload := &codec.Payload{AnswerTTL: 20, Sites: []codec.EdgeSite{
+		{IP: "10.0.0.1", Lat: 35.6762, Lon: 139.6503, Ports: exposed},
+		{IP: "10.0.0.2", Lat: 55.6761, Lon: 12.5683, Ports: exposed},
+		{IP: "10.0.0.3", Lat: 55.6761, Lon: 12.5683}, // Doesn't expose the port.
+	}}
+
+	r := new(dns.Msg)
+	r.SetQuestion(name, dns.TypeSRV)
+	state := request.Request{W: dnstest.NewRecorder(&test.ResponseWriter{}), Req: r}
+	d := newDecision(state)
+	if _, err := oe.answer(withDecision(context.Background(), d), state, payload, 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(d.Candidates) != 2 {
+		t.Errorf("expected the 2 sites exposing the port as candidates, got %v", d.Candidates)
+	}
+	if len(d.Chosen) != 1 || d.Chosen[0].IP != "10.0.0.2" {
+		t.Errorf("expected the closest site chosen, got %v", d.Chosen)
+	}
+	if d.Origin == nil || d.Answers != 2 {
+		t.Errorf("expected the origin and 2 answers recorded, got %+v", d)
+	}
+}
+
+func TestExtractVerify(t *testing.T) {
+	const name = "nginx.default.svc.cluster.external."
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := &codec.Signer{KeyID: "central1", Key: priv}
+	oe := New()
+	oe.keys = codec.KeySet{"central1": pub}
+	payload := &codec.Payload{TTL: 60, Sites: []codec.EdgeSite{{IP: "10.0.0.1", Lat: 55.6761, Lon: 12.5683}}}
+
+	tests := []struct {
+		name    string
+		reply   func(ret *dns.Msg) error
+		payload bool
+		err     error
+	}{
+		{"signed", func(ret *dns.Msg) error {
+			return signer.SetOption(ret, name, payload, time.Now())
+		}, true, nil},
+		{"unsigned", func(ret *dns.Msg) error {
+			return codec.SetOption(ret, payload)
+		}, false, errUnverified},
+		{"unsigned txt", func(ret *dns.Msg) error {
+			txt, err := codec.TXT(name, dns.ClassINET, payload)
+			ret.Extra = append(ret.Extra, txt)
+			return err
+		}, false, errUnverified},
+		{"signed for another name", func(ret *dns.Msg) error {
+			return signer.SetOption(ret, "other."+name, payload, time.Now())
+		}, false, errUnverified},
+		// Names central doesn't serve go to the next plugin unverified.
+		{"not served", func(ret *dns.Msg) error {
+			ret.Answer = append(ret.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.ParseIP("192.0.2.1"),
+			})
+			return nil
+		}, false, nil},
+	}
+	for _, tc := range tests {
+		r := new(dns.Msg)
+		r.SetQuestion(name, dns.TypeA)
+		codec.Request(r)
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.SetEdns0(dns.DefaultMsgSize, false)
+		if err := tc.reply(ret); err != nil {
+			t.Fatal(err)
+		}
+
+		state := request.Request{W: &test.ResponseWriter{}, Req: r}
+		_, got, err := oe.extract(state, ret)
+		if err != tc.err {
+			t.Errorf("%s: expected error %v, got %v", tc.name, tc.err, err)
+		}
+		if (got != nil) != tc.payload {
+			t.Errorf("%s: expected a payload %t, got %v", tc.name, tc.payload, got)
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"sync/atomic"
 
 	"github.com/miekg/dns"
+	"golang.org/x/net/context"
 )
 
 // For HC we send to . IN NS +norec message to the upstream. Dial timeouts and empty
@@ -26,6 +27,11 @@ func (p *Proxy) send() error {
 	hcping := new(dns.Msg)
 	hcping.SetQuestion(".", dns.TypeNS)
 
+	if p.doh != nil {
+		_, err := p.doh.exchange(context.Background(), hcping)
+		return err
+	}
+
 	m, _, err := p.client.Exchange(hcping, p.addr)
 	// If we got a header, we're alright, basically only care about I/O errors 'n stuff
 	if err != nil && m != nil {
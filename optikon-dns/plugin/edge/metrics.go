@@ -47,6 +47,121 @@ var (
 		Name:      "socket_count_total",
 		Help:      "Gauge of open sockets per upstream.",
 	}, []string{"to"})
+	LocalityCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "optikon-edge",
+		Name:      "locality_count_total",
+		Help:      "Counter of answers pointing to the local (this) or a remote edge site.",
+	}, []string{"locality"})
+	ProbeRTTGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "optikon-edge",
+		Name:      "probe_rtt_seconds",
+		Help:      "Gauge of the moving average of the round trip time per edge site.",
+	}, []string{"site"})
+	ProbeFailureCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "optikon-edge",
+		Name:      "probe_failure_count_total",
+		Help:      "Counter of failed round trip time probes per edge site.",
+	}, []string{"site"})
+	SiteHealthFailureCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "optikon-edge",
+		Name:      "site_healthcheck_failure_count_total",
+		Help:      "Counter of failed service health checks per edge site.",
+	}, []string{"site"})
+	SiteHealthFailOpenCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "optikon-edge",
+		Name:      "site_health_fail_open_count_total",
+		Help:      "Counter of answers given while all edge sites of the service were down.",
+	})
+	ClientSubnetCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "optikon-edge",
+		Name:      "client_subnet_count_total",
+		Help:      "Counter of queries with an ECS option per outcome (located, unknown or skipped).",
+	}, []string{"result"})
+	CacheHitCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "optikon-edge",
+		Name:      "cache_hits_total",
+		Help:      "Counter of edge site cache hits per type (positive, negative or stale).",
+	}, []string{"type"})
+	CacheMissCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "optikon-edge",
+		Name:      "cache_misses_total",
+		Help:      "Counter of edge site cache misses.",
+	})
+	CachePrefetchCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "optikon-edge",
+		Name:      "cache_prefetch_total",
+		Help:      "Counter of edge site cache entries refreshed before expiry.",
+	})
+	CacheSize = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "optikon-edge",
+		Name:      "cache_size",
+		Help:      "Gauge of names in the edge site cache.",
+	})
+	StaleGenerationCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "optikon-edge",
+		Name:      "stale_generation_total",
+		Help:      "Counter of answers from central dropped for an older table generation than already seen.",
+	})
+	StreamConnected = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "optikon-edge",
+		Name:      "stream_connected",
+		Help:      "Gauge that is 1 while queries are answered from the table streamed by central.",
+	})
+	ReplicaSize = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "optikon-edge",
+		Name:      "replica_size",
+		Help:      "Gauge of services in the local replica of the table of central.",
+	})
+	SignatureFailureCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "optikon-edge",
+		Name:      "signature_failures_total",
+		Help:      "Counter of answers from central rejected by signature verification, per reason.",
+	}, []string{"reason"})
+	DegradedCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "optikon-edge",
+		Name:      "degraded_answers_total",
+		Help:      "Counter of queries answered while central is unreachable, per source of the answer.",
+	}, []string{"source"})
+	SelectionCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "optikon-edge",
+		Name:      "selections_total",
+		Help:      "Counter of answers per service and chosen edge site.",
+	}, []string{"service", "site"})
+	SelectionDistance = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "optikon-edge",
+		Name:      "selection_distance_kilometers",
+		Buckets:   []float64{10, 50, 100, 250, 500, 1000, 2500, 5000, 10000, 20000},
+		Help:      "Histogram of the distance from the origin of the query to the chosen edge site.",
+	})
+	TableParseFailureCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "optikon-edge",
+		Name:      "table_parse_failures_total",
+		Help:      "Counter of answers from central without usable edge sites.",
+	})
+	NextCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "optikon-edge",
+		Name:      "next_total",
+		Help:      "Counter of queries passed to the next plugin, per reason.",
+	}, []string{"reason"})
 )
 
 var once sync.Once
@@ -0,0 +1,194 @@
+package edge
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// prober periodically measures the round trip time to every edge site learned
+// from central, keeping an exponentially weighted moving average per site.
+type prober struct {
+	sync.RWMutex
+	sites map[string]*siteRTT // Keyed by IP.
+
+	method   string // "tcp" or "dns".
+	port     string
+	interval time.Duration
+	timeout  time.Duration
+	alpha    float64 // Weight of a new sample in the moving average.
+
+	client *dns.Client
+	stop   chan struct{}
+}
+
+// siteRTT is the moving average of the round trip time to a single site.
+type siteRTT struct {
+	rtt      time.Duration
+	measured bool
+	seen     time.Time // Last time the site was returned by central.
+}
+
+func newProber(method, port string) *prober {
+	p := &prober{
+		sites:    make(map[string]*siteRTT),
+		method:   method,
+		port:     port,
+		interval: defaultProbeInterval,
+		timeout:  defaultProbeTimeout,
+		alpha:    defaultProbeAlpha,
+		stop:     make(chan struct{}),
+	}
+	p.client = &dns.Client{Net: "udp", ReadTimeout: p.timeout, WriteTimeout: p.timeout}
+	return p
+}
+
+// learn makes sure all IPs are probed.
+func (p *prober) learn(ips []string) {
+	now := time.Now()
+
+	// Most of the time all sites are known and were seen recently, don't take
+	// the write lock for those.
+	p.RLock()
+	known := true
+	for _, ip := range ips {
+		s, found := p.sites[ip]
+		if !found || now.Sub(s.seen) > p.interval {
+			known = false
+			break
+		}
+	}
+	p.RUnlock()
+	if known {
+		return
+	}
+
+	p.Lock()
+	for _, ip := range ips {
+		s, found := p.sites[ip]
+		if !found {
+			s = new(siteRTT)
+			p.sites[ip] = s
+		}
+		s.seen = now
+	}
+	p.Unlock()
+}
+
+// RTT returns the moving average of the round trip time to ip, if it has been
+// measured successfully.
+func (p *prober) RTT(ip string) (time.Duration, bool) {
+	p.RLock()
+	defer p.RUnlock()
+	s, found := p.sites[ip]
+	if !found || !s.measured {
+		return 0, false
+	}
+	return s.rtt, true
+}
+
+// start starts the probing goroutine.
+func (p *prober) start() { go p.run() }
+
+// close stops the probing goroutine.
+func (p *prober) close() { close(p.stop) }
+
+func (p *prober) run() {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			p.probeAll()
+		}
+	}
+}
+
+// probeAll probes every known site concurrently and forgets sites central
+// hasn't returned for a while.
+func (p *prober) probeAll() {
+	forget := time.Now().Add(-probeForget * p.interval)
+
+	p.Lock()
+	ips := make([]string, 0, len(p.sites))
+	for ip, s := range p.sites {
+		if s.seen.Before(forget) {
+			delete(p.sites, ip)
+			ProbeRTTGauge.DeleteLabelValues(ip)
+			continue
+		}
+		ips = append(ips, ip)
+	}
+	p.Unlock()
+
+	var wg sync.WaitGroup
+	for _, ip := range ips {
+		wg.Add(1)
+		go func(ip string) {
+			defer wg.Done()
+			rtt, err := p.probe(ip)
+			if err != nil {
+				ProbeFailureCount.WithLabelValues(ip).Add(1)
+				return
+			}
+			p.observe(ip, rtt)
+		}(ip)
+	}
+	wg.Wait()
+}
+
+// observe folds a new sample into the moving average of ip.
+func (p *prober) observe(ip string, rtt time.Duration) {
+	p.Lock()
+	defer p.Unlock()
+	s, found := p.sites[ip]
+	if !found {
+		return
+	}
+	if !s.measured {
+		s.rtt = rtt
+		s.measured = true
+	} else {
+		s.rtt = time.Duration(p.alpha*float64(rtt) + (1-p.alpha)*float64(s.rtt))
+	}
+	ProbeRTTGauge.WithLabelValues(ip).Set(s.rtt.Seconds())
+}
+
+// probe measures a single round trip to ip, either by setting up a TCP
+// connection or by sending a DNS query.
+func (p *prober) probe(ip string) (time.Duration, error) {
+	addr := net.JoinHostPort(ip, p.port)
+
+	if p.method == probeDNS {
+		m := new(dns.Msg)
+		m.SetQuestion(".", dns.TypeNS)
+		_, rtt, err := p.client.Exchange(m, addr)
+		return rtt, err
+	}
+
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", addr, p.timeout)
+	if err != nil {
+		return 0, err
+	}
+	rtt := time.Since(start)
+	conn.Close()
+	return rtt, nil
+}
+
+// Probe methods.
+const (
+	probeTCP = "tcp"
+	probeDNS = "dns"
+)
+
+const (
+	defaultProbeInterval = 5 * time.Second
+	defaultProbeTimeout  = 1 * time.Second
+	defaultProbeAlpha    = 0.3
+	probeForget          = 100 // Intervals after which a site not returned by central is forgotten.
+)
@@ -0,0 +1,130 @@
+package edge
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+
+	"wwwin-github.cisco.com/edge/optikon-dns/plugin/codec"
+)
+
+func TestProberTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	p := newProber(probeTCP, port)
+	p.learn([]string{"127.0.0.1"})
+	if _, ok := p.RTT("127.0.0.1"); ok {
+		t.Errorf("expected no round trip time before probing")
+	}
+	p.probeAll()
+	if rtt, ok := p.RTT("127.0.0.1"); !ok || rtt <= 0 || rtt > p.timeout {
+		t.Errorf("expected a round trip time, got %s, %t", rtt, ok)
+	}
+}
+
+func TestProberDNS(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		w.WriteMsg(m)
+	})}
+	go s.ActivateAndServe()
+	defer s.Shutdown()
+	_, port, _ := net.SplitHostPort(pc.LocalAddr().String())
+
+	p := newProber(probeDNS, port)
+	p.learn([]string{"127.0.0.1"})
+	p.probeAll()
+	if rtt, ok := p.RTT("127.0.0.1"); !ok || rtt <= 0 || rtt > p.timeout {
+		t.Errorf("expected a round trip time, got %s, %t", rtt, ok)
+	}
+}
+
+func TestProberUnreachable(t *testing.T) {
+	// Nothing listens on a port that was just closed.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	ln.Close()
+
+	p := newProber(probeTCP, port)
+	p.learn([]string{"127.0.0.1"})
+	p.probeAll()
+	if rtt, ok := p.RTT("127.0.0.1"); ok {
+		t.Errorf("expected no round trip time for an unreachable site, got %s", rtt)
+	}
+}
+
+func TestProberObserve(t *testing.T) {
+	p := newProber(probeTCP, "80")
+	p.learn([]string{"10.0.0.1"})
+
+	p.observe("10.0.0.1", 10*time.Millisecond)
+	if rtt, _ := p.RTT("10.0.0.1"); rtt != 10*time.Millisecond {
+		t.Errorf("expected the first sample to be taken as is, got %s", rtt)
+	}
+	p.observe("10.0.0.1", 20*time.Millisecond)
+	if rtt, _ := p.RTT("10.0.0.1"); rtt != 13*time.Millisecond {
+		t.Errorf("expected the moving average 13ms, got %s", rtt)
+	}
+
+	// Samples of sites that aren't known are dropped.
+	p.observe("10.0.0.2", 10*time.Millisecond)
+	if _, ok := p.RTT("10.0.0.2"); ok {
+		t.Errorf("expected no round trip time for an unknown site")
+	}
+}
+
+func TestProberForget(t *testing.T) {
+	p := newProber(probeTCP, "9")
+	p.learn([]string{"127.0.0.1", "127.0.0.2"})
+	p.sites["127.0.0.2"].seen = time.Now().Add(-2 * probeForget * p.interval)
+
+	p.probeAll()
+	if _, found := p.sites["127.0.0.1"]; !found {
+		t.Errorf("expected a site seen recently to be kept")
+	}
+	if _, found := p.sites["127.0.0.2"]; found {
+		t.Errorf("expected a site central no longer returns to be forgotten")
+	}
+}
+
+func TestChooseLearnsSelf(t *testing.T) {
+	oe := New()
+	oe.self = net.ParseIP("10.0.0.1")
+	oe.prober = newProber(probeTCP, "80")
+
+	sites := []codec.EdgeSite{{IP: "10.0.0.1"}, {IP: "10.0.0.2", Lat: 55.6761, Lon: 12.5683}}
+	chosen := oe.choose(context.Background(), Query{Lat: 55.6050, Lon: 13.0038}, sites)
+	if len(chosen) != 1 || chosen[0].IP != "10.0.0.1" {
+		t.Errorf("expected this edge site, got %v", siteIPs(chosen))
+	}
+	for _, es := range sites {
+		if _, found := oe.prober.sites[es.IP]; !found {
+			t.Errorf("expected %s to be probed while this edge site is chosen", es.IP)
+		}
+	}
+}
@@ -14,6 +14,8 @@ func protocol(s string) (int, string) {
 		return TLS, s[len(_tls)+3:]
 	case strings.HasPrefix(s, _dns+"://"):
 		return DNS, s[len(_dns)+3:]
+	case strings.HasPrefix(s, _https+"://"):
+		return HTTPS, s[len(_https)+3:]
 	}
 	return DNS, s
 }
@@ -22,9 +24,23 @@ func protocol(s string) (int, string) {
 const (
 	DNS = iota + 1
 	TLS
+	HTTPS
 )
 
 const (
-	_dns = "dns"
-	_tls = "tls"
+	_dns   = "dns"
+	_tls   = "tls"
+	_https = "https"
 )
+
+// splitPath splits the URL path off the address s of an https upstream. The
+// path defaults to /dns-query.
+func splitPath(s string) (string, string) {
+	i := strings.IndexByte(s, '/')
+	if i < 0 {
+		return s, dohPath
+	}
+	return s[:i], s[i:]
+}
+
+const dohPath = "/dns-query"
@@ -18,6 +18,7 @@ type Proxy struct {
 	// Connection caching
 	expire    time.Duration
 	transport *transport
+	doh       *dohTransport // Used instead of transport for https:// upstreams.
 
 	// health checking
 	probe *up.Probe
@@ -57,6 +58,17 @@ func (p *Proxy) SetTLSConfig(cfg *tls.Config) { p.transport.SetTLSConfig(cfg) }
 // SetExpire sets the expire duration in the lower p.transport.
 func (p *Proxy) SetExpire(expire time.Duration) { p.transport.SetExpire(expire) }
 
+// SetDoH makes p send its queries over DNS over HTTPS to url. Call it after
+// SetExpire.
+func (p *Proxy) SetDoH(url string, cfg *tls.Config) error {
+	doh, err := newDoHTransport(url, cfg, p.transport.expire)
+	if err != nil {
+		return err
+	}
+	p.doh = doh
+	return nil
+}
+
 // Dial connects to the host in p with the configured transport.
 func (p *Proxy) Dial(proto string) (*dns.Conn, error) { return p.transport.Dial(proto) }
 
@@ -80,6 +92,9 @@ func (p *Proxy) Down(maxfails uint32) bool {
 func (p *Proxy) close() {
 	p.probe.Stop()
 	p.transport.Stop()
+	if p.doh != nil {
+		p.doh.close()
+	}
 }
 
 // start starts the proxy's healthchecking.
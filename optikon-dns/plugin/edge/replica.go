@@ -0,0 +1,164 @@
+package edge
+
+import (
+	"crypto/tls"
+	"sync"
+	"time"
+
+	"wwwin-github.cisco.com/edge/optikon-dns/plugin/codec"
+	"wwwin-github.cisco.com/edge/optikon-dns/plugin/logging"
+	"wwwin-github.cisco.com/edge/optikon-dns/plugin/stream"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// replica is a local copy of the table of central, kept up to date over the
+// table stream. While it is live queries are answered from it without asking
+// central; while the stream is down queries are forwarded to central again.
+type replica struct {
+	addr      string      // Address of the table stream of central.
+	name      string      // Name of this edge, for the logs of central.
+	tlsConfig *tls.Config // Client certificate and CA of central, nil for plain text.
+
+	sync.RWMutex
+	table      map[string]codec.Service
+	generation uint64
+	live       bool
+
+	log  *logging.Logger
+	stop chan struct{}
+}
+
+func newReplica(addr string, log *logging.Logger) *replica {
+	return &replica{addr: addr, log: log, stop: make(chan struct{})}
+}
+
+// lookup returns the payload for service. live is false while the stream is
+// down, and the payload nil if central doesn't serve the service.
+func (r *replica) lookup(service string) (payload *codec.Payload, live bool) {
+	r.RLock()
+	defer r.RUnlock()
+	if !r.live {
+		return nil, false
+	}
+	svc, found := r.table[service]
+	if !found {
+		return nil, true
+	}
+	return &codec.Payload{Sites: svc.Sites, AnswerTTL: svc.TTL, Generation: r.generation}, true
+}
+
+// status reports the state of the replica for the admin endpoint.
+func (r *replica) status() *replicaStatus {
+	r.RLock()
+	defer r.RUnlock()
+	return &replicaStatus{Addr: r.addr, Live: r.live, Generation: r.generation, Services: len(r.table)}
+}
+
+// start starts following the table stream.
+func (r *replica) start() { go r.run() }
+
+// close stops following the table stream.
+func (r *replica) close() { close(r.stop) }
+
+// run follows the table stream, subscribing again with exponential backoff
+// whenever it breaks.
+func (r *replica) run() {
+	backoff := streamMinBackoff
+	for {
+		received, err := r.follow()
+		r.setLive(false)
+
+		select {
+		case <-r.stop:
+			return
+		default:
+		}
+		r.log.Warningf("table stream from %s broke, asking central per query: %s", r.addr, err)
+
+		if received {
+			backoff = streamMinBackoff
+		}
+		select {
+		case <-r.stop:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > streamMaxBackoff {
+			backoff = streamMaxBackoff
+		}
+	}
+}
+
+// follow subscribes to the table stream and applies the updates until the
+// stream breaks or the replica is closed. It reports whether any update was
+// received.
+func (r *replica) follow() (bool, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-r.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	security := grpc.WithInsecure()
+	if r.tlsConfig != nil {
+		security = grpc.WithTransportCredentials(credentials.NewTLS(r.tlsConfig))
+	}
+	conn, err := grpc.DialContext(ctx, r.addr, security, grpc.WithCodec(stream.Codec{}))
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	sub, err := stream.NewTableClient(conn).Subscribe(ctx, &stream.SubscribeRequest{Edge: r.name})
+	if err != nil {
+		return false, err
+	}
+	received := false
+	for {
+		u, err := sub.Recv()
+		if err != nil {
+			return received, err
+		}
+		r.apply(u)
+		received = true
+	}
+}
+
+// apply applies an update of the stream. Changes can only be applied on top
+// of a snapshot.
+func (r *replica) apply(u *stream.Update) {
+	r.Lock()
+	defer r.Unlock()
+	if !u.Snapshot && !r.live {
+		return
+	}
+	if u.Snapshot && !r.live {
+		r.log.Infof("following the table stream from %s, %d services", r.addr, len(u.Services))
+	}
+	r.table = stream.Apply(r.table, u)
+	r.generation = u.Generation
+	r.live = true
+	StreamConnected.Set(1)
+	ReplicaSize.Set(float64(len(r.table)))
+}
+
+func (r *replica) setLive(live bool) {
+	r.Lock()
+	r.live = live
+	r.Unlock()
+	if !live {
+		StreamConnected.Set(0)
+	}
+}
+
+const (
+	streamMinBackoff = time.Second
+	streamMaxBackoff = 30 * time.Second
+)
@@ -0,0 +1,256 @@
+package edge
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+
+	"wwwin-github.cisco.com/edge/optikon-dns/plugin/codec"
+)
+
+// Query holds everything a SiteSelector may use to pick edge sites.
+type Query struct {
+	Name string `json:"name"` // Name being resolved.
+
+	// Origin distances are measured from.
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+
+	Client net.IP `json:"client,omitempty"` // Address of the client, may be nil.
+	Subnet bool   `json:"subnet"`           // Origin and client were taken from the ECS option.
+}
+
+// SiteSelector defines a strategy for selecting the edge sites to answer with.
+// Select returns the chosen sites, best first; sites is never empty.
+type SiteSelector interface {
+	Select(q Query, sites []codec.EdgeSite) []codec.EdgeSite
+	String() string
+}
+
+// nearest is a selector that picks the edge site closest to the origin.
+type nearest struct{}
+
+func (n *nearest) String() string { return "nearest" }
+
+func (n *nearest) Select(q Query, sites []codec.EdgeSite) []codec.EdgeSite {
+	closest := sites[0]
+	minDist := Distance(q.Lat, q.Lon, sites[0].Lat, sites[0].Lon)
+	for _, es := range sites[1:] {
+		dist := Distance(q.Lat, q.Lon, es.Lat, es.Lon)
+		if dist < minDist {
+			minDist = dist
+			closest = es
+		}
+	}
+	return []codec.EdgeSite{closest}
+}
+
+// weightedRandom is a selector that picks a random edge site, with the
+// probability of each site inversely proportional to its distance.
+type weightedRandom struct{}
+
+func (w *weightedRandom) String() string { return "weighted_random" }
+
+func (w *weightedRandom) Select(q Query, sites []codec.EdgeSite) []codec.EdgeSite {
+	weights := make([]float64, len(sites))
+	for i, es := range sites {
+		weights[i] = 1 / (Distance(q.Lat, q.Lon, es.Lat, es.Lon) + minDistance)
+	}
+	return []codec.EdgeSite{sites[pickWeighted(weights)]}
+}
+
+// topN is a selector that returns the n edge sites closest to the origin.
+type topN struct {
+	n int
+}
+
+func (t *topN) String() string { return "top" }
+
+func (t *topN) Select(q Query, sites []codec.EdgeSite) []codec.EdgeSite {
+	sorted := byDistance(q, sites)
+	if len(sorted) > t.n {
+		sorted = sorted[:t.n]
+	}
+	return sorted
+}
+
+// capacity is a selector that picks a random edge site, with the probability
+// of each site proportional to its weight. Without any weights it falls back
+// to the nearest site.
+type capacity struct{}
+
+func (c *capacity) String() string { return "capacity" }
+
+func (c *capacity) Select(q Query, sites []codec.EdgeSite) []codec.EdgeSite {
+	weights := make([]float64, len(sites))
+	total := 0.0
+	for i, es := range sites {
+		weights[i] = float64(es.Weight)
+		total += weights[i]
+	}
+	if total == 0 {
+		return (&nearest{}).Select(q, sites)
+	}
+	return []codec.EdgeSite{sites[pickWeighted(weights)]}
+}
+
+// consistentHash is a selector that maps each client subnet to the same edge
+// site, so caches on the sites stay warm. It uses rendezvous hashing, when a
+// site goes away only the subnets mapped to it move.
+type consistentHash struct{}
+
+func (h *consistentHash) String() string { return "consistent_hash" }
+
+func (h *consistentHash) Select(q Query, sites []codec.EdgeSite) []codec.EdgeSite {
+	if q.Client == nil {
+		return (&nearest{}).Select(q, sites)
+	}
+	subnet := clientSubnet(q.Client)
+
+	best := 0
+	var bestScore uint64
+	for i, es := range sites {
+		f := fnv.New64a()
+		f.Write(subnet)
+		f.Write([]byte(es.IP))
+		if score := f.Sum64(); i == 0 || score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+	return []codec.EdgeSite{sites[best]}
+}
+
+// ParseSelection returns the selector configured by the arguments of the
+// selection property: the strategy followed by its parameters, e.g. "top 2".
+// The latency selector measures nothing by itself, the edge connects it to its
+// prober.
+func ParseSelection(args []string) (SiteSelector, error) {
+	if len(args) == 0 {
+		return nil, errSelectionArgs
+	}
+	var selector SiteSelector
+	switch x := args[0]; x {
+	case "nearest":
+		selector = &nearest{}
+	case "weighted_random":
+		selector = &weightedRandom{}
+	case "top":
+		if len(args) != 2 {
+			return nil, errSelectionArgs
+		}
+		n, err := strconv.Atoi(args[1])
+		if err != nil {
+			return nil, err
+		}
+		if n <= 0 {
+			return nil, fmt.Errorf("top must be positive: %d", n)
+		}
+		return &topN{n: n}, nil
+	case "capacity":
+		selector = &capacity{}
+	case "consistent_hash":
+		selector = &consistentHash{}
+	case "latency":
+		selector = &latency{}
+	default:
+		return nil, fmt.Errorf("unknown selection '%s'", x)
+	}
+	if len(args) > 1 {
+		return nil, errSelectionArgs
+	}
+	return selector, nil
+}
+
+// latency is a selector that picks the edge site with the lowest measured
+// round trip time. Sites whose round trip times are within latencyTolerance of
+// each other, or haven't been measured yet, are ordered by distance.
+type latency struct {
+	p *prober
+}
+
+func (l *latency) String() string { return "latency" }
+
+func (l *latency) Select(q Query, sites []codec.EdgeSite) []codec.EdgeSite {
+	best := sites[0]
+	bestBucket, bestMeasured := l.bucket(best)
+	bestDist := Distance(q.Lat, q.Lon, best.Lat, best.Lon)
+	for _, es := range sites[1:] {
+		bucket, measured := l.bucket(es)
+		dist := Distance(q.Lat, q.Lon, es.Lat, es.Lon)
+
+		better := false
+		switch {
+		case measured != bestMeasured:
+			better = measured
+		case measured && bucket != bestBucket:
+			better = bucket < bestBucket
+		default:
+			better = dist < bestDist
+		}
+		if better {
+			best, bestBucket, bestMeasured, bestDist = es, bucket, measured, dist
+		}
+	}
+	return []codec.EdgeSite{best}
+}
+
+// bucket returns the round trip time to es in units of latencyTolerance.
+func (l *latency) bucket(es codec.EdgeSite) (int64, bool) {
+	rtt, ok := l.p.RTT(es.IP)
+	if !ok {
+		return 0, false
+	}
+	return int64(rtt / latencyTolerance), true
+}
+
+// clientSubnet masks ip to the subnet used for affinity, a /24 for IPv4 and a
+// /56 for IPv6.
+func clientSubnet(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32))
+	}
+	return ip.Mask(net.CIDRMask(56, 128))
+}
+
+// byDistance returns a copy of sites sorted by distance to the origin.
+func byDistance(q Query, sites []codec.EdgeSite) []codec.EdgeSite {
+	sorted := make([]codec.EdgeSite, len(sites))
+	copy(sorted, sites)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return Distance(q.Lat, q.Lon, sorted[i].Lat, sorted[i].Lon) < Distance(q.Lat, q.Lon, sorted[j].Lat, sorted[j].Lon)
+	})
+	return sorted
+}
+
+// pickWeighted returns a random index into weights, with the probability of
+// each index proportional to its weight.
+func pickWeighted(weights []float64) int {
+	total := 0.0
+	for _, w := range weights {
+		total += w
+	}
+	r := randFloat() * total
+	for i, w := range weights {
+		r -= w
+		if r < 0 {
+			return i
+		}
+	}
+	return len(weights) - 1
+}
+
+// randFloat returns a random number in [0, 1) for the random selectors, tests
+// replace it with a seeded source.
+var randFloat = rand.Float64
+
+const (
+	// minDistance keeps weights finite for sites at the origin, in kilometers.
+	minDistance = 1
+	// latencyTolerance is the difference in round trip time below which sites
+	// are considered equally fast.
+	latencyTolerance = time.Millisecond
+)
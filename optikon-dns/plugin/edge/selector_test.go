@@ -0,0 +1,249 @@
+package edge
+
+import (
+	"math/rand"
+	"net"
+	"reflect"
+	"testing"
+
+	"wwwin-github.cisco.com/edge/optikon-dns/plugin/codec"
+)
+
+var (
+	copenhagen = codec.EdgeSite{IP: "10.0.0.1", Lat: 55.6761, Lon: 12.5683}
+	newYork    = codec.EdgeSite{IP: "10.0.0.2", Lat: 40.7128, Lon: -74.0060}
+	tokyo      = codec.EdgeSite{IP: "10.0.0.3", Lat: 35.6895, Lon: 139.6917}
+
+	testSites = []codec.EdgeSite{copenhagen, newYork, tokyo}
+
+	malmo  = Query{Name: "nginx.default.svc.cluster.external.", Lat: 55.6050, Lon: 13.0038}
+	boston = Query{Name: "nginx.default.svc.cluster.external.", Lat: 42.3601, Lon: -71.0589}
+	osaka  = Query{Name: "nginx.default.svc.cluster.external.", Lat: 34.6937, Lon: 135.5023}
+)
+
+// seedRandom makes the random selectors deterministic until the returned
+// function is called.
+func seedRandom(seed int64) func() {
+	saved := randFloat
+	randFloat = rand.New(rand.NewSource(seed)).Float64
+	return func() { randFloat = saved }
+}
+
+func siteIPs(sites []codec.EdgeSite) []string {
+	ips := make([]string, len(sites))
+	for i, es := range sites {
+		ips[i] = es.IP
+	}
+	return ips
+}
+
+func TestNearest(t *testing.T) {
+	tests := []struct {
+		q     Query
+		sites []codec.EdgeSite
+		want  string
+	}{
+		{malmo, testSites, copenhagen.IP},
+		{boston, testSites, newYork.IP},
+		{osaka, testSites, tokyo.IP},
+		{osaka, []codec.EdgeSite{copenhagen, newYork}, copenhagen.IP},
+		{malmo, []codec.EdgeSite{tokyo}, tokyo.IP},
+		// Ties go to the first site.
+		{malmo, []codec.EdgeSite{{IP: "10.0.0.4", Lat: 55.6761, Lon: 12.5683}, copenhagen}, "10.0.0.4"},
+	}
+	for i, test := range tests {
+		got := (&nearest{}).Select(test.q, test.sites)
+		if len(got) != 1 || got[0].IP != test.want {
+			t.Errorf("test %d: expected %s, got %v", i, test.want, siteIPs(got))
+		}
+	}
+}
+
+func TestTopN(t *testing.T) {
+	tests := []struct {
+		n    int
+		q    Query
+		want []string
+	}{
+		{1, malmo, []string{copenhagen.IP}},
+		{2, malmo, []string{copenhagen.IP, newYork.IP}},
+		{2, osaka, []string{tokyo.IP, copenhagen.IP}},
+		{3, boston, []string{newYork.IP, copenhagen.IP, tokyo.IP}},
+		{5, boston, []string{newYork.IP, copenhagen.IP, tokyo.IP}},
+	}
+	for _, test := range tests {
+		sites := append([]codec.EdgeSite(nil), testSites...)
+		got := (&topN{n: test.n}).Select(test.q, sites)
+		if !reflect.DeepEqual(siteIPs(got), test.want) {
+			t.Errorf("top %d from %v: expected %v, got %v", test.n, test.q, test.want, siteIPs(got))
+		}
+		if !reflect.DeepEqual(sites, testSites) {
+			t.Errorf("top %d: the sites were reordered", test.n)
+		}
+	}
+}
+
+func TestCapacity(t *testing.T) {
+	defer seedRandom(1)()
+
+	// Without weights the nearest site is picked.
+	if got := (&capacity{}).Select(osaka, testSites); got[0].IP != tokyo.IP {
+		t.Errorf("expected the nearest site %s without weights, got %s", tokyo.IP, got[0].IP)
+	}
+
+	// Sites without a weight are never picked when others have one.
+	weighted := []codec.EdgeSite{copenhagen, newYork, tokyo}
+	weighted[1].Weight = 1
+	for i := 0; i < 100; i++ {
+		if got := (&capacity{}).Select(malmo, weighted); got[0].IP != newYork.IP {
+			t.Fatalf("expected the only weighted site %s, got %s", newYork.IP, got[0].IP)
+		}
+	}
+
+	// Otherwise sites are picked in proportion to their weight.
+	weighted[0].Weight = 1
+	weighted[1].Weight = 3
+	weighted[2].Weight = 6
+	picks := pickCounts(&capacity{}, malmo, weighted, 10000)
+	for _, es := range weighted {
+		want := 10000 * float64(es.Weight) / 10
+		if got := float64(picks[es.IP]); got < want*0.9 || got > want*1.1 {
+			t.Errorf("expected %s about %.0f times, got %.0f", es.IP, want, got)
+		}
+	}
+}
+
+func TestWeightedRandom(t *testing.T) {
+	defer seedRandom(1)()
+
+	// Sites are picked in inverse proportion to their distance.
+	far := []codec.EdgeSite{newYork, tokyo}
+	picks := pickCounts(&weightedRandom{}, malmo, far, 10000)
+	toNewYork := 1 / Distance(malmo.Lat, malmo.Lon, newYork.Lat, newYork.Lon)
+	toTokyo := 1 / Distance(malmo.Lat, malmo.Lon, tokyo.Lat, tokyo.Lon)
+	want := 10000 * toNewYork / (toNewYork + toTokyo)
+	if got := float64(picks[newYork.IP]); got < want*0.95 || got > want*1.05 {
+		t.Errorf("expected %s about %.0f times, got %.0f", newYork.IP, want, got)
+	}
+
+	// A site at the origin all but always wins.
+	here := codec.EdgeSite{IP: "10.0.0.4", Lat: malmo.Lat, Lon: malmo.Lon}
+	picks = pickCounts(&weightedRandom{}, malmo, append([]codec.EdgeSite{here}, testSites...), 1000)
+	if picks[here.IP] < 950 {
+		t.Errorf("expected the site at the origin to be picked nearly always, got %v", picks)
+	}
+
+	// The same seed picks the same sites.
+	seedRandom(7)
+	first := pickSequence(&weightedRandom{}, boston, testSites, 20)
+	seedRandom(7)
+	if second := pickSequence(&weightedRandom{}, boston, testSites, 20); !reflect.DeepEqual(first, second) {
+		t.Errorf("expected the same picks for the same seed, got %v and %v", first, second)
+	}
+}
+
+func TestConsistentHash(t *testing.T) {
+	h := &consistentHash{}
+
+	// Without a client the nearest site is picked.
+	if got := h.Select(boston, testSites); got[0].IP != newYork.IP {
+		t.Errorf("expected the nearest site %s without a client, got %s", newYork.IP, got[0].IP)
+	}
+
+	clients := []string{"192.0.2.1", "198.51.100.7", "203.0.113.200", "2001:db8:1::1", "2001:db8:2::1"}
+	for _, client := range clients {
+		q := malmo
+		q.Client = net.ParseIP(client)
+		chosen := h.Select(q, testSites)[0]
+
+		// The same subnet maps to the same site, wherever it is.
+		neighbor := osaka
+		neighbor.Client = sameSubnet(q.Client)
+		if got := h.Select(neighbor, testSites)[0]; got.IP != chosen.IP {
+			t.Errorf("%s: expected %s for %s in the same subnet, got %s", client, chosen.IP, neighbor.Client, got.IP)
+		}
+
+		// The order of the sites doesn't matter.
+		reversed := []codec.EdgeSite{testSites[2], testSites[1], testSites[0]}
+		if got := h.Select(q, reversed)[0]; got.IP != chosen.IP {
+			t.Errorf("%s: expected %s with the sites reversed, got %s", client, chosen.IP, got.IP)
+		}
+
+		// Removing another site doesn't move the subnet.
+		var rest []codec.EdgeSite
+		removed := false
+		for _, es := range testSites {
+			if es.IP != chosen.IP && !removed {
+				removed = true
+				continue
+			}
+			rest = append(rest, es)
+		}
+		if got := h.Select(q, rest)[0]; got.IP != chosen.IP {
+			t.Errorf("%s: expected %s after removing another site, got %s", client, chosen.IP, got.IP)
+		}
+	}
+}
+
+func TestParseSelection(t *testing.T) {
+	tests := []struct {
+		args []string
+		want string
+		err  bool
+	}{
+		{[]string{"nearest"}, "nearest", false},
+		{[]string{"weighted_random"}, "weighted_random", false},
+		{[]string{"top", "2"}, "top", false},
+		{[]string{"capacity"}, "capacity", false},
+		{[]string{"consistent_hash"}, "consistent_hash", false},
+		{[]string{"latency"}, "latency", false},
+		{nil, "", true},
+		{[]string{"top"}, "", true},
+		{[]string{"top", "0"}, "", true},
+		{[]string{"top", "two"}, "", true},
+		{[]string{"nearest", "2"}, "", true},
+		{[]string{"closest"}, "", true},
+	}
+	for _, test := range tests {
+		selector, err := ParseSelection(test.args)
+		if test.err {
+			if err == nil {
+				t.Errorf("%v: expected an error", test.args)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %s", test.args, err)
+			continue
+		}
+		if selector.String() != test.want {
+			t.Errorf("%v: expected %s, got %s", test.args, test.want, selector)
+		}
+	}
+}
+
+// pickCounts returns how often each site is picked by s in n queries.
+func pickCounts(s SiteSelector, q Query, sites []codec.EdgeSite, n int) map[string]int {
+	picks := make(map[string]int)
+	for i := 0; i < n; i++ {
+		picks[s.Select(q, sites)[0].IP]++
+	}
+	return picks
+}
+
+// pickSequence returns the sites picked by s in n queries.
+func pickSequence(s SiteSelector, q Query, sites []codec.EdgeSite, n int) []string {
+	seq := make([]string, n)
+	for i := range seq {
+		seq[i] = s.Select(q, sites)[0].IP
+	}
+	return seq
+}
+
+// sameSubnet returns another address in the affinity subnet of ip.
+func sameSubnet(ip net.IP) net.IP {
+	other := make(net.IP, len(ip))
+	copy(other, ip)
+	other[len(other)-1] ^= 0x0f
+	return other
+}
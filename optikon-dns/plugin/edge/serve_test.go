@@ -0,0 +1,133 @@
+package edge
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+
+	"wwwin-github.cisco.com/edge/optikon-dns/plugin/codec"
+)
+
+func TestServeNotServed(t *testing.T) {
+	const name = "nginx.default.svc.cluster.local."
+
+	// Central passes names it doesn't serve to its next plugin, which answers
+	// NXDOMAIN or NODATA, and returns that without a payload.
+	for _, rcode := range []int{dns.RcodeNameError, dns.RcodeSuccess} {
+		var queries int32
+		srv := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+			atomic.AddInt32(&queries, 1)
+			ret := new(dns.Msg)
+			ret.SetRcode(r, rcode)
+			w.WriteMsg(ret)
+		})
+
+		oe := New()
+		oe.cache = newSiteCache()
+		oe.Next = test.NextHandler(rcode, nil)
+		p := NewProxy(srv.Addr, nil)
+		oe.proxies = append(oe.proxies, p)
+
+		for i := 0; i < 2; i++ {
+			r := new(dns.Msg)
+			r.SetQuestion(name, dns.TypeA)
+			got, err := oe.ServeDNS(context.Background(), dnstest.NewRecorder(&test.ResponseWriter{}), r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != rcode {
+				t.Errorf("%s: expected the rcode of the next plugin, got %s", dns.RcodeToString[rcode], dns.RcodeToString[got])
+			}
+		}
+		if n := atomic.LoadInt32(&queries); n != 1 {
+			t.Errorf("%s: expected the second query answered from the negative cache, central got %d", dns.RcodeToString[rcode], n)
+		}
+		e, found := oe.cache.get(codec.ParseName(name).Service, time.Now())
+		if !found || !e.negative {
+			t.Errorf("%s: expected a negative cache entry, got %v", dns.RcodeToString[rcode], e)
+		}
+
+		p.transport.Stop()
+		srv.Close()
+	}
+}
+
+func TestServeMalformed(t *testing.T) {
+	const name = "nginx.default.svc.cluster.external."
+	srv := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.Extra = append(ret.Extra, &dns.TXT{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 30},
+			Txt: []string{`[{"ip": "10.0.0.1", "lat": `},
+		})
+		w.WriteMsg(ret)
+	})
+	defer srv.Close()
+
+	oe := New()
+	p := NewProxy(srv.Addr, nil)
+	defer p.transport.Stop()
+	oe.proxies = append(oe.proxies, p)
+
+	r := new(dns.Msg)
+	r.SetQuestion(name, dns.TypeA)
+	state := request.Request{W: &test.ResponseWriter{}, Req: r}
+	if _, _, err := oe.resolve(context.Background(), state); err != errTableParseFailure {
+		t.Errorf("expected %v for edge sites that don't decode, got %v", errTableParseFailure, err)
+	}
+}
+
+// TestPrefetch checks that a cache hit close to expiry refreshes the entry in
+// the background. Run it with -race: the refresh must not share the request
+// with the answer.
+func TestPrefetch(t *testing.T) {
+	const name = "nginx.default.svc.cluster.external."
+	site := codec.EdgeSite{IP: "10.0.0.1", Lat: 55.6761, Lon: 12.5683}
+	srv := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.SetEdns0(dns.DefaultMsgSize, false)
+		codec.SetOption(ret, &codec.Payload{TTL: 60, Generation: 2, Sites: []codec.EdgeSite{site}})
+		w.WriteMsg(ret)
+	})
+	defer srv.Close()
+
+	oe := New()
+	oe.cache = newSiteCache()
+	oe.cache.prefetch = 1 // Every hit refreshes its entry.
+	p := NewProxy(srv.Addr, nil)
+	defer p.transport.Stop()
+	oe.proxies = append(oe.proxies, p)
+
+	service := codec.ParseName(name).Service
+	oe.cache.set(service, &codec.Payload{TTL: 60, Generation: 1, Sites: []codec.EdgeSite{site}}, time.Now())
+
+	r := new(dns.Msg)
+	r.SetQuestion(name, dns.TypeA)
+	r.SetEdns0(4096, true)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := oe.ServeDNS(context.Background(), rec, r); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Msg == nil || len(rec.Msg.Answer) != 1 {
+		t.Fatalf("expected a single answer from the cache, got %v", rec.Msg)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if e, found := oe.cache.get(service, time.Now()); found && e.payload.Generation == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the entry refreshed by the prefetch")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -3,7 +3,10 @@ package edge
 import (
 	"fmt"
 	"net"
+	"net/http"
+	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/coredns/coredns/core/dnsserver"
@@ -12,6 +15,9 @@ import (
 	"github.com/coredns/coredns/plugin/pkg/dnsutil"
 	pkgtls "github.com/coredns/coredns/plugin/pkg/tls"
 
+	"wwwin-github.cisco.com/edge/optikon-dns/plugin/codec"
+	"wwwin-github.cisco.com/edge/optikon-dns/plugin/logging"
+
 	"github.com/mholt/caddy"
 )
 
@@ -44,7 +50,12 @@ func setup(c *caddy.Controller) error {
 	// Register Prometheus metrics.
 	c.OnStartup(func() error {
 		once.Do(func() {
-			metrics.MustRegister(c, RequestCount, RcodeCount, RequestDuration, HealthcheckFailureCount, SocketGauge)
+			metrics.MustRegister(c, RequestCount, RcodeCount, RequestDuration, HealthcheckFailureCount,
+				HealthcheckBrokenCount, SocketGauge,
+				LocalityCount, ProbeRTTGauge, ProbeFailureCount, SiteHealthFailureCount, SiteHealthFailOpenCount,
+				ClientSubnetCount, CacheHitCount, CacheMissCount, CachePrefetchCount, CacheSize, StaleGenerationCount,
+				StreamConnected, ReplicaSize, SignatureFailureCount, DegradedCount,
+				SelectionCount, SelectionDistance, TableParseFailureCount, NextCount)
 		})
 		return oe.OnStartup()
 	})
@@ -56,19 +67,57 @@ func setup(c *caddy.Controller) error {
 	return nil
 }
 
-// OnStartup starts a goroutines for all proxies.
+// OnStartup starts a goroutines for all proxies, the prober, the site health
+// checks and following the table stream, and opens the decision log and the
+// admin endpoint.
 func (oe *OptikonEdge) OnStartup() (err error) {
 	for _, p := range oe.proxies {
 		p.start(oe.hcInterval)
 	}
+	if oe.prober != nil {
+		oe.prober.start()
+	}
+	if oe.health != nil {
+		oe.health.start()
+	}
+	if oe.replica != nil {
+		oe.replica.start()
+	}
+	if oe.decisions != nil {
+		if err := oe.decisions.open(); err != nil {
+			return err
+		}
+	}
+	if oe.admin != nil {
+		return oe.startAdmin()
+	}
 	return nil
 }
 
-// OnShutdown stops all configured proxies.
+// OnShutdown stops all configured proxies, the prober, the site health checks,
+// following the table stream, the decision log and the admin endpoint.
 func (oe *OptikonEdge) OnShutdown() error {
 	for _, p := range oe.proxies {
 		p.close()
 	}
+	if oe.prober != nil {
+		oe.prober.close()
+	}
+	if oe.health != nil {
+		oe.health.close()
+	}
+	if oe.replica != nil {
+		oe.replica.close()
+	}
+	if oe.geo != nil {
+		oe.geo.Close()
+	}
+	if oe.decisions != nil {
+		oe.decisions.close()
+	}
+	if oe.admin != nil {
+		return oe.stopAdmin()
+	}
 	return nil
 }
 
@@ -82,6 +131,7 @@ func parseOptikonEdge(c *caddy.Controller) (*OptikonEdge, error) {
 	oe := New()
 
 	protocols := map[int]int{}
+	paths := map[int]string{} // URL paths of https upstreams.
 
 	i := 0
 	for c.Next() {
@@ -124,8 +174,12 @@ func parseOptikonEdge(c *caddy.Controller) (*OptikonEdge, error) {
 
 		// A bit fiddly, but first check if we've got protocols and if so add them back in when we create the proxies.
 		protocols = make(map[int]int)
+		paths = make(map[int]string)
 		for i := range to {
 			protocols[i], to[i] = protocol(to[i])
+			if protocols[i] == HTTPS {
+				to[i], paths[i] = splitPath(to[i])
+			}
 		}
 
 		// If parseHostPortOrFile expands a file with a lot of nameserver our accounting in protocols doesn't make
@@ -151,6 +205,14 @@ func parseOptikonEdge(c *caddy.Controller) (*OptikonEdge, error) {
 				if p == "53" {
 					h = net.JoinHostPort(h1, "853")
 				}
+			case HTTPS:
+				h1, p, err := net.SplitHostPort(h)
+				if err != nil {
+					break
+				}
+				if p == "53" {
+					h = net.JoinHostPort(h1, "443")
+				}
 			}
 
 			// We can't set tlsConfig here, because we haven't parsed it yet.
@@ -166,6 +228,35 @@ func parseOptikonEdge(c *caddy.Controller) (*OptikonEdge, error) {
 		}
 	}
 
+	if oe.minTTL > oe.maxTTL {
+		return oe, errTTLRange
+	}
+
+	// probe_interval may come before probe, the prober only has a method once
+	// both are read.
+	if oe.prober != nil && oe.prober.method == "" {
+		return oe, errIntervalNoProbe
+	}
+
+	// The table stream isn't signed, only TLS authenticates it.
+	if oe.keys != nil && oe.replica != nil && oe.replica.tlsConfig == nil {
+		return oe, errVerifyStream
+	}
+
+	if oe.health != nil && oe.health.reportURL != "" {
+		oe.health.reporter = reporterName(oe.self)
+	}
+	if oe.replica != nil {
+		oe.replica.name = reporterName(oe.self)
+	}
+
+	if l, ok := oe.selector.(*latency); ok {
+		if oe.prober == nil {
+			return oe, errLatencyNoProbe
+		}
+		l.p = oe.prober
+	}
+
 	if oe.tlsServerName != "" {
 		oe.tlsConfig.ServerName = oe.tlsServerName
 	}
@@ -175,6 +266,12 @@ func parseOptikonEdge(c *caddy.Controller) (*OptikonEdge, error) {
 			oe.proxies[i].SetTLSConfig(oe.tlsConfig)
 		}
 		oe.proxies[i].SetExpire(oe.expire)
+		if protocols[i] == HTTPS {
+			url := "https://" + oe.proxies[i].addr + paths[i]
+			if err := oe.proxies[i].SetDoH(url, oe.tlsConfig); err != nil {
+				return oe, err
+			}
+		}
 	}
 	return oe, nil
 }
@@ -219,6 +316,72 @@ func parseBlock(c *caddy.Controller, oe *OptikonEdge) error {
 			return c.ArgErr()
 		}
 		oe.forceTCP = true
+	case "reconcile":
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		oe.reconcile = true
+	case "stream":
+		args := c.RemainingArgs()
+		if len(args) != 1 && len(args) != 4 {
+			return c.ArgErr()
+		}
+		oe.replica = newReplica(args[0], oe.log)
+		if len(args) == 4 {
+			tlsConfig, err := pkgtls.NewTLSConfig(args[1], args[2], args[3])
+			if err != nil {
+				return err
+			}
+			oe.replica.tlsConfig = tlsConfig
+		}
+	case "verify":
+		files := c.RemainingArgs()
+		if len(files) == 0 {
+			return c.ArgErr()
+		}
+		keys, err := codec.LoadKeySet(files...)
+		if err != nil {
+			return err
+		}
+		oe.keys = keys
+	case "admin":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		addr := c.Val()
+		// Without a host the endpoint only listens on the loopback interface,
+		// it has no authentication and explaining a query asks central.
+		if host, port, err := net.SplitHostPort(addr); err == nil && host == "" {
+			addr = net.JoinHostPort("localhost", port)
+		}
+		oe.admin = &admin{addr: addr}
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+	case "fallback":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		table, err := codec.LoadTable(c.Val())
+		if err != nil {
+			return err
+		}
+		oe.fallback = table
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+	case "max_age":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		dur, err := time.ParseDuration(c.Val())
+		if err != nil {
+			return err
+		}
+		if dur < 0 {
+			return fmt.Errorf("max_age can't be negative: %s", dur)
+		}
+		oe.maxAge = dur
 	case "tls":
 		args := c.RemainingArgs()
 		if len(args) > 3 {
@@ -259,6 +422,250 @@ func parseBlock(c *caddy.Controller, oe *OptikonEdge) error {
 		default:
 			return c.Errf("unknown policy '%s'", x)
 		}
+	case "selection":
+		selector, err := ParseSelection(c.RemainingArgs())
+		if err == errSelectionArgs {
+			return c.ArgErr()
+		}
+		if err != nil {
+			return err
+		}
+		oe.selector = selector
+	case "probe":
+		args := c.RemainingArgs()
+		if len(args) == 0 || len(args) > 2 {
+			return c.ArgErr()
+		}
+		port := ""
+		switch args[0] {
+		case probeTCP:
+			if len(args) != 2 {
+				return c.ArgErr()
+			}
+			port = args[1]
+		case probeDNS:
+			port = "53"
+			if len(args) == 2 {
+				port = args[1]
+			}
+		default:
+			return c.Errf("unknown probe method '%s'", args[0])
+		}
+		if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			return fmt.Errorf("invalid probe port: %s", port)
+		}
+		p := newProber(args[0], port)
+		if oe.prober != nil {
+			// probe_interval came first.
+			p.interval = oe.prober.interval
+		}
+		oe.prober = p
+	case "probe_interval":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		dur, err := time.ParseDuration(c.Val())
+		if err != nil {
+			return err
+		}
+		if dur <= 0 {
+			return fmt.Errorf("probe_interval must be positive: %s", dur)
+		}
+		if oe.prober == nil {
+			// Holds the interval until probe is read, see parseOptikonEdge.
+			oe.prober = newProber("", "")
+		}
+		oe.prober.interval = dur
+	case "site_health":
+		args := c.RemainingArgs()
+		if len(args) > 1 {
+			return c.ArgErr()
+		}
+		oe.enableSiteHealth()
+		if len(args) == 1 {
+			dur, err := time.ParseDuration(args[0])
+			if err != nil {
+				return err
+			}
+			if dur <= 0 {
+				return fmt.Errorf("site_health must be positive: %s", dur)
+			}
+			oe.health.interval = dur
+		}
+	case "site_health_report":
+		args := c.RemainingArgs()
+		if len(args) != 1 && len(args) != 2 {
+			return c.ArgErr()
+		}
+		oe.enableSiteHealth()
+		oe.health.reportURL = strings.TrimSuffix(args[0], "/")
+		if len(args) == 2 {
+			token, err := readToken(args[1])
+			if err != nil {
+				return err
+			}
+			oe.health.reportToken = token
+		}
+	case "site_health_tls":
+		args := c.RemainingArgs()
+		if len(args) != 2 && len(args) != 3 {
+			return c.ArgErr()
+		}
+		tlsConfig, err := pkgtls.NewTLSConfigFromArgs(args...)
+		if err != nil {
+			return err
+		}
+		oe.enableSiteHealth()
+		oe.health.reportClient.Transport = &http.Transport{TLSClientConfig: tlsConfig}
+	case "ecs":
+		args := c.RemainingArgs()
+		if len(args) != 2 {
+			return c.ArgErr()
+		}
+		var err error
+		switch args[0] {
+		case "mmdb":
+			oe.geo, err = newMMDBLocator(args[1])
+		case "cidr":
+			oe.geo, err = newCIDRLocator(args[1])
+		default:
+			return c.Errf("unknown ecs database '%s'", args[0])
+		}
+		if err != nil {
+			return err
+		}
+	case "self":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		ip := net.ParseIP(c.Val())
+		if ip == nil {
+			return fmt.Errorf("not an IP address: %s", c.Val())
+		}
+		oe.self = ip
+	case "cache":
+		oe.enableCache()
+		args := c.RemainingArgs()
+		if len(args) > 1 {
+			return c.ArgErr()
+		}
+		if len(args) == 1 {
+			n, err := strconv.Atoi(args[0])
+			if err != nil {
+				return err
+			}
+			if n <= 0 {
+				return fmt.Errorf("cache capacity must be positive: %d", n)
+			}
+			oe.cache.capacity = n
+		}
+	case "negative_ttl":
+		oe.enableCache()
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		dur, err := time.ParseDuration(c.Val())
+		if err != nil {
+			return err
+		}
+		if dur < 0 {
+			return fmt.Errorf("negative_ttl can't be negative: %s", dur)
+		}
+		oe.cache.negTTL = dur
+	case "prefetch":
+		oe.enableCache()
+		args := c.RemainingArgs()
+		if len(args) > 1 {
+			return c.ArgErr()
+		}
+		oe.cache.prefetch = defaultPrefetch
+		if len(args) == 1 {
+			pct, err := strconv.Atoi(strings.TrimSuffix(args[0], "%"))
+			if err != nil {
+				return err
+			}
+			if pct <= 0 || pct >= 100 {
+				return fmt.Errorf("prefetch percentage should fall in range [1, 99]: %d", pct)
+			}
+			oe.cache.prefetch = float64(pct) / 100
+		}
+	case "serve_stale":
+		oe.enableCache()
+		args := c.RemainingArgs()
+		if len(args) > 1 {
+			return c.ArgErr()
+		}
+		oe.cache.maxStale = defaultMaxStale
+		if len(args) == 1 {
+			dur, err := time.ParseDuration(args[0])
+			if err != nil {
+				return err
+			}
+			if dur < 0 {
+				return fmt.Errorf("serve_stale can't be negative: %s", dur)
+			}
+			oe.cache.maxStale = dur
+		}
+	case "ttl", "min_ttl", "max_ttl":
+		property := c.Val()
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		dur, err := time.ParseDuration(c.Val())
+		if err != nil {
+			return err
+		}
+		if dur < 0 {
+			return fmt.Errorf("%s can't be negative: %s", property, dur)
+		}
+		ttl := uint32(dur.Seconds())
+		switch property {
+		case "ttl":
+			oe.ttl = ttl
+		case "min_ttl":
+			oe.minTTL = ttl
+		case "max_ttl":
+			oe.maxTTL = ttl
+		}
+
+	case "decision_log":
+		args := c.RemainingArgs()
+		if len(args) == 0 || len(args) > 2 {
+			return c.ArgErr()
+		}
+		sample := 1.0
+		if len(args) == 2 {
+			f, err := strconv.ParseFloat(args[1], 64)
+			if err != nil {
+				return err
+			}
+			if f <= 0 || f > 1 {
+				return fmt.Errorf("decision_log sample must be in (0, 1]: %s", args[1])
+			}
+			sample = f
+		}
+		oe.decisions = newDecisionLog(args[0], sample, oe.log)
+	case "log_level":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		level, err := logging.ParseLevel(c.Val())
+		if err != nil {
+			return err
+		}
+		oe.log.SetLevel(level)
+	case "log_format":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		switch c.Val() {
+		case "text":
+			oe.log.SetJSON(false)
+		case "json":
+			oe.log.SetJSON(true)
+		default:
+			return c.Errf("unknown log format '%s'", c.Val())
+		}
 
 	default:
 		return c.Errf("unknown property '%s'", c.Val())
@@ -267,4 +674,51 @@ func parseBlock(c *caddy.Controller, oe *OptikonEdge) error {
 	return nil
 }
 
+// enableCache turns on caching of edge sites, all cache related properties do.
+func (oe *OptikonEdge) enableCache() {
+	if oe.cache == nil {
+		oe.cache = newSiteCache()
+	}
+}
+
+// enableSiteHealth turns on health checking of the edge sites.
+func (oe *OptikonEdge) enableSiteHealth() {
+	if oe.health == nil {
+		oe.health = newSiteHealth(oe.log)
+	}
+}
+
+// reporterName returns the name this edge reports site health under: its own
+// address if known, its hostname otherwise.
+func reporterName(self net.IP) string {
+	if self != nil {
+		return self.String()
+	}
+	name, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return name
+}
+
 const max = 15 // Maximum number of upstreams.
+
+const (
+	defaultTTL    = 30 // Seconds.
+	defaultMaxTTL = 3600
+)
+
+// staleAnswerTTL is the TTL in seconds of answers given while central is
+// unreachable, as recommended by RFC 8767.
+const staleAnswerTTL = 30
+
+// Timers of the SOA record of NODATA answers, in seconds. They matter to
+// secondaries only, there are none.
+const (
+	soaRefresh = 7200
+	soaRetry   = 1800
+	soaExpire  = 86400
+)
+
+// defaultMaxAge is how far from now answers of central may have been signed.
+const defaultMaxAge = 5 * time.Minute
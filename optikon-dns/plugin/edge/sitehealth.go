@@ -0,0 +1,267 @@
+package edge
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"wwwin-github.cisco.com/edge/optikon-dns/plugin/codec"
+	"wwwin-github.cisco.com/edge/optikon-dns/plugin/logging"
+)
+
+// siteHealth checks the service on every edge site learned from central that
+// declares a health check. Sites are marked down after maxfails consecutive
+// failed checks and back up after the first successful one.
+type siteHealth struct {
+	sync.RWMutex
+	sites map[string]*siteState // Keyed by siteKey.
+
+	interval time.Duration
+	timeout  time.Duration
+	maxfails uint32
+
+	// Optional reporting of the results to central.
+	reportURL    string
+	reporter     string
+	reportToken  string       // Bearer token of the management API, if it requires one.
+	reportClient *http.Client // Configured with site_health_tls for mutual TLS.
+
+	client *http.Client
+	log    *logging.Logger
+	stop   chan struct{}
+}
+
+// siteState is the health of the service on a single site.
+type siteState struct {
+	ip    string
+	check codec.HealthCheck
+	fails uint32
+	seen  time.Time
+}
+
+func newSiteHealth(log *logging.Logger) *siteHealth {
+	h := &siteHealth{
+		log:      log,
+		sites:    make(map[string]*siteState),
+		interval: defaultSiteHealthInterval,
+		timeout:  defaultSiteHealthTimeout,
+		maxfails: defaultSiteHealthMaxFails,
+		stop:     make(chan struct{}),
+	}
+	h.client = &http.Client{Timeout: h.timeout}
+	h.reportClient = &http.Client{Timeout: h.timeout}
+	return h
+}
+
+// siteKey identifies a check of a service on a site.
+func siteKey(es codec.EdgeSite) string {
+	return es.IP + "|" + es.Check.Proto + "|" + strconv.Itoa(int(es.Check.Port)) + "|" + es.Check.Path
+}
+
+// learn makes sure the health checks of all sites are run.
+func (h *siteHealth) learn(sites []codec.EdgeSite) {
+	now := time.Now()
+	for _, es := range sites {
+		if es.Check == nil {
+			continue
+		}
+		key := siteKey(es)
+
+		h.RLock()
+		s, found := h.sites[key]
+		recent := found && now.Sub(s.seen) < h.interval
+		h.RUnlock()
+		if recent {
+			continue
+		}
+
+		h.Lock()
+		if s, found = h.sites[key]; !found {
+			s = &siteState{ip: es.IP, check: *es.Check}
+			h.sites[key] = s
+		}
+		s.seen = now
+		h.Unlock()
+	}
+}
+
+// Down reports whether the service on es failed its last maxfails checks.
+func (h *siteHealth) Down(es codec.EdgeSite) bool {
+	if es.Check == nil {
+		return false
+	}
+	h.RLock()
+	defer h.RUnlock()
+	s, found := h.sites[siteKey(es)]
+	return found && s.fails >= h.maxfails
+}
+
+// filter returns the sites that aren't down. If all of them are, all sites are
+// returned: answering with a site that may be down beats not answering.
+func (h *siteHealth) filter(sites []codec.EdgeSite) []codec.EdgeSite {
+	h.learn(sites)
+
+	up := make([]codec.EdgeSite, 0, len(sites))
+	for _, es := range sites {
+		if !h.Down(es) {
+			up = append(up, es)
+		}
+	}
+	if len(up) == 0 {
+		SiteHealthFailOpenCount.Add(1)
+		return sites
+	}
+	return up
+}
+
+// start starts the health checking goroutine.
+func (h *siteHealth) start() { go h.run() }
+
+// close stops the health checking goroutine.
+func (h *siteHealth) close() { close(h.stop) }
+
+func (h *siteHealth) run() {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.stop:
+			return
+		case <-ticker.C:
+			h.checkAll()
+			if h.reportURL != "" {
+				h.report()
+			}
+		}
+	}
+}
+
+// checkAll checks every known site concurrently and forgets sites central
+// hasn't returned for a while.
+func (h *siteHealth) checkAll() {
+	forget := time.Now().Add(-siteHealthForget * h.interval)
+
+	h.Lock()
+	states := make([]*siteState, 0, len(h.sites))
+	for key, s := range h.sites {
+		if s.seen.Before(forget) {
+			delete(h.sites, key)
+			continue
+		}
+		states = append(states, s)
+	}
+	h.Unlock()
+
+	var wg sync.WaitGroup
+	for _, s := range states {
+		wg.Add(1)
+		go func(s *siteState) {
+			defer wg.Done()
+			err := h.check(s.ip, s.check)
+
+			h.Lock()
+			defer h.Unlock()
+			if err == nil {
+				if s.fails >= h.maxfails {
+					h.log.Infof("%s:%d is back up", s.ip, s.check.Port)
+				}
+				s.fails = 0
+				return
+			}
+			SiteHealthFailureCount.WithLabelValues(s.ip).Add(1)
+			s.fails++
+			if s.fails == h.maxfails {
+				h.log.Warningf("%s:%d is down: %s", s.ip, s.check.Port, err)
+			}
+		}(s)
+	}
+	wg.Wait()
+}
+
+// check runs a single health check against ip.
+func (h *siteHealth) check(ip string, hc codec.HealthCheck) error {
+	addr := net.JoinHostPort(ip, strconv.Itoa(int(hc.Port)))
+
+	if hc.Proto == checkHTTP {
+		resp, err := h.client.Get("http://" + addr + hc.Path)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+			return fmt.Errorf("unexpected status %d", resp.StatusCode)
+		}
+		return nil
+	}
+
+	conn, err := net.DialTimeout("tcp", addr, h.timeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// report sends the health of all known sites to central's management API.
+// A site is up if any of its checks passes.
+func (h *siteHealth) report() {
+	up := make(map[string]bool)
+	h.RLock()
+	for _, s := range h.sites {
+		up[s.ip] = up[s.ip] || s.fails < h.maxfails
+	}
+	h.RUnlock()
+
+	data, err := json.Marshal(up)
+	if err != nil {
+		return
+	}
+	req, err := http.NewRequest(http.MethodPut, h.reportURL+"/v1/health/"+h.reporter, bytes.NewReader(data))
+	if err != nil {
+		h.log.Errorf("reporting site health: %s", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if h.reportToken != "" {
+		req.Header.Set("Authorization", "Bearer "+h.reportToken)
+	}
+	resp, err := h.reportClient.Do(req)
+	if err != nil {
+		h.log.Errorf("reporting site health: %s", err)
+		return
+	}
+	resp.Body.Close()
+}
+
+// readToken reads the bearer token of the management API of central from the
+// file at path, without surrounding whitespace.
+func readToken(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", errEmptyToken
+	}
+	return token, nil
+}
+
+// Health check protocols.
+const (
+	checkTCP  = "tcp"
+	checkHTTP = "http"
+)
+
+const (
+	defaultSiteHealthInterval = 5 * time.Second
+	defaultSiteHealthTimeout  = 2 * time.Second
+	defaultSiteHealthMaxFails = 2
+	siteHealthForget          = 100 // Intervals after which a site not returned by central is forgotten.
+)
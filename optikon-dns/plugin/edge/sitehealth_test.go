@@ -0,0 +1,155 @@
+package edge
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"wwwin-github.cisco.com/edge/optikon-dns/plugin/codec"
+	"wwwin-github.cisco.com/edge/optikon-dns/plugin/logging"
+)
+
+// healthServer is the HTTP health check of a service, failing while down is
+// set.
+type healthServer struct {
+	*httptest.Server
+	down int32
+}
+
+func newHealthServer() *healthServer {
+	s := new(healthServer)
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" || atomic.LoadInt32(&s.down) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	return s
+}
+
+func (s *healthServer) setDown(down bool) {
+	v := int32(0)
+	if down {
+		v = 1
+	}
+	atomic.StoreInt32(&s.down, v)
+}
+
+// site returns an edge site checked by s.
+func (s *healthServer) site(t *testing.T) codec.EdgeSite {
+	t.Helper()
+	host, port, err := net.SplitHostPort(s.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return codec.EdgeSite{IP: host, Check: &codec.HealthCheck{Proto: checkHTTP, Port: uint16(p), Path: "/healthz"}}
+}
+
+// ports returns the health check ports of sites, which tell them apart.
+func ports(sites []codec.EdgeSite) []uint16 {
+	var p []uint16
+	for _, es := range sites {
+		p = append(p, es.Check.Port)
+	}
+	return p
+}
+
+func TestSiteHealth(t *testing.T) {
+	a, b := newHealthServer(), newHealthServer()
+	defer a.Close()
+	defer b.Close()
+	sites := []codec.EdgeSite{a.site(t), b.site(t)}
+
+	h := newSiteHealth(logging.New("optikon-edge"))
+	h.maxfails = 2
+
+	tests := []struct {
+		adown, bdown bool
+		up           []codec.EdgeSite
+	}{
+		{false, false, sites},
+		{false, true, sites},     // A single failure doesn't exclude a site.
+		{false, true, sites[:1]}, // maxfails failures do.
+		{false, false, sites},    // A single success readmits it.
+		{true, true, sites},
+		{true, true, sites}, // All sites down fails open.
+		{true, false, sites[1:]},
+	}
+	if got := h.filter(sites); len(got) != len(sites) {
+		t.Fatalf("expected all sites up before any check, got %v", ports(got))
+	}
+	for i, tc := range tests {
+		a.setDown(tc.adown)
+		b.setDown(tc.bdown)
+		h.checkAll()
+
+		got := h.filter(sites)
+		if len(got) != len(tc.up) {
+			t.Errorf("test %d: expected sites %v, got %v", i, ports(tc.up), ports(got))
+			continue
+		}
+		for j := range got {
+			if got[j].Check.Port != tc.up[j].Check.Port {
+				t.Errorf("test %d: expected sites %v, got %v", i, ports(tc.up), ports(got))
+				break
+			}
+		}
+	}
+}
+
+func TestSiteHealthReport(t *testing.T) {
+	type report struct {
+		method, path, auth string
+		up                 map[string]bool
+	}
+	reports := make(chan report, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rep := report{method: r.Method, path: r.URL.Path, auth: r.Header.Get("Authorization")}
+		data, _ := ioutil.ReadAll(r.Body)
+		if err := json.Unmarshal(data, &rep.up); err != nil {
+			t.Errorf("expected a JSON map of site health, got %q", data)
+		}
+		reports <- rep
+	}))
+	defer srv.Close()
+
+	h := newSiteHealth(logging.New("optikon-edge"))
+	h.maxfails = 2
+	h.reportURL = srv.URL
+	h.reporter = "edge-1"
+	h.reportToken = "secret"
+	for key, s := range map[string]*siteState{
+		"up":         {ip: "10.0.0.1", fails: 1},
+		"down":       {ip: "10.0.0.2", fails: 2},
+		"check-down": {ip: "10.0.0.3", fails: 3},
+		"check-up":   {ip: "10.0.0.3"}, // A site is up if any of its checks passes.
+	} {
+		h.sites[key] = s
+	}
+
+	h.report()
+	rep := <-reports
+	if rep.method != http.MethodPut || rep.path != "/v1/health/edge-1" {
+		t.Errorf("expected PUT /v1/health/edge-1, got %s %s", rep.method, rep.path)
+	}
+	if rep.auth != "Bearer secret" {
+		t.Errorf("expected the bearer token, got %q", rep.auth)
+	}
+	want := map[string]bool{"10.0.0.1": true, "10.0.0.2": false, "10.0.0.3": true}
+	if len(rep.up) != len(want) {
+		t.Errorf("expected %v, got %v", want, rep.up)
+	}
+	for ip, up := range want {
+		if got, found := rep.up[ip]; !found || got != up {
+			t.Errorf("%s: expected up %t, got %t", ip, up, got)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package edge
+
+import (
+	ot "github.com/opentracing/opentracing-go"
+	"golang.org/x/net/context"
+)
+
+// childSpan starts a span called name as a child of the span in ctx and returns
+// it with a context carrying it. If ctx carries no span the query isn't traced,
+// a no-op span and ctx itself are returned.
+func childSpan(ctx context.Context, name string) (ot.Span, context.Context) {
+	span := ot.SpanFromContext(ctx)
+	if span == nil {
+		return noopTracer.StartSpan(name), ctx
+	}
+	child := span.Tracer().StartSpan(name, ot.ChildOf(span.Context()))
+	return child, ot.ContextWithSpan(ctx, child)
+}
+
+// traced reports whether the query of ctx is traced.
+func traced(ctx context.Context) bool { return ot.SpanFromContext(ctx) != nil }
+
+var noopTracer ot.NoopTracer
+
+// Tags set on the spans of the edge.
+const (
+	tagCacheHit   = "optikon.cache_hit"
+	tagNegative   = "optikon.negative"
+	tagUpstream   = "optikon.upstream"
+	tagGeneration = "optikon.generation"
+	tagSites      = "optikon.sites"
+	tagCandidates = "optikon.candidates"
+	tagSite       = "optikon.site"
+	tagDistance   = "optikon.distance_km"
+	tagAnswers    = "optikon.answers"
+)
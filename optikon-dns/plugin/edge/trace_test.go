@@ -0,0 +1,141 @@
+package edge
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	ot "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"golang.org/x/net/context"
+
+	"wwwin-github.cisco.com/edge/optikon-dns/plugin/codec"
+)
+
+func TestTrace(t *testing.T) {
+	const name = "nginx.default.svc.cluster.external."
+	tracer := mocktracer.New()
+	copenhagen := codec.EdgeSite{IP: "10.0.0.1", Lat: 55.6761, Lon: 12.5683}
+	tokyo := codec.EdgeSite{IP: "10.0.0.2", Lat: 35.6895, Lon: 139.6917}
+
+	// Central answers with the edge sites and remembers the span context the
+	// edge sent along.
+	var (
+		mu      sync.Mutex
+		central []mocktracer.MockSpanContext
+	)
+	srv := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		if sc, err := codec.ExtractSpan(tracer, r); err == nil {
+			mu.Lock()
+			central = append(central, sc.(mocktracer.MockSpanContext))
+			mu.Unlock()
+		}
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.SetEdns0(dns.DefaultMsgSize, false)
+		codec.SetOption(ret, &codec.Payload{TTL: 60, Generation: 7, Sites: []codec.EdgeSite{copenhagen, tokyo}})
+		w.WriteMsg(ret)
+	})
+	defer srv.Close()
+
+	oe := New()
+	oe.lat, oe.lon = 55.6050, 13.0038 // Malmö.
+	oe.cache = newSiteCache()
+	p := NewProxy(srv.Addr, nil)
+	defer p.transport.Stop()
+	oe.proxies = append(oe.proxies, p)
+
+	query := func() *mocktracer.MockSpan {
+		root := tracer.StartSpan("forward")
+		ctx := ot.ContextWithSpan(context.Background(), root)
+		r := new(dns.Msg)
+		r.SetQuestion(name, dns.TypeA)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		if _, err := oe.ServeDNS(ctx, rec, r); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Msg == nil || len(rec.Msg.Answer) != 1 {
+			t.Fatalf("expected a single answer, got %v", rec.Msg)
+		}
+		root.Finish()
+		return root.(*mocktracer.MockSpan)
+	}
+
+	// The first query goes to central.
+	root := query()
+	spans := childSpans(tracer, root)
+	for _, op := range []string{"cache", "connect", "decode", "select", "write"} {
+		if spans[op] == nil {
+			t.Fatalf("expected a %s span under the span of the query, got %v", op, spans)
+		}
+	}
+	expectTags(t, spans["cache"], map[string]interface{}{tagCacheHit: false})
+	expectTags(t, spans["connect"], map[string]interface{}{tagUpstream: srv.Addr})
+	expectTags(t, spans["decode"], map[string]interface{}{tagGeneration: uint64(7), tagSites: 2})
+	expectTags(t, spans["select"], map[string]interface{}{tagCandidates: 2, tagSite: copenhagen.IP})
+	expectTags(t, spans["write"], map[string]interface{}{tagAnswers: 1})
+	if d, ok := spans["select"].Tag(tagDistance).(float64); !ok || d < 20 || d > 40 {
+		t.Errorf("expected a distance of about 30 km to %s, got %v", copenhagen.IP, spans["select"].Tag(tagDistance))
+	}
+
+	// Central got the context of the connect span through TraceOptionCode,
+	// so its span becomes a child of it.
+	mu.Lock()
+	if len(central) != 1 {
+		t.Fatalf("expected central to receive the span context once, got %d", len(central))
+	}
+	sc := central[0]
+	mu.Unlock()
+	connect := spans["connect"].SpanContext
+	if sc.TraceID != root.SpanContext.TraceID || sc.SpanID != connect.SpanID {
+		t.Errorf("expected central to continue trace %d from span %d, got trace %d and span %d",
+			root.SpanContext.TraceID, connect.SpanID, sc.TraceID, sc.SpanID)
+	}
+
+	// The second one is answered from the cache.
+	tracer.Reset()
+	root = query()
+	spans = childSpans(tracer, root)
+	if spans["connect"] != nil || spans["decode"] != nil {
+		t.Errorf("expected no query to central for a cache hit, got %v", spans)
+	}
+	expectTags(t, spans["cache"], map[string]interface{}{tagCacheHit: true, tagNegative: false})
+	expectTags(t, spans["select"], map[string]interface{}{tagCandidates: 2, tagSite: copenhagen.IP})
+}
+
+func TestTraceUntraced(t *testing.T) {
+	span, ctx := childSpan(context.Background(), "cache")
+	if traced(ctx) {
+		t.Error("expected a query without a span not to be traced")
+	}
+	if span.Tracer() != (ot.NoopTracer{}) {
+		t.Errorf("expected a no-op span, got %T", span)
+	}
+}
+
+// childSpans returns the finished spans whose parent is root, by operation.
+func childSpans(tracer *mocktracer.MockTracer, root *mocktracer.MockSpan) map[string]*mocktracer.MockSpan {
+	spans := make(map[string]*mocktracer.MockSpan)
+	for _, span := range tracer.FinishedSpans() {
+		if span.ParentID == root.SpanContext.SpanID && span.SpanContext.TraceID == root.SpanContext.TraceID {
+			spans[span.OperationName] = span
+		}
+	}
+	return spans
+}
+
+// expectTags checks that span carries tags.
+func expectTags(t *testing.T, span *mocktracer.MockSpan, tags map[string]interface{}) {
+	t.Helper()
+	if span == nil {
+		t.Errorf("expected a span with tags %v", tags)
+		return
+	}
+	for key, want := range tags {
+		if got := span.Tag(key); got != want {
+			t.Errorf("%s: expected tag %s %v (%T), got %v (%T)", span.OperationName, key, want, want, got, got)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+// Package logging implements the leveled logging shared by optikon-central and
+// optikon-edge.
+//
+// Every plugin instance has its own Logger, so the level and format set in one
+// server block don't leak into another. By default records are written through
+// the log package of CoreDNS, in its format, e.g.
+//
+//	[ERROR] plugin/optikon-edge: unable to decode edge sites
+//
+// As for the rest of CoreDNS, debug records are only written with the debug
+// plugin enabled. With the JSON format every record is a single JSON object on
+// its own line, debug records included:
+//
+//	{"ts":"2018-04-12T10:04:05.123Z","level":"error","plugin":"optikon-edge","msg":"unable to decode edge sites"}
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	clog "github.com/coredns/coredns/plugin/pkg/log"
+)
+
+// Level is the severity of a record.
+type Level int
+
+// Levels, records below the level of a Logger are dropped.
+const (
+	Debug Level = iota
+	Info
+	Warning
+	Error
+)
+
+// ParseLevel parses a level name, as used in the Corefile.
+func ParseLevel(s string) (Level, error) {
+	for l, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(l), nil
+		}
+	}
+	return Info, fmt.Errorf("unknown log level '%s'", s)
+}
+
+func (l Level) String() string { return levelNames[l] }
+
+var levelNames = []string{"debug", "info", "warning", "error"}
+
+// Logger writes the records of a plugin instance. Its level and format are
+// set while the instance is set up, before it logs.
+type Logger struct {
+	plugin string
+	text   clog.P
+
+	level Level
+	json  bool
+
+	mu  sync.Mutex
+	out io.Writer // Only used for JSON, text goes through CoreDNS.
+}
+
+// New returns a Logger for plugin writing text records at level Info and up.
+func New(plugin string) *Logger {
+	return &Logger{plugin: plugin, text: clog.NewWithPlugin(plugin), level: Info, out: os.Stdout}
+}
+
+// SetLevel sets the lowest level written.
+func (l *Logger) SetLevel(level Level) { l.level = level }
+
+// SetJSON switches between JSON and text records.
+func (l *Logger) SetJSON(on bool) { l.json = on }
+
+// Debugf writes a record at level Debug.
+func (l *Logger) Debugf(format string, v ...interface{}) {
+	if l.write(Debug, format, v...) {
+		l.text.Debugf(format, v...)
+	}
+}
+
+// Infof writes a record at level Info.
+func (l *Logger) Infof(format string, v ...interface{}) {
+	if l.write(Info, format, v...) {
+		l.text.Infof(format, v...)
+	}
+}
+
+// Warningf writes a record at level Warning.
+func (l *Logger) Warningf(format string, v ...interface{}) {
+	if l.write(Warning, format, v...) {
+		l.text.Warningf(format, v...)
+	}
+}
+
+// Errorf writes a record at level Error.
+func (l *Logger) Errorf(format string, v ...interface{}) {
+	if l.write(Error, format, v...) {
+		l.text.Errorf(format, v...)
+	}
+}
+
+// record is a record in the JSON format.
+type record struct {
+	Time   time.Time `json:"ts"`
+	Level  string    `json:"level"`
+	Plugin string    `json:"plugin"`
+	Msg    string    `json:"msg"`
+}
+
+// write writes a record at level in the JSON format if l uses it. It reports
+// whether the record is left to be written as text.
+func (l *Logger) write(level Level, format string, v ...interface{}) bool {
+	if level < l.level {
+		return false
+	}
+	if !l.json {
+		return true
+	}
+	data, err := json.Marshal(record{Time: time.Now().UTC(), Level: level.String(), Plugin: l.plugin, Msg: fmt.Sprintf(format, v...)})
+	if err != nil {
+		l.text.Errorf("encoding log record: %s", err)
+		return false
+	}
+	l.mu.Lock()
+	l.out.Write(append(data, '\n'))
+	l.mu.Unlock()
+	return false
+}
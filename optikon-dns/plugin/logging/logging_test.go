@@ -0,0 +1,70 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestParseLevel(t *testing.T) {
+	tests := []struct {
+		name  string
+		level Level
+		err   bool
+	}{
+		{"debug", Debug, false},
+		{"INFO", Info, false},
+		{"Warning", Warning, false},
+		{"error", Error, false},
+		{"fatal", Info, true},
+	}
+	for _, test := range tests {
+		level, err := ParseLevel(test.name)
+		if (err != nil) != test.err || level != test.level {
+			t.Errorf("%q: expected %s (error %t), got %s (%v)", test.name, test.level, test.err, level, err)
+		}
+	}
+}
+
+func TestJSON(t *testing.T) {
+	var out bytes.Buffer
+	l := New("optikon-edge")
+	l.out = &out
+	l.SetJSON(true)
+	l.SetLevel(Warning)
+
+	l.Infof("dropped")
+	l.Warningf("%s is down", "10.0.0.1:80")
+	l.Errorf("unable to decode edge sites")
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 records, got %q", out.String())
+	}
+	var r record
+	if err := json.Unmarshal([]byte(lines[0]), &r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Level != "warning" || r.Plugin != "optikon-edge" || r.Msg != "10.0.0.1:80 is down" || r.Time.IsZero() {
+		t.Errorf("unexpected record %+v", r)
+	}
+}
+
+func TestLoggersIndependent(t *testing.T) {
+	var outA, outB bytes.Buffer
+	a, b := New("optikon-edge"), New("optikon-edge")
+	a.out, b.out = &outA, &outB
+	a.SetJSON(true)
+	b.SetJSON(true)
+	a.SetLevel(Error)
+
+	a.Infof("quiet")
+	b.Infof("loud")
+	if outA.Len() != 0 {
+		t.Errorf("expected no records below the level of a, got %q", outA.String())
+	}
+	if outB.Len() == 0 {
+		t.Error("expected the level of a to leave b alone")
+	}
+}
@@ -0,0 +1,182 @@
+// Package stream implements the gRPC service over which optikon-central pushes
+// its table to optikon-edge.
+//
+// There are no protobuf definitions: the messages are plain Go structs encoded
+// as JSON by Codec, which both ends must use. The service description below is
+// what protoc-gen-go would generate for
+//
+//	service Table {
+//	  rpc Subscribe(SubscribeRequest) returns (stream Update);
+//	}
+package stream
+
+import (
+	"encoding/json"
+	"reflect"
+
+	"wwwin-github.cisco.com/edge/optikon-dns/plugin/codec"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+// SubscribeRequest starts a table stream.
+type SubscribeRequest struct {
+	Edge string `json:"edge"` // Name of the edge, for logging.
+}
+
+// Update is a message on the table stream. The first update of a stream is a
+// snapshot of the whole table, later ones hold the services that changed and
+// the names of the services that were removed.
+type Update struct {
+	Generation uint64                   `json:"generation"`
+	Snapshot   bool                     `json:"snapshot,omitempty"`
+	Services   map[string]codec.Service `json:"services,omitempty"`
+	Deleted    []string                 `json:"deleted,omitempty"`
+}
+
+// Snapshot returns the update holding all of table.
+func Snapshot(table map[string]codec.Service, gen uint64) *Update {
+	return &Update{Generation: gen, Snapshot: true, Services: table}
+}
+
+// Diff returns the update turning table old into new.
+func Diff(old, new map[string]codec.Service, gen uint64) *Update {
+	u := &Update{Generation: gen, Services: make(map[string]codec.Service)}
+	for name, svc := range new {
+		if prev, found := old[name]; !found || !reflect.DeepEqual(prev, svc) {
+			u.Services[name] = svc
+		}
+	}
+	for name := range old {
+		if _, found := new[name]; !found {
+			u.Deleted = append(u.Deleted, name)
+		}
+	}
+	return u
+}
+
+// Apply returns the table resulting from applying u to table, which is not
+// modified.
+func Apply(table map[string]codec.Service, u *Update) map[string]codec.Service {
+	if u.Snapshot {
+		return u.Services
+	}
+	t := make(map[string]codec.Service, len(table)+len(u.Services))
+	for name, svc := range table {
+		t[name] = svc
+	}
+	for name, svc := range u.Services {
+		t[name] = svc
+	}
+	for _, name := range u.Deleted {
+		delete(t, name)
+	}
+	return t
+}
+
+// Codec encodes the messages of the service as JSON. Use it with
+// grpc.CustomCodec on the server and grpc.WithCodec on the client.
+type Codec struct{}
+
+// Marshal implements grpc.Codec.
+func (Codec) Marshal(v interface{}) ([]byte, error) { return json.Marshal(v) }
+
+// Unmarshal implements grpc.Codec.
+func (Codec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+// String implements grpc.Codec.
+func (Codec) String() string { return "json" }
+
+// TableServer is the server API of the table service.
+type TableServer interface {
+	Subscribe(*SubscribeRequest, SubscribeServer) error
+}
+
+// SubscribeServer is the server side of a table stream.
+type SubscribeServer interface {
+	Send(*Update) error
+	grpc.ServerStream
+}
+
+type subscribeServer struct {
+	grpc.ServerStream
+}
+
+func (x *subscribeServer) Send(m *Update) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func subscribeHandler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(SubscribeRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(TableServer).Subscribe(m, &subscribeServer{stream})
+}
+
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: "optikon.Table",
+	HandlerType: (*TableServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Subscribe",
+			Handler:       subscribeHandler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "optikon/table",
+}
+
+// RegisterTableServer registers srv with s.
+func RegisterTableServer(s *grpc.Server, srv TableServer) {
+	s.RegisterService(&serviceDesc, srv)
+}
+
+// TableClient is the client API of the table service.
+type TableClient interface {
+	Subscribe(ctx context.Context, in *SubscribeRequest, opts ...grpc.CallOption) (SubscribeClient, error)
+}
+
+type tableClient struct {
+	cc *grpc.ClientConn
+}
+
+// NewTableClient returns a client of the table service on cc.
+func NewTableClient(cc *grpc.ClientConn) TableClient {
+	return &tableClient{cc}
+}
+
+func (c *tableClient) Subscribe(ctx context.Context, in *SubscribeRequest, opts ...grpc.CallOption) (SubscribeClient, error) {
+	stream, err := grpc.NewClientStream(ctx, &serviceDesc.Streams[0], c.cc, "/optikon.Table/Subscribe", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &subscribeClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// SubscribeClient is the client side of a table stream.
+type SubscribeClient interface {
+	Recv() (*Update, error)
+	grpc.ClientStream
+}
+
+type subscribeClient struct {
+	grpc.ClientStream
+}
+
+func (x *subscribeClient) Recv() (*Update, error) {
+	m := new(Update)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}